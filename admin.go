@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Bearer token for the endpoints which change state or serve what machines
+// uploaded. If nil, those endpoints are refused.
+var adminToken []byte
+
+// requireAdmin only passes requests with the -admin-token-file bearer token
+// on to handler.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == nil {
+			log.Printf("Refusing %s %s from %s: -admin-token-file wasn't provided", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+			log.Printf("Refusing %s %s from %s: wrong admin token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dhcpv6macd"`)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
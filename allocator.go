@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// prefixLength is the number of bytes of the base address we keep. The MAC
+// address fills in the remaining 48 bits.
+const prefixLength = 10
+
+// Allocator derives a machine's IPv6 address from its MAC address by
+// concatenating the MAC onto the base address' /80 prefix. Because the scheme
+// is reversible, it can also recover the MAC from an address it issued.
+type Allocator struct {
+	prefix net.IP
+}
+
+func NewAllocator(baseAddress net.IP) *Allocator {
+	prefix := make(net.IP, prefixLength)
+	copy(prefix, baseAddress.To16()[:prefixLength])
+
+	return &Allocator{prefix: prefix}
+}
+
+// AddressFor returns the address issued to the given MAC.
+func (a *Allocator) AddressFor(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, 0, net.IPv6len)
+	ip = append(ip, a.prefix...)
+	return append(ip, mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+}
+
+// Contains reports whether the address is inside the allocator's prefix.
+func (a *Allocator) Contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil || ip.To4() != nil {
+		return false
+	}
+
+	return bytes.Equal(ip16[:prefixLength], a.prefix)
+}
+
+// MACFor recovers the MAC address an issued address was derived from.
+func (a *Allocator) MACFor(ip net.IP) (net.HardwareAddr, error) {
+	if !a.Contains(ip) {
+		return nil, fmt.Errorf("address %s is not inside the allocator's prefix %s/80", ip, a.prefix)
+	}
+
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, ip.To16()[prefixLength:])
+	return mac, nil
+}
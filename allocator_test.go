@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllocatorRoundTrip(t *testing.T) {
+	allocator := NewAllocator(net.ParseIP("fd19:287e:c5a0:4931::"))
+	mac := net.HardwareAddr{0x02, 0xde, 0xad, 0xbe, 0xef, 0x01}
+
+	ip := allocator.AddressFor(mac)
+	if want := net.ParseIP("fd19:287e:c5a0:4931:0:2de:adbe:ef01"); !ip.Equal(want) {
+		t.Fatalf("Wanted %s, got %s", want, ip)
+	}
+
+	got, err := allocator.MACFor(ip)
+	if err != nil {
+		t.Fatalf("MACFor failure: %v", err)
+	}
+	if got.String() != mac.String() {
+		t.Fatalf("Wanted %s, got %s", mac, got)
+	}
+}
+
+func TestAllocatorRejectsForeignAddresses(t *testing.T) {
+	allocator := NewAllocator(net.ParseIP("fd19:287e:c5a0:4931::"))
+
+	for _, s := range []string{"fd19:287e:c5a0:4932::1", "fe80::1", "192.0.2.1"} {
+		if _, err := allocator.MACFor(net.ParseIP(s)); err == nil {
+			t.Fatalf("Expected %s to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// archNames are the IANA processor architecture types, named like the
+// constants in the iana package.
+var archNames = map[string]iana.Arch{
+	"INTEL_X86PC":       iana.INTEL_X86PC,
+	"NEC_PC98":          iana.NEC_PC98,
+	"EFI_ITANIUM":       iana.EFI_ITANIUM,
+	"DEC_ALPHA":         iana.DEC_ALPHA,
+	"ARC_X86":           iana.ARC_X86,
+	"INTEL_LEAN_CLIENT": iana.INTEL_LEAN_CLIENT,
+	"EFI_IA32":          iana.EFI_IA32,
+	"EFI_X86_64":        iana.EFI_X86_64,
+	"EFI_XSCALE":        iana.EFI_XSCALE,
+	"EFI_BC":            iana.EFI_BC,
+	"EFI_ARM32":         iana.EFI_ARM32,
+	"EFI_ARM64":         iana.EFI_ARM64,
+	"PPC_OPEN_FIRMWARE": iana.PPC_OPEN_FIRMWARE,
+	"PPC_EPAPR":         iana.PPC_EPAPR,
+	"PPC_OPAL":          iana.PPC_OPAL,
+	"EFI_X86_HTTP":      iana.EFI_X86_HTTP,
+	"EFI_X86_64_HTTP":   iana.EFI_X86_64_HTTP,
+	"EFI_BC_HTTP":       iana.EFI_BC_HTTP,
+	"EFI_ARM32_HTTP":    iana.EFI_ARM32_HTTP,
+	"EFI_ARM64_HTTP":    iana.EFI_ARM64_HTTP,
+	"INTEL_X86PC_HTTP":  iana.INTEL_X86PC_HTTP,
+	"UBOOT_ARM32":       iana.UBOOT_ARM32,
+	"UBOOT_ARM64":       iana.UBOOT_ARM64,
+	"UBOOT_ARM32_HTTP":  iana.UBOOT_ARM32_HTTP,
+	"UBOOT_ARM64_HTTP":  iana.UBOOT_ARM64_HTTP,
+	"EFI_RISCV32":       iana.EFI_RISCV32,
+	"EFI_RISCV32_HTTP":  iana.EFI_RISCV32_HTTP,
+	"EFI_RISCV64":       iana.EFI_RISCV64,
+	"EFI_RISCV64_HTTP":  iana.EFI_RISCV64_HTTP,
+	"EFI_RISCV128":      iana.EFI_RISCV128,
+	"EFI_RISCV128_HTTP": iana.EFI_RISCV128_HTTP,
+	"S390_BASIC":        iana.S390_BASIC,
+	"S390_EXTENDED":     iana.S390_EXTENDED,
+	"EFI_MIPS32":        iana.EFI_MIPS32,
+	"EFI_MIPS64":        iana.EFI_MIPS64,
+	"EFI_SUNWAY32":      iana.EFI_SUNWAY32,
+	"EFI_SUNWAY64":      iana.EFI_SUNWAY64,
+}
+
+// parseArch parses an architecture type by name, like EFI_ARM64_HTTP, or by
+// number, like 19.
+func parseArch(s string) (iana.Arch, error) {
+	if arch, ok := archNames[strings.ToUpper(s)]; ok {
+		return arch, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown architecture type %q", s)
+	}
+
+	return iana.Arch(n), nil
+}
+
+// archName is the inverse of parseArch, preferring the name.
+func archName(arch iana.Arch) string {
+	for name, a := range archNames {
+		if a == arch {
+			return name
+		}
+	}
+
+	return strconv.Itoa(int(arch))
+}
+
+// UnsupportedArchEvent is the detail of an unsupported_arch event, emitted
+// when we have nothing to boot a client's architecture with.
+type UnsupportedArchEvent struct {
+	Protocol      string   `json:"protocol"`
+	Architectures []string `json:"architectures,omitempty"`
+	Filename      string   `json:"file_name,omitempty"`
+	Error         string   `json:"error"`
+}
+
+// archFlag collects repeated ARCH=VALUE flags.
+type archFlag map[iana.Arch]string
+
+func (f archFlag) String() string {
+	parts := make([]string, 0, len(f))
+	for arch, value := range f {
+		parts = append(parts, archName(arch)+"="+value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f archFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected ARCH=VALUE, got %q", s)
+	}
+
+	arch, err := parseArch(name)
+	if err != nil {
+		return err
+	}
+
+	f[arch] = value
+	return nil
+}
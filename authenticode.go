@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// What to do with PE files which fail -authenticode-trusted-certs.
+const (
+	// authenticodeFlag serves them, reporting the failure in the event
+	authenticodeFlag = "flag"
+	// authenticodeRefuse refuses them with http_fetch_denied
+	authenticodeRefuse = "refuse"
+)
+
+// Certificates which boot files must be signed by, or chain to. If nil,
+// signatures aren't checked.
+var authenticodeTrusted []*x509.Certificate
+
+// SignatureInfo is the result of checking a PE file's Authenticode
+// signature.
+type SignatureInfo struct {
+	Valid bool `json:"valid"`
+	// Subject, Issuer and Serial describe the signing certificate
+	Subject string `json:"subject,omitempty"`
+	Issuer  string `json:"issuer,omitempty"`
+	Serial  string `json:"serial,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSpcIndirect   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidDigestSHA256  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidDigestSHA384  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidDigestSHA512  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// authenticodeHashes are the digest algorithms we check signatures with, by
+// OID.
+var authenticodeHashes = map[string]crypto.Hash{
+	oidDigestSHA256.String(): crypto.SHA256,
+	oidDigestSHA384.String(): crypto.SHA384,
+	oidDigestSHA512.String(): crypto.SHA512,
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type spcIndirectDataContent struct {
+	Data          asn1.RawValue
+	MessageDigest spcDigestInfo
+}
+
+type spcDigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// LoadAuthenticodeCerts reads PEM or DER certificates from a file, or from
+// every file in a directory.
+func LoadAuthenticodeCerts(path string) ([]*x509.Certificate, error) {
+	files := []string{path}
+
+	if stat, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if stat.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = nil
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	var certs []*x509.Certificate
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Contains(data, []byte("-----BEGIN")) {
+			cert, err := x509.ParseCertificate(data)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", file, err)
+			}
+			certs = append(certs, cert)
+			continue
+		}
+
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", file, err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+
+	return certs, nil
+}
+
+// authenticodeResults caches checkAuthenticode's results by the hex SHA-256
+// of the file, so files are checked when they are first seen or change.
+// Files which aren't PE files are cached as nil.
+var authenticodeResults sumCache[*SignatureInfo]
+
+// authenticodeFor checks the file with the hex SHA-256 sum, if it isn't
+// cached. It is nil if the file isn't a PE file.
+func authenticodeFor(sum string, r io.ReaderAt, size int64) *SignatureInfo {
+	if info, ok := authenticodeResults.get(sum); ok {
+		return info
+	}
+
+	info := checkAuthenticode(r, size, authenticodeTrusted)
+	authenticodeResults.put(sum, info)
+	return info
+}
+
+// checkAuthenticode verifies a PE file's signature, and that its signer is,
+// or chains to, one of trusted. It returns nil if r isn't a PE file.
+func checkAuthenticode(r io.ReaderAt, size int64, trusted []*x509.Certificate) *SignatureInfo {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil
+	}
+	f.Close()
+
+	info := &SignatureInfo{}
+
+	layout, err := readPELayout(r)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	signer, err := verifyAuthenticode(r, size, layout, trusted)
+	if signer != nil {
+		info.Subject = signer.Subject.String()
+		info.Issuer = signer.Issuer.String()
+		info.Serial = signer.SerialNumber.Text(16)
+	}
+	if err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Valid = true
+	}
+
+	return info
+}
+
+// peLayout locates the parts of a PE file which its Authenticode hash skips.
+type peLayout struct {
+	checksumOffset int64
+	certDirOffset  int64
+	certTable      pe.DataDirectory
+}
+
+func readPELayout(r io.ReaderAt) (peLayout, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return peLayout{}, err
+	}
+	defer f.Close()
+
+	var lfanew [4]byte
+	if _, err := r.ReadAt(lfanew[:], 0x3c); err != nil {
+		return peLayout{}, err
+	}
+
+	// The optional header follows the signature and the file header
+	optional := int64(binary.LittleEndian.Uint32(lfanew[:])) + 4 + 20
+	layout := peLayout{checksumOffset: optional + 64}
+
+	switch header := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		layout.certDirOffset = optional + 96 + pe.IMAGE_DIRECTORY_ENTRY_SECURITY*8
+		if header.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			layout.certTable = header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		}
+	case *pe.OptionalHeader64:
+		layout.certDirOffset = optional + 112 + pe.IMAGE_DIRECTORY_ENTRY_SECURITY*8
+		if header.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			layout.certTable = header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		}
+	default:
+		return peLayout{}, errors.New("no optional header")
+	}
+
+	return layout, nil
+}
+
+// authenticodeDigest hashes the file the way it was signed: all of it, except
+// for the checksum, the certificate table's directory entry and the table
+// itself.
+func authenticodeDigest(r io.ReaderAt, size int64, layout peLayout, hash crypto.Hash) ([]byte, error) {
+	tableStart := int64(layout.certTable.VirtualAddress)
+	tableEnd := tableStart + int64(layout.certTable.Size)
+	if layout.certTable.Size == 0 {
+		tableStart, tableEnd = size, size
+	}
+
+	h := hash.New()
+	for _, span := range [][2]int64{
+		{0, layout.checksumOffset},
+		{layout.checksumOffset + 4, layout.certDirOffset},
+		{layout.certDirOffset + 8, tableStart},
+		{tableEnd, size},
+	} {
+		if _, err := io.Copy(h, io.NewSectionReader(r, span[0], span[1]-span[0])); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.Sum(nil), nil
+}
+
+// verifyAuthenticode checks the file's first PKCS#7 signature. The signer is
+// returned whenever it could be found, even if the signature is bad.
+func verifyAuthenticode(r io.ReaderAt, size int64, layout peLayout, trusted []*x509.Certificate) (*x509.Certificate, error) {
+	table := layout.certTable
+	if table.Size == 0 {
+		return nil, errors.New("unsigned")
+	}
+	if int64(table.VirtualAddress)+int64(table.Size) > size || table.Size < 8 {
+		return nil, errors.New("certificate table is out of bounds")
+	}
+
+	// The table is a list of WIN_CERTIFICATEs, each padded to 8 bytes
+	data := make([]byte, table.Size)
+	if _, err := r.ReadAt(data, int64(table.VirtualAddress)); err != nil {
+		return nil, err
+	}
+
+	var signature []byte
+	for len(data) >= 8 {
+		length := binary.LittleEndian.Uint32(data[0:4])
+		certType := binary.LittleEndian.Uint16(data[6:8])
+		if length < 8 || int(length) > len(data) {
+			return nil, errors.New("malformed certificate table")
+		}
+
+		// WIN_CERT_TYPE_PKCS_SIGNED_DATA
+		if certType == 2 {
+			signature = data[8:length]
+			break
+		}
+
+		data = data[min(int(length+7)&^7, len(data)):]
+	}
+	if signature == nil {
+		return nil, errors.New("no PKCS#7 signature")
+	}
+
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(signature, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("malformed PKCS#7 signature")
+	}
+
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("malformed PKCS#7 signed data: %w", err)
+	}
+
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirect) {
+		return nil, errors.New("not an Authenticode signature")
+	}
+
+	// With an explicit tag, Bytes is the whole inner SpcIndirectDataContent
+	var indirect spcIndirectDataContent
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &indirect); err != nil {
+		return nil, fmt.Errorf("malformed Authenticode content: %w", err)
+	}
+
+	hash, ok := authenticodeHashes[indirect.MessageDigest.Algorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", indirect.MessageDigest.Algorithm.Algorithm)
+	}
+
+	digest, err := authenticodeDigest(r, size, layout, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest, indirect.MessageDigest.Digest) {
+		return nil, errors.New("the file doesn't match its signature")
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the signature's certificates: %w", err)
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("wanted one signer, got %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	var signer *x509.Certificate
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) &&
+			cert.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 {
+			signer = cert
+			break
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("the signer's certificate is missing")
+	}
+
+	// Unlike PKCS#7, Authenticode signs the content without its tag and
+	// length
+	var content asn1.RawValue
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return signer, fmt.Errorf("malformed Authenticode content: %w", err)
+	}
+
+	if err := verifySignerInfo(si, signer, content.Bytes); err != nil {
+		return signer, err
+	}
+
+	if !chainsTo(signer, certs, trusted) {
+		return signer, errors.New("the signer isn't trusted")
+	}
+
+	return signer, nil
+}
+
+// verifySignerInfo checks the signer signed the authenticated attributes, and
+// that they carry the digest of content.
+func verifySignerInfo(si pkcs7SignerInfo, signer *x509.Certificate, content []byte) error {
+	hash, ok := authenticodeHashes[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+
+	if len(si.AuthenticatedAttributes.FullBytes) == 0 {
+		return errors.New("no authenticated attributes")
+	}
+
+	var messageDigest []byte
+	for rest := si.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+		var attr pkcs7Attribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return fmt.Errorf("malformed authenticated attributes: %w", err)
+		}
+
+		if attr.Type.Equal(oidMessageDigest) {
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &messageDigest); err != nil {
+				return fmt.Errorf("malformed message digest: %w", err)
+			}
+		}
+	}
+
+	h := hash.New()
+	h.Write(content)
+	if !bytes.Equal(messageDigest, h.Sum(nil)) {
+		return errors.New("the authenticated attributes don't match the content")
+	}
+
+	algorithm, err := signatureAlgorithm(signer, hash)
+	if err != nil {
+		return err
+	}
+
+	// The attributes are signed as a SET, not with their implicit [0] tag
+	signed := append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+	if err := signer.CheckSignature(algorithm, signed, si.EncryptedDigest); err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+
+	return nil
+}
+
+func signatureAlgorithm(cert *x509.Certificate, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		switch hash {
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	case *ecdsa.PublicKey:
+		switch hash {
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	}
+
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signing key %T", cert.PublicKey)
+}
+
+// chainsTo reports whether cert is one of trusted, or was signed by one of
+// them through intermediates. Like firmware, it ignores validity periods and
+// key usages.
+func chainsTo(cert *x509.Certificate, intermediates, trusted []*x509.Certificate) bool {
+	for depth := 0; depth < 8; depth++ {
+		for _, root := range trusted {
+			if cert.Equal(root) || signedBy(cert, root) {
+				return true
+			}
+		}
+
+		var parent *x509.Certificate
+		for _, candidate := range intermediates {
+			if !candidate.Equal(cert) && signedBy(cert, candidate) {
+				parent = candidate
+				break
+			}
+		}
+		if parent == nil {
+			return false
+		}
+		cert = parent
+	}
+
+	return false
+}
+
+func signedBy(cert, parent *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, parent.RawSubject) &&
+		parent.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T, name string) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, cert
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// tagged wraps DER in a constructed tag, like an explicit [0] or a SET.
+func tagged(t *testing.T, class, tag int, contents ...[]byte) []byte {
+	return mustMarshal(t, asn1.RawValue{Class: class, Tag: tag, IsCompound: true, Bytes: bytes.Join(contents, nil)})
+}
+
+// signTestPE appends an Authenticode signature by cert to a PE file.
+func signTestPE(t *testing.T, unsigned []byte, key *ecdsa.PrivateKey, cert *x509.Certificate) []byte {
+	layout, err := readPELayout(bytes.NewReader(unsigned))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := authenticodeDigest(bytes.NewReader(unsigned), int64(len(unsigned)), layout, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidDigestSHA256, Parameters: asn1.NullRawValue}
+
+	// SpcPEImageData's contents don't matter to us
+	indirect := mustMarshal(t, spcIndirectDataContent{
+		Data:          asn1.RawValue{FullBytes: mustMarshal(t, struct{ Type asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}})},
+		MessageDigest: spcDigestInfo{Algorithm: sha256Algorithm, Digest: digest},
+	})
+
+	var content asn1.RawValue
+	mustUnmarshal(t, indirect, &content)
+	contentDigest := sha256.Sum256(content.Bytes)
+
+	attrs := bytes.Join([][]byte{
+		mustMarshal(t, pkcs7Attribute{
+			Type:   asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3},
+			Values: asn1.RawValue{FullBytes: tagged(t, asn1.ClassUniversal, asn1.TagSet, mustMarshal(t, oidSpcIndirect))},
+		}),
+		mustMarshal(t, pkcs7Attribute{
+			Type:   oidMessageDigest,
+			Values: asn1.RawValue{FullBytes: tagged(t, asn1.ClassUniversal, asn1.TagSet, mustMarshal(t, contentDigest[:]))},
+		}),
+	}, nil)
+
+	signedAttrs := sha256.Sum256(tagged(t, asn1.ClassUniversal, asn1.TagSet, attrs))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, signedAttrs[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedData := mustMarshal(t, pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo: pkcs7ContentInfo{
+			ContentType: oidSpcIndirect,
+			Content:     asn1.RawValue{FullBytes: tagged(t, asn1.ClassContextSpecific, 0, indirect)},
+		},
+		Certificates: asn1.RawValue{FullBytes: tagged(t, asn1.ClassContextSpecific, 0, cert.Raw)},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: pkcs7IssuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:           sha256Algorithm,
+			AuthenticatedAttributes:   asn1.RawValue{FullBytes: tagged(t, asn1.ClassContextSpecific, 0, attrs)},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			EncryptedDigest:           signature,
+		}},
+	})
+
+	pkcs7 := mustMarshal(t, pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{FullBytes: tagged(t, asn1.ClassContextSpecific, 0, signedData)},
+	})
+
+	// A WIN_CERTIFICATE of WIN_CERT_TYPE_PKCS_SIGNED_DATA, padded to 8 bytes
+	var winCert bytes.Buffer
+	binary.Write(&winCert, binary.LittleEndian, uint32(8+len(pkcs7)))
+	binary.Write(&winCert, binary.LittleEndian, uint16(0x0200))
+	binary.Write(&winCert, binary.LittleEndian, uint16(2))
+	winCert.Write(pkcs7)
+	winCert.Write(make([]byte, (8-winCert.Len()%8)%8))
+
+	signed := append([]byte{}, unsigned...)
+	binary.LittleEndian.PutUint32(signed[layout.certDirOffset:], uint32(len(unsigned)))
+	binary.LittleEndian.PutUint32(signed[layout.certDirOffset+4:], uint32(winCert.Len()))
+
+	return append(signed, winCert.Bytes()...)
+}
+
+func mustUnmarshal(t *testing.T, der []byte, v interface{}) {
+	if _, err := asn1.Unmarshal(der, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckAuthenticode(t *testing.T) {
+	key, cert := newTestSigner(t, "Test Secure Boot Signer")
+	_, other := newTestSigner(t, "Someone Else")
+
+	unsigned := buildUKIAddon(pe.IMAGE_FILE_MACHINE_AMD64, "quiet")
+	signed := signTestPE(t, unsigned, key, cert)
+
+	check := func(file []byte, trusted ...*x509.Certificate) *SignatureInfo {
+		return checkAuthenticode(bytes.NewReader(file), int64(len(file)), trusted)
+	}
+
+	if info := check(signed, cert); info == nil || !info.Valid || info.Subject != "CN=Test Secure Boot Signer" {
+		t.Fatalf("Wanted a valid signature, got %+v", info)
+	}
+
+	if info := check(signed, other); info == nil || info.Valid || info.Error != "the signer isn't trusted" || info.Subject == "" {
+		t.Fatalf("Wanted an untrusted signer, got %+v", info)
+	}
+
+	if info := check(unsigned, cert); info == nil || info.Valid || info.Error != "unsigned" {
+		t.Fatalf("Wanted an unsigned file, got %+v", info)
+	}
+
+	tampered := append([]byte{}, signed...)
+	tampered[0x200] ^= 0xff
+	if info := check(tampered, cert); info == nil || info.Valid || info.Error != "the file doesn't match its signature" {
+		t.Fatalf("Wanted a tampered file, got %+v", info)
+	}
+
+	if info := check([]byte("#!ipxe\n"), cert); info != nil {
+		t.Fatalf("Wanted nothing for a file which isn't PE, got %+v", info)
+	}
+}
+
+// TestCheckAuthenticodeGolden checks a file signed with an RSA key outside of
+// this code, by testdata/authenticode/generate.sh.
+func TestCheckAuthenticodeGolden(t *testing.T) {
+	signed, err := os.ReadFile("testdata/authenticode/signed.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := os.ReadFile("testdata/authenticode/unsigned.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := LoadAuthenticodeCerts("testdata/authenticode/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := LoadAuthenticodeCerts("testdata/authenticode/signer.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(file []byte, trusted []*x509.Certificate) *SignatureInfo {
+		return checkAuthenticode(bytes.NewReader(file), int64(len(file)), trusted)
+	}
+
+	for _, trusted := range [][]*x509.Certificate{ca, signer} {
+		info := check(signed, trusted)
+		if info == nil || !info.Valid || info.Subject != "CN=Test Secure Boot Signer" || info.Issuer != "CN=Test Secure Boot CA" || info.Serial != "2a" {
+			t.Fatalf("Wanted a valid signature trusting %s, got %+v", trusted[0].Subject, info)
+		}
+	}
+
+	_, other := newTestSigner(t, "Someone Else")
+	if info := check(signed, []*x509.Certificate{other}); info == nil || info.Valid || info.Error != "the signer isn't trusted" {
+		t.Fatalf("Wanted an untrusted signer, got %+v", info)
+	}
+
+	if info := check(unsigned, ca); info == nil || info.Valid || info.Error != "unsigned" {
+		t.Fatalf("Wanted an unsigned file, got %+v", info)
+	}
+}
+
+func TestServeAuthenticodeRefused(t *testing.T) {
+	key, cert := newTestSigner(t, "Test Secure Boot Signer")
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "db.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	authenticodeTrusted, err = LoadAuthenticodeCerts(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*authenticodePolicy = authenticodeRefuse
+	defer func() {
+		authenticodeTrusted = nil
+		*authenticodePolicy = authenticodeFlag
+	}()
+
+	for mac, file := range map[string][]byte{
+		"04:42:1a:03:9b:20": signTestPE(t, buildUKIAddon(pe.IMAGE_FILE_MACHINE_AMD64, "signed"), key, cert),
+		"04:42:1a:03:9b:21": buildUKIAddon(pe.IMAGE_FILE_MACHINE_AMD64, "unsigned"),
+		"04:42:1a:03:9b:22": []byte("not PE at all"),
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, mac), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, mac, "boot.efi"), file, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux, broker, _ := newTestWebserver(t, dir)
+
+	subscriber, unsubscribe := broker.SubscribeBuffered(64)
+	defer unsubscribe()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/boot.efi", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wanted the signed file, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:21/boot.efi", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Wanted the unsigned file refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:22/boot.efi", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Wanted a .efi which isn't PE refused, got %d", w.Code)
+	}
+
+	var signed, denied *SignatureInfo
+	for signed == nil || denied == nil {
+		ev := <-subscriber
+		detail, _ := ev.Event.Detail.(TransferEvent)
+		switch {
+		case ev.Event.Event == "http_fetch_uki":
+			signed = detail.Signature
+		case ev.Event.Event == "http_fetch_denied" && strings.Contains(detail.Filename, "04:42:1a:03:9b:21"):
+			denied = detail.Signature
+		}
+	}
+
+	if !signed.Valid || signed.Subject != "CN=Test Secure Boot Signer" || denied.Valid || denied.Error != "unsigned" {
+		t.Fatalf("Wrong signature details: %+v %+v", signed, denied)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// Boot intents say what a machine should do when its firmware asks to
+// netboot.
+const (
+	// intentAlways always netboots, which is the default
+	intentAlways = "always"
+	// intentLocal withholds the boot URL, so the firmware falls through to
+	// the next boot option, usually the local disk
+	intentLocal = "local"
+	// intentReprovisionOnce netboots until the machine reaches os_init, then
+	// becomes intentLocal
+	intentReprovisionOnce = "reprovision-once"
+)
+
+func validIntent(intent string) bool {
+	return intent == intentAlways || intent == intentLocal || intent == intentReprovisionOnce
+}
+
+// intentTransitions change a machine's intent when it has an event.
+var intentTransitions = map[string]map[string]string{
+	intentReprovisionOnce: {"os_init": intentLocal},
+}
+
+// BootIntentEvent is the detail of boot_intent_changed and boot_withheld
+// events.
+type BootIntentEvent struct {
+	Intent   string `json:"intent"`
+	Previous string `json:"previous,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// BootIntents are the machines' boot intents, persisted as a JSON object of
+// MACs to intents. Machines which aren't in it have the default intent.
+type BootIntents struct {
+	file          string
+	defaultIntent string
+
+	mu      sync.Mutex
+	intents map[string]string
+}
+
+var bootIntents *BootIntents
+
+func LoadBootIntents(file, defaultIntent string) (*BootIntents, error) {
+	if !validIntent(defaultIntent) {
+		return nil, fmt.Errorf("invalid default boot intent %q", defaultIntent)
+	}
+
+	bi := &BootIntents{file: file, defaultIntent: defaultIntent, intents: make(map[string]string)}
+
+	if file == "" {
+		return bi, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return bi, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading the boot intents %q: %w", file, err)
+	}
+
+	if err := json.Unmarshal(data, &bi.intents); err != nil {
+		return nil, fmt.Errorf("parsing the boot intents %q: %w", file, err)
+	}
+
+	for mac, intent := range bi.intents {
+		if !validIntent(intent) {
+			return nil, fmt.Errorf("invalid boot intent %q for %s", intent, mac)
+		}
+	}
+
+	return bi, nil
+}
+
+// Intent returns the machine's boot intent.
+func (bi *BootIntents) Intent(mac net.HardwareAddr) string {
+	if bi == nil {
+		return intentAlways
+	}
+
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+
+	if intent, ok := bi.intents[mac.String()]; ok {
+		return intent
+	}
+	return bi.defaultIntent
+}
+
+// All returns the machines with an intent of their own.
+func (bi *BootIntents) All() map[string]string {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+
+	all := make(map[string]string, len(bi.intents))
+	for mac, intent := range bi.intents {
+		all[mac] = intent
+	}
+	return all
+}
+
+// Set changes the machine's intent, and returns the previous one.
+func (bi *BootIntents) Set(mac net.HardwareAddr, intent string) (string, error) {
+	if !validIntent(intent) {
+		return "", fmt.Errorf("invalid boot intent %q, wanted %s, %s or %s", intent, intentAlways, intentLocal, intentReprovisionOnce)
+	}
+
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+
+	previous, ok := bi.intents[mac.String()]
+	if !ok {
+		previous = bi.defaultIntent
+	}
+
+	bi.intents[mac.String()] = intent
+
+	if bi.file != "" {
+		if err := writeJSONFile(bi.file, bi.intents); err != nil {
+			return previous, fmt.Errorf("writing the boot intents: %w", err)
+		}
+	}
+
+	return previous, nil
+}
+
+// observe moves intents along intentTransitions.
+func (bi *BootIntents) observe(ev IdentifiedEvent) {
+	if ev.Mac == nil || ev.Event.Repeated {
+		return
+	}
+	mac := net.HardwareAddr(ev.Mac)
+
+	current := bi.Intent(mac)
+	next, ok := intentTransitions[current][ev.Event.Event]
+	if !ok {
+		return
+	}
+
+	if _, err := bi.Set(mac, next); err != nil {
+		log.Printf("Failed to change the boot intent of %s: %v", mac, err)
+	}
+
+	// The event's publisher may have the machine locked
+	go func() {
+		if machine := machines.GetMachine(mac); machine != nil {
+			machine.Notify("boot_intent_changed", BootIntentEvent{
+				Intent:   next,
+				Previous: current,
+				Reason:   ev.Event.Event,
+			})
+		}
+	}()
+}
+
+// Watch changes intents as the events which change them are published, so
+// a machine's next Solicit already gets its new intent.
+func (bi *BootIntents) Watch(broker *Broker) {
+	broker.Observe(bi.observe)
+}
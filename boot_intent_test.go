@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func newTestHTTPBootSolicit(t *testing.T, mac net.HardwareAddr) *dhcpv6.Message {
+	msg, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatalf("NewMessage failure: %v", err)
+	}
+	msg.MessageType = dhcpv6.MessageTypeSolicit
+	msg.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: mac}))
+	msg.AddOption(dhcpv6.OptClientArchType(iana.EFI_X86_64_HTTP))
+	msg.AddOption(&dhcpv6.OptVendorClass{Data: [][]byte{[]byte("HTTPClient:Arch:00016:UNDI:003001")}})
+	msg.AddOption(&dhcpv6.OptIANA{})
+	return msg
+}
+
+// bootFileURLFor runs a solicit through the handler and returns the Boot File
+// URL we answered with, if any.
+func bootFileURLFor(t *testing.T, s *DHCPv6Handler, msg *dhcpv6.Message) string {
+	resp, err := dhcpv6.NewAdvertiseFromSolicit(msg)
+	if err != nil {
+		t.Fatalf("NewAdvertiseFromSolicit failure: %v", err)
+	}
+
+	if err := s.process(&net.UDPAddr{IP: net.ParseIP("fe80::1")}, msg, msg, resp); err != nil {
+		t.Fatalf("process failure: %v", err)
+	}
+
+	return resp.Options.BootFileURL()
+}
+
+func TestBootIntents(t *testing.T) {
+	s := newTestLeaseQueryHandler()
+
+	var err error
+	httpBootTemplate, err = newBootTemplate("test", "http://netboot/{{.MAC}}?intent={{.Intent}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { httpBootTemplate = nil }()
+
+	file := filepath.Join(t.TempDir(), "intents.json")
+	bootIntents, err = LoadBootIntents(file, intentAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { bootIntents = nil }()
+
+	mac := net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20}
+	solicit := newTestHTTPBootSolicit(t, mac)
+
+	if got := bootFileURLFor(t, s, solicit); got != "http://netboot/04:42:1a:03:9b:20?intent=always" {
+		t.Fatalf("Wanted to netboot by default, got %q", got)
+	}
+
+	if _, err := bootIntents.Set(mac, intentLocal); err != nil {
+		t.Fatal(err)
+	}
+	if got := bootFileURLFor(t, s, solicit); got != "" {
+		t.Fatalf("Wanted the boot URL withheld for a local boot, got %q", got)
+	}
+
+	if _, err := bootIntents.Set(mac, intentReprovisionOnce); err != nil {
+		t.Fatal(err)
+	}
+	if got := bootFileURLFor(t, s, solicit); got != "http://netboot/04:42:1a:03:9b:20?intent=reprovision-once" {
+		t.Fatalf("Wanted to netboot the installer, got %q", got)
+	}
+
+	broker := NewBroker()
+	bootIntents.Watch(broker)
+	broker.Publish(IdentifiedEvent{Mac: MAC(mac), Event: NewEvent("os_init", false, nil)})
+	if got := bootIntents.Intent(mac); got != intentLocal {
+		t.Fatalf("Wanted reaching os_init to flip to local, got %s", got)
+	}
+
+	reloaded, err := LoadBootIntents(file, intentAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Intent(mac); got != intentLocal {
+		t.Fatalf("Wanted the intent to be persisted, got %s", got)
+	}
+
+	if _, err := bootIntents.Set(mac, "sometimes"); err == nil {
+		t.Fatalf("Wanted an unknown intent to be refused")
+	}
+}
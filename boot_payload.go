@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/DeterminateSystems/dhcpv6macd/bootpayload"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// Key to sign boot payloads with, see bootpayload. If nil, the payload is the
+// older unsigned base64 JSON.
+var bootPayloadKey []byte
+
+// issueBootPayload is the Payload boot template parameter.
+func issueBootPayload(mac net.HardwareAddr, address net.IP, archs iana.Archs, now time.Time) (string, error) {
+	if bootPayloadKey == nil {
+		return archsToEncoded(archs)
+	}
+
+	return bootpayload.Sign(bootPayloadKey, bootpayload.Claims{
+		MAC:           mac.String(),
+		Address:       address.String(),
+		Architectures: archsToStrings(archs),
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     now.Add(*bootPayloadTTL).Unix(),
+	})
+}
+
+// checkBootPayload verifies the request's `payload` query parameter was
+// issued to mac.
+func checkBootPayload(r *http.Request, mac net.HardwareAddr) error {
+	if bootPayloadKey == nil {
+		return errors.New("no -boot-payload-key-file to verify the payload with")
+	}
+
+	token := r.URL.Query().Get("payload")
+	if token == "" {
+		return errors.New("missing payload")
+	}
+
+	claims, err := bootpayload.Verify(bootPayloadKey, token, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if claims.MAC != mac.String() {
+		return fmt.Errorf("payload was issued to %s", claims.MAC)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestCheckBootPayload(t *testing.T) {
+	bootPayloadKey = []byte("hunter2")
+	defer func() { bootPayloadKey = nil }()
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	other, _ := net.ParseMAC("04:42:1a:03:9b:21")
+
+	token, err := issueBootPayload(mac, net.ParseIP("fec0::442:1a03:9b20"), iana.Archs{iana.EFI_X86_64_HTTP}, time.Now())
+	if err != nil {
+		t.Fatalf("issueBootPayload failure: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/mac/"+mac.String()+"/boot.efi?payload="+url.QueryEscape(token), nil)
+	if err := checkBootPayload(r, mac); err != nil {
+		t.Fatalf("Wanted the payload to verify, got %v", err)
+	}
+
+	if err := checkBootPayload(r, other); err == nil {
+		t.Fatalf("Wanted a payload for another MAC to be refused")
+	}
+
+	r = httptest.NewRequest("GET", "/mac/"+mac.String()+"/boot.efi", nil)
+	if err := checkBootPayload(r, mac); err == nil {
+		t.Fatalf("Wanted a missing payload to be refused")
+	}
+}
+
+func TestRequireBootPayload(t *testing.T) {
+	bootPayloadKey = []byte("hunter2")
+	*requireBootPayload = true
+	defer func() {
+		bootPayloadKey = nil
+		*requireBootPayload = false
+	}()
+
+	dir := t.TempDir()
+	macDir := filepath.Join(dir, "04:42:1a:03:9b:20")
+	if err := os.MkdirAll(macDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"boot.efi", "initrd"} {
+		if err := os.WriteFile(filepath.Join(macDir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux, _, _ := newTestWebserver(t, dir)
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code
+	}
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	token, err := issueBootPayload(mac, net.ParseIP("fec0::442:1a03:9b20"), iana.Archs{iana.EFI_X86_64_HTTP}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := get("/mac/04:42:1a:03:9b:20/boot.efi"); code != http.StatusForbidden {
+		t.Fatalf("Wanted boot.efi refused without a payload, got %d", code)
+	}
+	if code := get("/mac/04:42:1a:03:9b:20/boot.efi?payload=" + url.QueryEscape(token)); code != http.StatusOK {
+		t.Fatalf("Wanted boot.efi served with a payload, got %d", code)
+	}
+	if code := get("/mac/04:42:1a:03:9b:20/initrd"); code != http.StatusOK {
+		t.Fatalf("Wanted other files served without a payload, got %d", code)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+var httpBootTemplate *template.Template
+
+// Boot URL templates by client architecture, which take precedence over
+// httpBootTemplate
+var httpBootTemplatesByArch = make(map[iana.Arch]*template.Template)
+
+// httpBootEnabled reports whether we were given any boot URL or iPXE script
+// templates at all.
+func httpBootEnabled() bool {
+	return httpBootTemplate != nil || len(httpBootTemplatesByArch) > 0 ||
+		ipxeScriptTemplate != nil || kernelBootEnabled()
+}
+
+// bootTemplateFor picks the template for the first of the client's
+// architectures which has one, falling back to httpBootTemplate. It is nil if
+// there is no template for the client.
+func bootTemplateFor(archs iana.Archs) *template.Template {
+	for _, arch := range archs {
+		if tmpl, ok := httpBootTemplatesByArch[arch]; ok {
+			return tmpl
+		}
+	}
+
+	return httpBootTemplate
+}
+
+// BootTemplateContext is what the boot URL and boot file parameter templates
+// are rendered with.
+type BootTemplateContext struct {
+	// MAC is the MAC address of the booting machine, like 04:42:1a:03:9b:20
+	MAC string
+	// BaseAddress is the -base-address flag
+	BaseAddress string
+	// Address is the IPv6 address assigned to the machine
+	Address string
+	// Payload is a signed token about the machine if there is a
+	// -boot-payload-key-file, otherwise a base64 encoded JSON blob of the
+	// requested architectures
+	Payload string
+	// Expires and Signature sign a URL for the machine's boot.efi, see
+	// -boot-url-key-file. They are empty without a key.
+	Expires   string
+	Signature string
+	// Architectures are the client's architecture types, like "EFI x86-64 boot from HTTP"
+	Architectures []string
+	// VendorClasses are the client's vendor class strings, like "HTTPClient:Arch:00016:UNDI:003001"
+	VendorClasses []string
+	// UserClasses are the client's user class strings, like "iPXE"
+	UserClasses []string
+	// DUID is the client's DUID as colon separated hex
+	DUID string
+	// IAID is the client's IA_NA identifier as hex
+	IAID string
+	// RelayLinkAddress is the link-address of the relay closest to the
+	// client, or empty if the message wasn't relayed
+	RelayLinkAddress string
+	// State is the machine's current FSM state
+	State string
+	// BootAttempts counts how many times the machine has started booting
+	BootAttempts int
+	// Intent is the machine's boot intent, like always or reprovision-once
+	Intent string
+	// BootMode is the machine's boot mode, uki or kernel
+	BootMode string
+	// Cmdline is the machine's rendered kernel command line. It is only
+	// available to iPXE script templates.
+	Cmdline string
+	// UKIExtras are the paths of the machine's generated systemd-stub addons
+	// and credentials, like boot.efi.extra.d/hostname.cred
+	UKIExtras []string
+	// Hostname, Groups and Labels come from the machine's inventory entry
+	Hostname string
+	Groups   []string
+	Labels   map[string]string
+	// BootFileParams are the machine's rendered boot file parameters. They
+	// are not available to the boot file parameter templates themselves, or
+	// to the kernel command line.
+	BootFileParams []string
+}
+
+var bootTemplateFuncs = template.FuncMap{
+	// macDashes formats a MAC like 04-42-1a-03-9b-20
+	"macDashes": func(mac string) string {
+		return strings.ReplaceAll(mac, ":", "-")
+	},
+	// macPlain formats a MAC like 04421a039b20
+	"macPlain": func(mac string) string {
+		return strings.ReplaceAll(mac, ":", "")
+	},
+	"lower":       strings.ToLower,
+	"upper":       strings.ToUpper,
+	"queryEscape": url.QueryEscape,
+	"pathEscape":  url.PathEscape,
+}
+
+func newBootTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(bootTemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// machineTemplateContext fills in what we know about the machine without a
+// DHCPv6 message from it, for a client of the given architectures.
+func machineTemplateContext(a *Allocator, mac net.HardwareAddr, machine *Machine, archs iana.Archs) BootTemplateContext {
+	address := a.AddressFor(mac)
+
+	payload, err := issueBootPayload(mac, address, archs, time.Now())
+	if err != nil {
+		log.Printf("failed to construct the payload: %s", err)
+	}
+
+	ctx := BootTemplateContext{
+		MAC:           mac.String(),
+		BaseAddress:   *baseAddress,
+		Address:       address.String(),
+		Payload:       payload,
+		Architectures: archsToStrings(archs),
+		State:         machine.State(),
+		BootAttempts:  machine.BootAttempts(),
+		Intent:        bootIntents.Intent(mac),
+		BootMode:      bootModeFor(mac),
+		UKIExtras:     ukiExtraNames(mac),
+	}
+
+	if bootURLKey != nil {
+		expires := time.Now().Add(*bootURLTTL).Unix()
+		ctx.Expires = strconv.FormatInt(expires, 10)
+		ctx.Signature = signBootURL(mac, "boot.efi", expires)
+	}
+
+	if entry := inventory.Machine(mac); entry != nil {
+		ctx.Hostname = entry.Hostname
+		ctx.Groups = entry.Groups
+		ctx.Labels = entry.Labels
+	}
+
+	return ctx
+}
+
+func (s *DHCPv6Handler) bootTemplateContext(mac net.HardwareAddr, machine *Machine,
+	msg *dhcpv6.Message, req dhcpv6.DHCPv6) BootTemplateContext {
+
+	ctx := machineTemplateContext(s.allocator, mac, machine, msg.Options.ArchTypes())
+
+	for _, vc := range msg.Options.VendorClasses() {
+		for _, data := range vc.Data {
+			ctx.VendorClasses = append(ctx.VendorClasses, string(data))
+		}
+	}
+
+	for _, uc := range msg.Options.UserClasses() {
+		ctx.UserClasses = append(ctx.UserClasses, string(uc))
+	}
+
+	if duid := msg.Options.ClientID(); duid != nil {
+		ctx.DUID = formatDUID(duid)
+	}
+
+	if oia := msg.Options.OneIANA(); oia != nil {
+		ctx.IAID = hex.EncodeToString(oia.IaId[:])
+	}
+
+	if req.IsRelay() {
+		if inner, err := dhcpv6.DecapsulateRelayIndex(req, -1); err == nil {
+			ctx.RelayLinkAddress = inner.(*dhcpv6.RelayMessage).LinkAddr.String()
+		}
+	}
+
+	return ctx
+}
+
+// appendQuery adds key=value to rawURL's query for each of values, leaving
+// whatever the template put in the URL as it is.
+func appendQuery(rawURL, key string, values ...string) string {
+	base, fragment, hasFragment := strings.Cut(rawURL, "#")
+
+	for _, value := range values {
+		sep := "&"
+		if !strings.Contains(base, "?") {
+			sep = "?"
+		}
+		base += sep + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+	}
+
+	if hasFragment {
+		return base + "#" + fragment
+	}
+	return base
+}
+
+// renderBootURL renders the machine's boot file parameters and the boot URL
+// template. Failing to render the parameters is logged, not fatal.
+func (s *DHCPv6Handler) renderBootURL(mac net.HardwareAddr, machine *Machine,
+	msg *dhcpv6.Message, req dhcpv6.DHCPv6) (bootURL string, params []string, err error) {
+
+	tmpl := bootTemplateFor(msg.Options.ArchTypes())
+	if tmpl == nil {
+		return "", nil, fmt.Errorf("no http boot template for %v", archsToStrings(msg.Options.ArchTypes()))
+	}
+
+	ctx := s.bootTemplateContext(mac, machine, msg, req)
+
+	params, perr := inventory.BootFileParams(mac, ctx)
+	if perr != nil {
+		log.Printf("failed to render the boot file parameters: %v", perr)
+	}
+	ctx.BootFileParams = params
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, ctx); err != nil {
+		return "", nil, fmt.Errorf("rendering the http boot template: %w", err)
+	}
+
+	return signRenderedBootURL(buf.String(), mac, time.Now()), params, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBootTemplateFuncs(t *testing.T) {
+	tmpl, err := newBootTemplate("test", `http://netboot/{{.Labels.rack}}/{{.Hostname}}/{{macDashes .MAC | upper}}/{{macPlain .MAC}}?state={{queryEscape .State}}&missing={{.Labels.missing}}`)
+	if err != nil {
+		t.Fatalf("Parse failure: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, BootTemplateContext{
+		MAC:      "04:42:1a:03:9b:20",
+		Hostname: "r1n1",
+		Labels:   map[string]string{"rack": "r1"},
+		State:    "http boot&more",
+	})
+	if err != nil {
+		t.Fatalf("Execute failure: %v", err)
+	}
+
+	want := "http://netboot/r1/r1n1/04-42-1A-03-9B-20/04421a039b20?state=http+boot%26more&missing="
+	if got := buf.String(); got != want {
+		t.Fatalf("Wanted %s,\ngot: %s", want, got)
+	}
+}
+
+func TestAppendQuery(t *testing.T) {
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"http://netboot/boot.efi", "http://netboot/boot.efi?param=console%3DttyS0%2C115200&param=quiet"},
+		{"http://netboot/?mac=04:42:1a:03:9b:20", "http://netboot/?mac=04:42:1a:03:9b:20&param=console%3DttyS0%2C115200&param=quiet"},
+		{"http://netboot/boot.efi#frag", "http://netboot/boot.efi?param=console%3DttyS0%2C115200&param=quiet#frag"},
+	} {
+		if got := appendQuery(tc.url, "param", "console=ttyS0,115200", "quiet"); got != tc.want {
+			t.Errorf("Wanted %s,\ngot: %s", tc.want, got)
+		}
+	}
+
+	if got := appendQuery("http://netboot/boot.efi", "param"); got != "http://netboot/boot.efi" {
+		t.Errorf("Wanted the URL untouched without values, got %s", got)
+	}
+}
@@ -0,0 +1,100 @@
+// Package bootpayload issues and verifies the signed payload dhcpv6macd puts
+// in boot URLs.
+//
+// A payload is a compact JWS (RFC 7515) signed with HMAC-SHA256, so netboot
+// servers can trust the claims in a boot request as long as they share the
+// key with dhcpv6macd:
+//
+//	claims, err := bootpayload.Verify(key, r.URL.Query().Get("payload"), time.Now())
+//	if err != nil || claims.MAC != macFromTheRequest {
+//		// refuse to serve
+//	}
+package bootpayload
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims describe the machine a payload was issued to.
+type Claims struct {
+	// MAC is the machine's MAC address, like 04:42:1a:03:9b:20
+	MAC string `json:"mac"`
+	// Address is the IPv6 address assigned to the machine
+	Address string `json:"address"`
+	// Architectures are the client architecture types the machine asked
+	// with, like "EFI x86-64 boot from HTTP"
+	Architectures []string `json:"architectures"`
+	// IssuedAt and ExpiresAt are Unix timestamps
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+var (
+	ErrMalformed = errors.New("bootpayload: malformed token")
+	ErrSignature = errors.New("bootpayload: invalid signature")
+	ErrExpired   = errors.New("bootpayload: token expired")
+)
+
+// The only header we issue or accept.
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func sign(key []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign issues a token for the claims.
+func Sign(key []byte, claims Claims) (string, error) {
+	if len(key) == 0 {
+		return "", errors.New("bootpayload: empty key")
+	}
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("bootpayload: marshalling the claims: %w", err)
+	}
+
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(b)
+	return signingInput + "." + sign(key, signingInput), nil
+}
+
+// Verify checks the token's signature and expiry, and returns its claims.
+func Verify(key []byte, token string, now time.Time) (*Claims, error) {
+	if len(key) == 0 {
+		return nil, errors.New("bootpayload: empty key")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != header {
+		return nil, ErrMalformed
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(key, signingInput))) {
+		return nil, ErrSignature
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+
+	return &claims, nil
+}
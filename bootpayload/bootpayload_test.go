@@ -0,0 +1,51 @@
+package bootpayload
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("hunter2")
+	now := time.Unix(1760000000, 0)
+
+	token, err := Sign(key, Claims{
+		MAC:           "04:42:1a:03:9b:20",
+		Address:       "fd19:287e:c5a0:4931:0:442:1a03:9b20",
+		Architectures: []string{"EFI x86-64 boot from HTTP"},
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     now.Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("Sign failure: %v", err)
+	}
+
+	claims, err := Verify(key, token, now)
+	if err != nil {
+		t.Fatalf("Verify failure: %v", err)
+	}
+	if claims.MAC != "04:42:1a:03:9b:20" {
+		t.Fatalf("Wanted the MAC back, got %v", claims)
+	}
+
+	if _, err := Verify([]byte("hunter3"), token, now); !errors.Is(err, ErrSignature) {
+		t.Fatalf("Wanted ErrSignature for the wrong key, got %v", err)
+	}
+
+	if _, err := Verify(key, token, now.Add(time.Minute)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Wanted ErrExpired, got %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged, _ := Sign([]byte("other"), Claims{MAC: "04:42:1a:03:9b:21", ExpiresAt: now.Add(time.Minute).Unix()})
+	tampered := parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+	if _, err := Verify(key, tampered, now); !errors.Is(err, ErrSignature) {
+		t.Fatalf("Wanted ErrSignature for swapped claims, got %v", err)
+	}
+
+	if _, err := Verify(key, "not-a-token", now); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Wanted ErrMalformed, got %v", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 type Broker struct {
 	mu      sync.RWMutex
 	clients map[chan IdentifiedEvent]struct{}
+	// observers see every event, see Observe
+	observers []func(IdentifiedEvent)
 }
 
 func NewBroker() *Broker {
@@ -16,7 +18,13 @@ func NewBroker() *Broker {
 }
 
 func (b *Broker) Subscribe() (ch chan IdentifiedEvent, unsubscribe func()) {
-	ch = make(chan IdentifiedEvent, 8) // small buffer to avoid head-of-line blocking
+	return b.SubscribeBuffered(8) // small buffer to avoid head-of-line blocking
+}
+
+// SubscribeBuffered is Subscribe for subscribers which need more slack than
+// a browser before they start missing events.
+func (b *Broker) SubscribeBuffered(size int) (ch chan IdentifiedEvent, unsubscribe func()) {
+	ch = make(chan IdentifiedEvent, size)
 	b.mu.Lock()
 	b.clients[ch] = struct{}{}
 	b.mu.Unlock()
@@ -28,6 +36,16 @@ func (b *Broker) Subscribe() (ch chan IdentifiedEvent, unsubscribe func()) {
 	}
 }
 
+// Observe has fn called with every event as it's published, on the
+// publisher's goroutine. Unlike subscribers, observers never miss an event, so
+// they're for state which must follow every one. Events are often published
+// with their machine locked, so fn mustn't block or call into the machine.
+func (b *Broker) Observe(fn func(IdentifiedEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.observers = append(b.observers, fn)
+}
+
 func (b *Broker) PublishFyi(msg string) {
 	b.Publish(IdentifiedEvent{
 		Mac:   nil,
@@ -43,6 +61,14 @@ func (b *Broker) Publish(msg IdentifiedEvent) {
 		log.Println("Event", string(evbytes))
 	}
 
+	// Observers may publish events of their own
+	b.mu.RLock()
+	observers := b.observers
+	b.mu.RUnlock()
+	for _, observe := range observers {
+		observe(msg)
+	}
+
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	for ch := range b.clients {
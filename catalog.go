@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Catalog is a directory of named, versioned boot images which machines can
+// be pinned to. Each image is a directory named like
+// `nixos-installer@2025-10-01`, holding the files it serves, like boot.efi,
+// and optionally its metadata in image.json.
+//
+// Pins are persisted as a JSON object of MACs to image references:
+//
+//	{ "04:42:1a:03:9b:20": "nixos-installer@2025-10-01" }
+//
+// A reference without a version, like `nixos-installer`, pins the newest
+// version, comparing versions as strings.
+type Catalog struct {
+	dir      string
+	pinsFile string
+
+	mu   sync.Mutex
+	pins map[string]string
+}
+
+var catalog *Catalog
+
+// Image is a version of an image in the catalog.
+type Image struct {
+	Name     string          `json:"name"`
+	Version  string          `json:"version"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// PinnedBy are the MACs of machines pinned to the image
+	PinnedBy []string `json:"pinned_by,omitempty"`
+}
+
+func (i Image) Ref() string {
+	return i.Name + "@" + i.Version
+}
+
+// ImageEvent is the detail of an image_pinned or image_unpinned event.
+type ImageEvent struct {
+	Image   string `json:"image"`
+	Version string `json:"version"`
+}
+
+// parseImageRef splits `name@version` or `name`.
+func parseImageRef(ref string) (name, version string, err error) {
+	name, version, _ = strings.Cut(ref, "@")
+
+	for _, part := range []string{name, version} {
+		if strings.ContainsAny(part, "/@") || part == "." || part == ".." {
+			return "", "", fmt.Errorf("invalid image reference %q", ref)
+		}
+	}
+
+	if name == "" {
+		return "", "", fmt.Errorf("invalid image reference %q: missing the name", ref)
+	}
+
+	return name, version, nil
+}
+
+func LoadCatalog(dir, pinsFile string) (*Catalog, error) {
+	c := &Catalog{dir: dir, pinsFile: pinsFile, pins: make(map[string]string)}
+
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("image catalog: %w", err)
+	}
+
+	if pinsFile == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(pinsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading the image pins %q: %w", pinsFile, err)
+	}
+
+	if err := json.Unmarshal(data, &c.pins); err != nil {
+		return nil, fmt.Errorf("parsing the image pins %q: %w", pinsFile, err)
+	}
+
+	return c, nil
+}
+
+// images lists the catalog without PinnedBy, sorted by name then version.
+func (c *Catalog) images() ([]Image, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing the image catalog: %w", err)
+	}
+
+	var images []Image
+	for _, entry := range entries {
+		name, version, ok := strings.Cut(entry.Name(), "@")
+		if !entry.IsDir() || !ok || name == "" || version == "" {
+			continue
+		}
+
+		image := Image{Name: name, Version: version}
+
+		metadata, err := os.ReadFile(filepath.Join(c.dir, entry.Name(), "image.json"))
+		if err == nil && json.Valid(metadata) {
+			image.Metadata = metadata
+		}
+
+		images = append(images, image)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name != images[j].Name {
+			return images[i].Name < images[j].Name
+		}
+		return images[i].Version < images[j].Version
+	})
+
+	return images, nil
+}
+
+// resolveImage finds the image a reference points at in images.
+func resolveImage(images []Image, ref string) (Image, error) {
+	name, version, err := parseImageRef(ref)
+	if err != nil {
+		return Image{}, err
+	}
+
+	var found *Image
+	for i := range images {
+		if images[i].Name != name {
+			continue
+		}
+
+		if version == "" || images[i].Version == version {
+			// images is sorted, so the last match is the newest version
+			found = &images[i]
+		}
+	}
+
+	if found == nil {
+		return Image{}, fmt.Errorf("no image %q in the catalog", ref)
+	}
+
+	return *found, nil
+}
+
+// Images lists the catalog, with the machines pinned to each image.
+func (c *Catalog) Images() ([]Image, error) {
+	images, err := c.images()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for mac, ref := range c.pins {
+		pinned, err := resolveImage(images, ref)
+		if err != nil {
+			continue
+		}
+
+		for i := range images {
+			if images[i].Ref() == pinned.Ref() {
+				images[i].PinnedBy = append(images[i].PinnedBy, mac)
+				sort.Strings(images[i].PinnedBy)
+			}
+		}
+	}
+
+	return images, nil
+}
+
+// Unpinned lists the images no machine is pinned to and no rollout serves,
+// which are safe to garbage collect.
+func (c *Catalog) Unpinned() ([]Image, error) {
+	images, err := c.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	rolledOut := make(map[string]bool)
+	for _, ref := range rollouts.Refs() {
+		if image, err := resolveImage(images, ref); err == nil {
+			rolledOut[image.Ref()] = true
+		}
+	}
+
+	unpinned := []Image{}
+	for _, image := range images {
+		if len(image.PinnedBy) == 0 && !rolledOut[image.Ref()] {
+			unpinned = append(unpinned, image)
+		}
+	}
+
+	return unpinned, nil
+}
+
+// Pinned returns the image the machine is pinned to, if any.
+func (c *Catalog) Pinned(mac net.HardwareAddr) (Image, bool) {
+	if c == nil {
+		return Image{}, false
+	}
+
+	c.mu.Lock()
+	ref, ok := c.pins[mac.String()]
+	c.mu.Unlock()
+	if !ok {
+		return Image{}, false
+	}
+
+	image, err := c.Resolve(ref)
+	if err != nil {
+		return Image{}, false
+	}
+
+	return image, true
+}
+
+// PinnedRef returns the reference the machine is pinned to, as it was given.
+func (c *Catalog) PinnedRef(mac net.HardwareAddr) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ref, ok := c.pins[mac.String()]
+	return ref, ok
+}
+
+// Resolve finds the image a reference points at.
+func (c *Catalog) Resolve(ref string) (Image, error) {
+	images, err := c.images()
+	if err != nil {
+		return Image{}, err
+	}
+
+	return resolveImage(images, ref)
+}
+
+// ImageDir is the directory an image's files are served from.
+func (c *Catalog) ImageDir(image Image) string {
+	return filepath.Join(c.dir, image.Ref())
+}
+
+// Pin points the machine at an image, which must exist.
+func (c *Catalog) Pin(mac net.HardwareAddr, ref string) (Image, error) {
+	image, err := c.Resolve(ref)
+	if err != nil {
+		return Image{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pins[mac.String()] = ref
+	return image, c.saveWithoutLocking()
+}
+
+// Unpin forgets the machine's image.
+func (c *Catalog) Unpin(mac net.HardwareAddr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pins, mac.String())
+	return c.saveWithoutLocking()
+}
+
+func (c *Catalog) saveWithoutLocking() error {
+	if c.pinsFile == "" {
+		return nil
+	}
+
+	if err := writeJSONFile(c.pinsFile, c.pins); err != nil {
+		return fmt.Errorf("writing the image pins: %w", err)
+	}
+
+	return nil
+}
+
+// writeJSONFile writes and renames, so a crash can't leave us with half a
+// file.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestCatalog(t *testing.T) (string, *Catalog) {
+	dir := t.TempDir()
+	catalogDir := filepath.Join(dir, "images")
+
+	for ref, content := range map[string]string{
+		"nixos-installer@2025-09-01": "old installer",
+		"nixos-installer@2025-10-01": "new installer",
+		"memtest@7.20":               "memtest",
+	} {
+		if err := os.MkdirAll(filepath.Join(catalogDir, ref), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(catalogDir, ref, "boot.efi"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(catalogDir, "memtest@7.20", "image.json"), []byte(`{"description":"memory test"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadCatalog(catalogDir, filepath.Join(dir, "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, c
+}
+
+func TestCatalogPins(t *testing.T) {
+	dir, c := newTestCatalog(t)
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+
+	image, err := c.Pin(mac, "nixos-installer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Ref() != "nixos-installer@2025-10-01" {
+		t.Fatalf("Wanted a name to pin the newest version, got %s", image.Ref())
+	}
+
+	if _, err := c.Pin(mac, "nixos-installer@1999-01-01"); err == nil {
+		t.Fatalf("Wanted pinning a missing version to fail")
+	}
+
+	if _, err := c.Pin(mac, "../etc"); err == nil {
+		t.Fatalf("Wanted pinning a path to fail")
+	}
+
+	unpinned, err := c.Unpinned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for _, image := range unpinned {
+		refs = append(refs, image.Ref())
+	}
+	if strings.Join(refs, ",") != "memtest@7.20,nixos-installer@2025-09-01" {
+		t.Fatalf("Wanted the other images to be unpinned, got %v", refs)
+	}
+	if string(unpinned[0].Metadata) != `{"description":"memory test"}` {
+		t.Fatalf("Wanted the image metadata, got %s", unpinned[0].Metadata)
+	}
+
+	reloaded, err := LoadCatalog(filepath.Join(dir, "images"), filepath.Join(dir, "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, ok := reloaded.Pinned(mac); !ok || image.Ref() != "nixos-installer@2025-10-01" {
+		t.Fatalf("Wanted the pin to be persisted, got %v %v", image, ok)
+	}
+
+	if err := reloaded.Unpin(mac); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Pinned(mac); ok {
+		t.Fatalf("Wanted the machine to be unpinned")
+	}
+}
+
+func TestServePinnedImage(t *testing.T) {
+	dir, c := newTestCatalog(t)
+	catalog = c
+	defer func() { catalog = nil }()
+
+	netbootDir := filepath.Join(dir, "macs")
+	if err := os.MkdirAll(filepath.Join(netbootDir, "default"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(netbootDir, "default", "boot.efi"), []byte("default"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, broker, _ := newTestWebserver(t, netbootDir)
+
+	adminToken = []byte("hunter2")
+	defer func() { adminToken = nil }()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer hunter2")
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("GET", "/mac/04:42:1a:03:9b:20/boot.efi", ""); w.Body.String() != "default" {
+		t.Fatalf("Wanted the default boot.efi before pinning, got %q", w.Body.String())
+	}
+
+	for _, auth := range []string{"", "Bearer hunter3", "hunter2"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/machines/04:42:1a:03:9b:20/image", strings.NewReader(`{"image":"memtest@7.20"}`))
+		r.Header.Set("Authorization", auth)
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Wanted a pin with Authorization %q refused, got %d", auth, w.Code)
+		}
+	}
+
+	if w := do("PUT", "/machines/04:42:1a:03:9b:20/image", `{"image":"memtest@7.20"}`); w.Code != http.StatusOK {
+		t.Fatalf("Wanted the pin to succeed, got %d %q", w.Code, w.Body.String())
+	}
+
+	ch, unsubscribe := broker.SubscribeBuffered(16)
+	defer unsubscribe()
+
+	if w := do("GET", "/mac/04:42:1a:03:9b:20/boot.efi", ""); w.Body.String() != "memtest" {
+		t.Fatalf("Wanted the pinned boot.efi, got %q", w.Body.String())
+	}
+
+	fetched := (<-ch).Event.Detail.(TransferEvent)
+	if fetched.Image != "memtest" || fetched.ImageVersion != "7.20" {
+		t.Fatalf("Wanted the image in the event, got %+v", fetched)
+	}
+
+	if w := do("DELETE", "/machines/04:42:1a:03:9b:20/image", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Wanted the unpin to succeed, got %d", w.Code)
+	}
+
+	if w := do("GET", "/machines/04:42:1a:03:9b:20/image", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Wanted no pin, got %d", w.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+var errFileChanged = errors.New("file changed during the transfer")
+
+type fileHash struct {
+	stat os.FileInfo
+	sum  []byte
+}
+
+// fileHashes caches the SHA-256 of served files by path, until the path is
+// another file, or its size or modification time changes. Files replaced
+// with another of the same size and modification time, as in the Nix store,
+// are told apart by their inode.
+var fileHashes = struct {
+	mu     sync.Mutex
+	hashes map[string]fileHash
+}{hashes: make(map[string]fileHash)}
+
+// cachedFileSHA256 is the SHA-256 of the file opened from name with stat, if
+// it's known.
+func cachedFileSHA256(name string, stat os.FileInfo) ([]byte, bool) {
+	fileHashes.mu.Lock()
+	cached, ok := fileHashes.hashes[name]
+	fileHashes.mu.Unlock()
+
+	if !ok || !os.SameFile(cached.stat, stat) || cached.stat.Size() != stat.Size() || !cached.stat.ModTime().Equal(stat.ModTime()) {
+		return nil, false
+	}
+	return cached.sum, true
+}
+
+func storeFileSHA256(name string, stat os.FileInfo, sum []byte) {
+	fileHashes.mu.Lock()
+	defer fileHashes.mu.Unlock()
+	fileHashes.hashes[name] = fileHash{stat: stat, sum: sum}
+}
+
+// fileSHA256 hashes f, which was opened from name and has stat, without
+// moving its offset.
+func fileSHA256(name string, f *os.File, stat os.FileInfo) ([]byte, error) {
+	if sum, ok := cachedFileSHA256(name, stat); ok {
+		return sum, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, stat.Size())); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+
+	// Don't cache a hash of a file which changed while we read it
+	if changed, err := fileChanged(f, stat); err != nil {
+		return nil, err
+	} else if changed {
+		return nil, errFileChanged
+	}
+
+	storeFileSHA256(name, stat, sum)
+	return sum, nil
+}
+
+// fileChanged reports whether f was modified in place since stat. Replacing
+// the file by renaming another over it doesn't count: f still reads the old
+// file.
+func fileChanged(f *os.File, stat os.FileInfo) (bool, error) {
+	now, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return now.Size() != stat.Size() || !now.ModTime().Equal(stat.ModTime()), nil
+}
+
+func sha256Hex(sum []byte) string {
+	return hex.EncodeToString(sum)
+}
+
+// reprDigest formats an RFC 9530 Repr-Digest header.
+func reprDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// sumCacheSize is how many files a sumCache remembers.
+const sumCacheSize = 256
+
+// sumCache caches what was learned from files by their hex SHA-256, keeping
+// the most recently used sumCacheSize of them. The zero value is empty.
+type sumCache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]V
+	// order has the sums from the least to the most recently used
+	order []string
+}
+
+func (c *sumCache[V]) get(sum string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.entries[sum]
+	if ok {
+		c.usedWithoutLocking(sum)
+	}
+	return v, ok
+}
+
+func (c *sumCache[V]) put(sum string, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]V)
+	}
+	if _, ok := c.entries[sum]; ok {
+		c.usedWithoutLocking(sum)
+	} else {
+		c.order = append(c.order, sum)
+	}
+	c.entries[sum] = v
+
+	for len(c.order) > sumCacheSize {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+func (c *sumCache[V]) usedWithoutLocking(sum string) {
+	i := slices.Index(c.order, sum)
+	c.order = append(slices.Delete(c.order, i, i+1), sum)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// touchingRecorder modifies a file in place once the response starts.
+type touchingRecorder struct {
+	*httptest.ResponseRecorder
+	name    string
+	touched bool
+}
+
+func (t *touchingRecorder) Write(b []byte) (int, error) {
+	if !t.touched {
+		t.touched = true
+		os.Chtimes(t.name, time.Now(), time.Now().Add(time.Hour))
+	}
+	return t.ResponseRecorder.Write(b)
+}
+
+func TestServeFileIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	macDir := filepath.Join(dir, "04:42:1a:03:9b:20")
+	if err := os.MkdirAll(macDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	small := []byte("a small boot.efi")
+	if err := os.WriteFile(filepath.Join(macDir, "boot.efi"), small, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	big := filepath.Join(macDir, "big.img")
+	if err := os.WriteFile(big, make([]byte, fiveMiB+1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, _, m := newTestWebserver(t, dir)
+
+	get := func(name string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/"+name, nil))
+		return w
+	}
+
+	// Even the first transfer, before the hash is cached, has it
+	sum := sha256.Sum256(small)
+	if got, want := get("boot.efi").Header().Get("Repr-Digest"), reprDigest(sum[:]); got != want {
+		t.Fatalf("Wanted Repr-Digest %q, got %q", want, got)
+	}
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	events := m.GetMachine(mac).Events
+	transfers := 0
+	for i := range events.Len() {
+		if detail, ok := events.At(i).Detail.(TransferEvent); ok {
+			transfers++
+			if detail.SHA256 != sha256Hex(sum[:]) {
+				t.Fatalf("Wanted every event of the first transfer to have the hash, got %+v", detail)
+			}
+		}
+	}
+	if transfers == 0 {
+		t.Fatal("Wanted the first transfer's events")
+	}
+	if got := m.GetMachine(mac).Images()["boot.efi"]; got != sha256Hex(sum[:]) {
+		t.Fatalf("Wanted the machine to record the boot.efi hash, got %q", got)
+	}
+
+	// Replacing the file with another of the same size and modification
+	// time, as the Nix store does, doesn't keep the old hash
+	replaced := []byte("other small boot")
+	tmp := filepath.Join(macDir, "boot.efi.tmp")
+	if err := os.WriteFile(tmp, replaced, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Unix(1, 0)
+	if err := os.Chtimes(tmp, epoch, epoch); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(macDir, "boot.efi"), epoch, epoch); err != nil {
+		t.Fatal(err)
+	}
+	get("boot.efi")
+	if err := os.Rename(tmp, filepath.Join(macDir, "boot.efi")); err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256(replaced)
+	if got, want := get("boot.efi").Header().Get("Repr-Digest"), reprDigest(sum[:]); got != want {
+		t.Fatalf("Wanted Repr-Digest %q for the replaced file, got %q", want, got)
+	}
+
+	// Files too small for a progress event are still checked between reads
+	medium := filepath.Join(macDir, "initrd")
+	if err := os.WriteFile(medium, make([]byte, 256<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tw := &touchingRecorder{ResponseRecorder: httptest.NewRecorder(), name: medium}
+	mux.ServeHTTP(tw, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/initrd", nil))
+	if tw.Body.Len() >= 256<<10 {
+		t.Fatalf("Wanted the small transfer to be cut short, got %d bytes", tw.Body.Len())
+	}
+
+	tw = &touchingRecorder{ResponseRecorder: httptest.NewRecorder(), name: big}
+	mux.ServeHTTP(tw, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/big.img", nil))
+	if tw.Code != http.StatusOK || tw.Body.Len() >= fiveMiB+1024 {
+		t.Fatalf("Wanted the transfer to be cut short, got %d after %d bytes", tw.Code, tw.Body.Len())
+	}
+
+	events = m.GetMachine(mac).Events
+	last := events.At(events.Len() - 1).Detail.(TransferEvent)
+	if last.State != "aborted" {
+		t.Fatalf("Wanted the transfer to be reported as aborted, got %+v", last)
+	}
+	if _, ok := m.GetMachine(mac).Images()["big.img"]; ok {
+		t.Fatalf("Wanted the torn transfer not to be recorded as an image")
+	}
+}
+
+func TestSumCacheEvicts(t *testing.T) {
+	var c sumCache[int]
+
+	for i := range sumCacheSize {
+		c.put(fmt.Sprint(i), i)
+	}
+
+	// Using 0 makes 1 the least recently used
+	if v, ok := c.get("0"); !ok || v != 0 {
+		t.Fatalf("Wanted 0 cached, got %v %v", v, ok)
+	}
+	c.put("new", -1)
+
+	if _, ok := c.get("1"); ok {
+		t.Fatalf("Wanted the least recently used entry evicted")
+	}
+	for _, sum := range []string{"0", "2", "new"} {
+		if _, ok := c.get(sum); !ok {
+			t.Fatalf("Wanted %s still cached", sum)
+		}
+	}
+	if len(c.entries) != sumCacheSize || len(c.order) != sumCacheSize {
+		t.Fatalf("Wanted %d entries, got %d and %d", sumCacheSize, len(c.entries), len(c.order))
+	}
+}
@@ -225,6 +225,26 @@
                     Path to the iPXE EFI binary for x86_64 to serve over TFTP.
                   '';
                 };
+                ipxeBinaries = lib.mkOption {
+                  type = lib.types.attrsOf lib.types.path;
+                  default = { };
+                  example = {
+                    EFI_ARM64 = "/path/to/arm64/ipxe.efi";
+                  };
+                  description = ''
+                    iPXE binaries to serve over TFTP, by IANA client architecture type.
+                  '';
+                };
+                httpBootUrlTemplatesForArch = lib.mkOption {
+                  type = lib.types.attrsOf lib.types.str;
+                  default = { };
+                  example = {
+                    EFI_ARM64_HTTP = "http://[{{.BaseAddress}}]/arm64/?mac={{.MAC}}";
+                  };
+                  description = ''
+                    Boot URL templates by IANA client architecture type, which take precedence over httpBootUrlTemplate.
+                  '';
+                };
               };
             };
             config =
@@ -274,6 +294,18 @@
                           "-tls-key-file"
                           cfg.tlsKeyFile
                         ])
+                        ++ (lib.concatLists (
+                          lib.mapAttrsToList (arch: path: [
+                            "-ipxe-binary"
+                            "${arch}=${path}"
+                          ]) cfg.ipxeBinaries
+                        ))
+                        ++ (lib.concatLists (
+                          lib.mapAttrsToList (arch: template: [
+                            "-http-boot-url-template-for-arch"
+                            "${arch}=${template}"
+                          ]) cfg.httpBootUrlTemplatesForArch
+                        ))
                         ++ (lib.optionals (cfg.netbootDirectory != null) [
                           "-netboot-dir"
                           cfg.netbootDirectory
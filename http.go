@@ -1,23 +1,19 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"path"
-	"strconv"
 	"strings"
 	"time"
 )
 
-func webserver(netbootDir string, b *Broker, m *Machines) (*http.ServeMux, error) {
+func webserver(netbootDir string, b *Broker, m *Machines, a *Allocator) (*http.ServeMux, error) {
 	server := http.NewServeMux()
 
 	if netbootDir == "" {
@@ -25,86 +21,310 @@ func webserver(netbootDir string, b *Broker, m *Machines) (*http.ServeMux, error
 	} else if _, err := os.Stat(netbootDir); os.IsNotExist(err) {
 		log.Printf("netboot directory does not exist, will not serve it: %s", netbootDir)
 	} else {
-		server.HandleFunc("/mac/{mac_addr}/boot.efi", func(w http.ResponseWriter, r *http.Request) {
+		// serveMACFile serves rel from pathMAC's directory, or if pathMAC is
+		// nil, from the directory of the MAC the source address was derived
+		// from
+		serveMACFile := func(w http.ResponseWriter, r *http.Request, pathMAC net.HardwareAddr, rel string) {
+			if rel == "" {
+				http.NotFound(w, r)
+				return
+			}
+
+			mac, err := resolveMAC(a, pathMAC, remoteIP(r), *requireSourceMAC)
+			if err != nil {
+				if pathMAC != nil {
+					denyFetch(w, r, m.GetOrInitMachine(pathMAC), err)
+				} else {
+					log.Printf("Can't find the MAC for %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+					http.NotFound(w, r)
+				}
+				return
+			}
+
+			if !fs.ValidPath(rel) {
+				log.Printf("Refusing fishy path %q", rel)
+				http.Error(w, "fishy path", 400)
+				return
+			}
+
+			if bootURLKey != nil {
+				if err := checkSignedBootURL(r, mac, rel, a, time.Now()); err != nil {
+					denyFetch(w, r, m.GetOrInitMachine(mac), err)
+					return
+				}
+			}
+
+			if *requireBootPayload && rel == "boot.efi" {
+				if err := checkBootPayload(r, mac); err != nil {
+					denyFetch(w, r, m.GetOrInitMachine(mac), err)
+					return
+				}
+			}
+
+			if tmpl := ipxeScriptTemplateFor(mac); rel == ipxeScriptName && tmpl != nil {
+				serveIPXEScript(w, r, tmpl, a, mac, m.GetOrInitMachine(mac))
+				return
+			}
+
+			// Extras may hold secrets, so they're only for requests known to
+			// come from the machine
+			verified := pathMAC == nil || bootURLKey != nil || *requireSourceMAC
+			if strings.HasPrefix(rel, ukiExtraDir+"/") && serveUKIExtra(w, r, a, m.GetOrInitMachine(mac), netbootDir, rel, verified) {
+				return
+			}
+
+			serveTreeFile(w, r, m.GetOrInitMachine(mac), netbootDir, rel)
+		}
+
+		server.HandleFunc("/mac/{mac_addr}/{path...}", func(w http.ResponseWriter, r *http.Request) {
 			// Extract MAC address from path
-			macStr := r.PathValue("mac_addr")
-			mac, err := net.ParseMAC(macStr)
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
 			if err != nil {
 				log.Printf("Got request with something that didn't look like a MAC address. Returning 404.")
 				http.NotFound(w, r)
 				return
 			}
 
-			name := path.Clean(path.Join(netbootDir, mac.String(), "boot.efi"))
+			serveMACFile(w, r, mac, r.PathValue("path"))
+		})
 
-			if !strings.HasPrefix(name, netbootDir+"/") {
-				log.Println("Path did not clean to subordinate of", netbootDir)
-				http.Error(w, "fishy path", 400)
+		// The info gives away the UKI's command line, so it's for operators
+		// rather than machines
+		server.HandleFunc("GET /mac/{mac_addr}/boot.efi/info", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			serveBootFileInfo(w, netbootDir, mac)
+		}))
+
+		// Everything else is a file of the MAC the source address belongs to
+		server.HandleFunc("/{path...}", func(w http.ResponseWriter, r *http.Request) {
+			serveMACFile(w, r, nil, r.PathValue("path"))
+		})
+	}
+
+	if catalog != nil {
+		server.HandleFunc("GET /images", func(w http.ResponseWriter, r *http.Request) {
+			images, err := catalog.Images()
+			if err != nil {
+				log.Printf("Listing the image catalog: %v", err)
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
 				return
 			}
+			writeJSON(w, images)
+		})
 
-			f, err := os.Open(name)
+		server.HandleFunc("GET /images/unpinned", func(w http.ResponseWriter, r *http.Request) {
+			images, err := catalog.Unpinned()
 			if err != nil {
-				msg, code := toHTTPError(err)
-				http.Error(w, msg, code)
+				log.Printf("Listing the image catalog: %v", err)
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
 				return
 			}
-			defer f.Close()
+			writeJSON(w, images)
+		})
 
-			stat, err := f.Stat()
+		server.HandleFunc("GET /machines/{mac_addr}/image", func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
 			if err != nil {
-				msg, code := toHTTPError(err)
-				http.Error(w, msg, code)
+				http.Error(w, fmt.Sprintf("MAC error: %v", err), http.StatusBadRequest)
 				return
 			}
 
-			if stat.IsDir() {
-				http.Error(w, "boot.efi was a directory", 500)
+			ref, ok := catalog.PinnedRef(mac)
+			if !ok {
+				http.NotFound(w, r)
 				return
 			}
 
-			w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
-			w.Header().Set("Content-Type", "application/octet-stream")
+			pin := struct {
+				Ref   string `json:"ref"`
+				Image *Image `json:"image"`
+			}{Ref: ref}
+			if image, ok := catalog.Pinned(mac); ok {
+				pin.Image = &image
+			}
+			writeJSON(w, pin)
+		})
 
-			machine := m.GetOrInitMachine(mac)
+		server.HandleFunc("PUT /machines/{mac_addr}/image", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("MAC error: %v", err), http.StatusBadRequest)
+				return
+			}
 
-			event := TransferEvent{
-				Filename:   name,
-				State:      "init",
-				TotalBytes: stat.Size(),
+			var body struct {
+				Image string `json:"image"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, fmt.Sprintf("JSON error: %v", err), http.StatusBadRequest)
+				return
 			}
 
-			if r.TLS == nil {
-				event.Protocol = "http"
-			} else {
-				event.Protocol = "https"
+			image, err := catalog.Pin(mac, body.Image)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
-			// Trigger state transition to http_fetch_uki
-			if err := machine.Event(r.Context(), "http_fetch_uki", event); err != nil {
-				log.Printf("Failed to transition to http_fetch_uki for %s: %v", macStr, err)
+			m.GetOrInitMachine(mac).Notify("image_pinned", ImageEvent{Image: image.Name, Version: image.Version})
+			writeJSON(w, image)
+		}))
+
+		server.HandleFunc("DELETE /machines/{mac_addr}/image", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("MAC error: %v", err), http.StatusBadRequest)
+				return
 			}
 
-			event.State = "sending"
+			image, _ := catalog.Pinned(mac)
+			if err := catalog.Unpin(mac); err != nil {
+				log.Printf("Unpinning %s: %v", mac, err)
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+				return
+			}
 
-			reader := newProgressReader(f, func(bytes int64) error {
-				event.SentBytes = bytes
-				machine.Event(context.Background(), "http_fetch_uki", event)
-				return nil
-			})
+			m.GetOrInitMachine(mac).Notify("image_unpinned", ImageEvent{Image: image.Name, Version: image.Version})
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
 
-			_, err = io.Copy(w, reader)
+	if bootIntents != nil {
+		server.HandleFunc("GET /intents", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, bootIntents.All())
+		})
 
+		server.HandleFunc("GET /machines/{mac_addr}/intent", func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
 			if err != nil {
-				event.State = "error"
-				event.Error = err.Error()
-				machine.Event(context.Background(), "http_fetch_uki", event)
-				log.Printf("Serving failure: %v", err)
-			} else {
-				event.State = "complete"
-				machine.Event(context.Background(), "http_fetch_uki", event)
+				http.Error(w, fmt.Sprintf("MAC error: %v", err), http.StatusBadRequest)
+				return
 			}
+
+			writeJSON(w, BootIntentEvent{Intent: bootIntents.Intent(mac)})
 		})
+
+		server.HandleFunc("PUT /machines/{mac_addr}/intent", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("MAC error: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			var body BootIntentEvent
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, fmt.Sprintf("JSON error: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			previous, err := bootIntents.Set(mac, body.Intent)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			event := BootIntentEvent{Intent: body.Intent, Previous: previous, Reason: "api"}
+			m.GetOrInitMachine(mac).Notify("boot_intent_changed", event)
+			writeJSON(w, event)
+		}))
+	}
+
+	if uploads != nil {
+		server.HandleFunc("GET /machines/{mac_addr}/uploads", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("MAC error: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			list, err := uploads.List(mac)
+			if err != nil {
+				log.Printf("Listing the uploads of %s: %v", mac, err)
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			writeJSON(w, list)
+		}))
+
+		server.HandleFunc("GET /machines/{mac_addr}/uploads/{name}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			mac, err := net.ParseMAC(r.PathValue("mac_addr"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("MAC error: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			f, err := uploads.Open(mac, r.PathValue("name"))
+			if err != nil {
+				msg, code := toHTTPError(err)
+				http.Error(w, msg, code)
+				return
+			}
+			defer f.Close()
+
+			stat, err := f.Stat()
+			if err != nil {
+				msg, code := toHTTPError(err)
+				http.Error(w, msg, code)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+		}))
+	}
+
+	if rollouts != nil {
+		server.HandleFunc("GET /rollouts", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, rollouts.All())
+		})
+
+		server.HandleFunc("POST /rollouts", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			var rollout Rollout
+			if err := json.NewDecoder(r.Body).Decode(&rollout); err != nil {
+				http.Error(w, fmt.Sprintf("JSON error: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			started, err := rollouts.Start(rollout, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			writeJSON(w, started)
+		}))
+
+		server.HandleFunc("GET /rollouts/{name}", func(w http.ResponseWriter, r *http.Request) {
+			rollout, ok := rollouts.Get(r.PathValue("name"))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, rollout)
+		})
+
+		server.HandleFunc("POST /rollouts/{name}/rollback", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			if err := rollouts.Rollback(r.PathValue("name"), "rolled back by hand"); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		server.HandleFunc("DELETE /rollouts/{name}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			if err := rollouts.Delete(r.PathValue("name")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
 	}
 
 	// SSE endpoint
@@ -199,6 +419,41 @@ func webserver(netbootDir string, b *Broker, m *Machines) (*http.ServeMux, error
 	return server, nil
 }
 
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("JSON marshalling error: ", err)
+	}
+}
+
+// denyFetch refuses a request and records why as an http_fetch_denied event.
+func denyFetch(w http.ResponseWriter, r *http.Request, machine *Machine, err error) {
+	log.Printf("Refusing %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+	machine.Notify("http_fetch_denied", TransferEvent{
+		Protocol: requestProtocol(r),
+		Filename: r.URL.Path,
+		State:    "denied",
+		Error:    err.Error(),
+	})
+	http.Error(w, "403 Forbidden", http.StatusForbidden)
+}
+
+// remoteIP is the request's source address, or nil if it can't be parsed.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func requestProtocol(r *http.Request) string {
+	if r.TLS == nil {
+		return "http"
+	}
+	return "https"
+}
+
 // Following was lifted from net/http:
 //
 // toHTTPError returns a non-specific HTTP error message and status code
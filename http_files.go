@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event name for transfers of files which aren't in httpFileEvents
+const defaultFileEvent = "http_fetch_file"
+
+type fileEvent struct {
+	pattern string
+	event   string
+}
+
+// fileEventFlag collects repeated PATTERN=EVENT flags, mapping files under a
+// MAC's directory to the event their transfers are reported as. The first
+// matching pattern wins.
+type fileEventFlag []fileEvent
+
+func (f *fileEventFlag) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, fe := range *f {
+		parts = append(parts, fe.pattern+"="+fe.event)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *fileEventFlag) Set(s string) error {
+	pattern, event, ok := strings.Cut(s, "=")
+	if !ok || event == "" {
+		return fmt.Errorf("expected PATTERN=EVENT, got %q", s)
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	*f = append(*f, fileEvent{pattern: pattern, event: event})
+	return nil
+}
+
+var httpFileEvents fileEventFlag
+
+// Events of the files the boot modes fetch, unless they are mapped to
+// something else.
+var bootFileEvents = map[string]string{
+	"boot.efi": "http_fetch_uki",
+	"kernel":   "http_fetch_kernel",
+	"initrd":   "http_fetch_initrd",
+}
+
+// fileEventFor picks the event for a file, relative to the MAC's directory.
+func fileEventFor(name string) string {
+	for _, fe := range httpFileEvents {
+		if ok, _ := path.Match(fe.pattern, name); ok {
+			return fe.event
+		}
+	}
+
+	if event, ok := bootFileEvents[name]; ok {
+		return event
+	}
+
+	return defaultFileEvent
+}
+
+// recordTransfer reports a transfer. Events which are FSM states move the
+// machine. Others are recorded in the timeline, except for progress updates
+// which are only published.
+func recordTransfer(ctx context.Context, machine *Machine, event string, detail TransferEvent) {
+	if isMachineState(event) {
+		if err := machine.Event(ctx, event, detail); err != nil {
+			log.Printf("Failed to transition to %s for %s: %v", event, machine.Mac, err)
+		}
+		return
+	}
+
+	if detail.State == "sending" || detail.State == "throttled" {
+		machine.Progress(event, detail)
+	} else {
+		machine.Notify(event, detail)
+	}
+}
+
+func contentTypeFor(name string) string {
+	switch path.Ext(name) {
+	case ".ipxe":
+		return "text/plain; charset=utf-8"
+	case ".efi", ".squashfs", ".img", "":
+		return "application/octet-stream"
+	}
+
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		return ct
+	}
+
+	return "application/octet-stream"
+}
+
+func fileETag(stat os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size())
+}
+
+// errTransferFinished is returned to reads which come after the transfer was
+// reported finished.
+var errTransferFinished = errors.New("the transfer has finished")
+
+// progressReadSeeker lets http.ServeContent seek a progressReader's file.
+//
+// For multiple ranges, http.ServeContent reads from another goroutine, which
+// may still be running when it returns, so reads are serialized with finish.
+type progressReadSeeker struct {
+	*progressReader
+	seeker io.Seeker
+	// check fails reads of a file which changed, before what was read is
+	// sent
+	check func() error
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (p *progressReadSeeker) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return 0, errTransferFinished
+	}
+
+	n, err := p.progressReader.Read(b)
+	if n > 0 && p.check != nil {
+		if err := p.check(); err != nil {
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+func (p *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return 0, errTransferFinished
+	}
+
+	return p.seeker.Seek(offset, whence)
+}
+
+// finish waits out any read in progress and fails later ones, so the
+// transfer's state can be read safely, and returns the bytes read.
+func (p *progressReadSeeker) finish() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done = true
+	return p.total
+}
+
+// transferResponseWriter remembers the status and any write error, which
+// http.ServeContent doesn't return. onStatus is called once the headers are
+// final, just before they are written.
+type transferResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	err      error
+	onStatus func(status int)
+}
+
+func (t *transferResponseWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+		if t.onStatus != nil {
+			t.onStatus(status)
+		}
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *transferResponseWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+
+	n, err := t.ResponseWriter.Write(b)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// contentRangeStart is where a 206 response starts in the file. Multi-range
+// responses have no Content-Range, so it falls back to the first requested
+// range, or 0 for suffix ranges.
+func contentRangeStart(contentRange, requested string) int64 {
+	var start int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-", &start); err == nil {
+		return start
+	}
+
+	first, _, _ := strings.Cut(strings.TrimPrefix(requested, "bytes="), ",")
+	if _, err := fmt.Sscanf(strings.TrimSpace(first), "%d-", &start); err == nil {
+		return start
+	}
+
+	return 0
+}
+
+// bootFileDirs is the chain of directories a machine's files are looked up
+// in: its own, its inventory groups', its OUI's, then the default. Files of a
+// pinned catalog image come before all of them, see serveTreeFile.
+func bootFileDirs(netbootDir string, mac net.HardwareAddr) []string {
+	dirs := []string{path.Join(netbootDir, mac.String())}
+
+	if entry := inventory.Machine(mac); entry != nil {
+		for _, group := range entry.Groups {
+			dirs = append(dirs, path.Join(netbootDir, "group", group))
+		}
+	}
+
+	dirs = append(dirs,
+		path.Join(netbootDir, "oui", mac[:3].String()),
+		path.Join(netbootDir, "default"))
+	return dirs
+}
+
+// BootFileMissingEvent is the detail of a boot_file_missing event, emitted
+// when none of a machine's directories have the requested file.
+type BootFileMissingEvent struct {
+	Protocol    string   `json:"protocol"`
+	Filename    string   `json:"file_name"`
+	Directories []string `json:"directories"`
+}
+
+// openTreeFile opens rel from the first of dirs which has it. It returns
+// fs.ErrNotExist if none do. rel can't climb out of the directories, but
+// symlinks are followed wherever they lead, like into the Nix store.
+func openTreeFile(dirs []string, rel string) (*os.File, os.FileInfo, string, error) {
+	if !fs.ValidPath(rel) {
+		return nil, nil, "", fmt.Errorf("invalid path %q", rel)
+	}
+
+	for _, dir := range dirs {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, nil, "", err
+		}
+
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, "", err
+		}
+
+		if stat.IsDir() {
+			f.Close()
+			continue
+		}
+
+		return f, stat, dir, nil
+	}
+
+	return nil, nil, "", fs.ErrNotExist
+}
+
+// machineFileDirs are the directories the machine's files are served from:
+// the directory of its catalog image, if it has one, then bootFileDirs.
+func machineFileDirs(netbootDir string, mac net.HardwareAddr) (dirs []string, image Image, rollout string, pinned bool) {
+	dirs = bootFileDirs(netbootDir, mac)
+
+	image, rollout, pinned = imageFor(mac)
+	if pinned {
+		dirs = append([]string{catalog.ImageDir(image)}, dirs...)
+	}
+
+	return dirs, image, rollout, pinned
+}
+
+// serveTreeFile serves rel, a path relative to the machine's directories
+// under netbootDir, with http.ServeContent's Range, HEAD and conditional
+// request handling.
+func serveTreeFile(w http.ResponseWriter, r *http.Request, machine *Machine, netbootDir, rel string) {
+	dirs, image, rollout, pinned := machineFileDirs(netbootDir, net.HardwareAddr(machine.Mac))
+
+	f, stat, dir, err := openTreeFile(dirs, rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		machine.Notify("boot_file_missing", BootFileMissingEvent{
+			Protocol:    requestProtocol(r),
+			Filename:    rel,
+			Directories: dirs,
+		})
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	name := path.Join(dir, rel)
+
+	// A file's first transfer waits for it to be hashed, so that even it
+	// reports which file was sent
+	sum, err := fileSHA256(name, f, stat)
+	if errors.Is(err, errFileChanged) {
+		log.Printf("Not serving %s: %v", name, err)
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	var signature *SignatureInfo
+	if authenticodeTrusted != nil {
+		signature = authenticodeFor(sha256Hex(sum), f, stat.Size())
+		// Firmware won't run it either, but a .efi which isn't PE shouldn't
+		// slip past the check
+		if signature == nil && path.Ext(rel) == ".efi" {
+			signature = &SignatureInfo{Error: "not a PE file"}
+		}
+	}
+
+	if signature != nil && !signature.Valid {
+		log.Printf("%s failed its signature check: %s", name, signature.Error)
+
+		if *authenticodePolicy == authenticodeRefuse {
+			machine.Notify("http_fetch_denied", TransferEvent{
+				Protocol:  requestProtocol(r),
+				Filename:  name,
+				Directory: dir,
+				SHA256:    sha256Hex(sum),
+				State:     "denied",
+				Error:     "signature: " + signature.Error,
+				Signature: signature,
+			})
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentTypeFor(rel))
+	w.Header().Set("ETag", fileETag(stat))
+	w.Header().Set("Repr-Digest", reprDigest(sum))
+
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, rel, stat.ModTime(), f)
+		return
+	}
+
+	eventName := fileEventFor(rel)
+	event := TransferEvent{
+		Protocol:   requestProtocol(r),
+		Filename:   name,
+		Directory:  dir,
+		SHA256:     sha256Hex(sum),
+		State:      "init",
+		TotalBytes: stat.Size(),
+		Signature:  signature,
+	}
+
+	if eventName == "http_fetch_uki" {
+		event.UKI = ukiInfoFor(sha256Hex(sum), f)
+	}
+
+	if pinned && dir == catalog.ImageDir(image) {
+		event.Image = image.Name
+		event.ImageVersion = image.Version
+		event.Rollout = rollout
+	}
+
+	slot, err := acquireTransferSlot(r.Context(), net.HardwareAddr(machine.Mac).String(), "", &event, func() {
+		recordTransfer(r.Context(), machine, eventName, event)
+	})
+	if err != nil {
+		log.Printf("Not serving %s: %v", name, err)
+		event.State = "refused"
+		event.Error = err.Error()
+		recordTransfer(context.Background(), machine, eventName, event)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer slot.Release()
+
+	var throttle transferThrottle
+	throttled := slot.Reader(r.Context(), f, func() {
+		if throttle.wait() && event.State == "sending" {
+			event.State = "throttled"
+			recordTransfer(r.Context(), machine, eventName, event)
+		}
+	})
+
+	// Operators replace files in place, so make sure we don't finish sending
+	// a torn file
+	var changedErr error
+	checkUnchanged := func() error {
+		if changed, err := fileChanged(f, stat); err != nil {
+			changedErr = err
+		} else if changed {
+			changedErr = errFileChanged
+		}
+		return changedErr
+	}
+
+	reader := &progressReadSeeker{
+		progressReader: newProgressReader(throttled, func(bytes int64) error {
+			event.SentBytes = bytes
+			event.State = throttle.progressState()
+			recordTransfer(context.Background(), machine, eventName, event)
+			return nil
+		}),
+		seeker: f,
+		check:  checkUnchanged,
+	}
+
+	uki := event.UKI
+
+	// The init event waits for http.ServeContent to decide which ranges, if
+	// any, it is serving
+	tw := &transferResponseWriter{ResponseWriter: w, onStatus: func(status int) {
+		if status == http.StatusPartialContent {
+			event.Range = r.Header.Get("Range")
+			event.Offset = contentRangeStart(w.Header().Get("Content-Range"), r.Header.Get("Range"))
+			if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+				event.TotalBytes = n
+			}
+			if event.Offset > 0 {
+				event.State = "resumed"
+			}
+		}
+
+		recordTransfer(r.Context(), machine, eventName, event)
+		event.State = "sending"
+		// Progress events leave out the UKI, which the last one repeats
+		event.UKI = nil
+	}}
+	start := time.Now()
+	http.ServeContent(tw, r, rel, stat.ModTime(), reader)
+
+	event.SentBytes = reader.finish()
+	event.UKI = uki
+	event.finished(time.Since(start))
+	if changedErr == nil && tw.status < 300 {
+		checkUnchanged()
+	}
+
+	switch {
+	case changedErr != nil:
+		event.State = "aborted"
+		event.Error = changedErr.Error()
+		log.Printf("Aborted serving %s: %v", name, changedErr)
+	case tw.err != nil:
+		event.State = "error"
+		event.Error = tw.err.Error()
+		log.Printf("Serving failure: %v", tw.err)
+	case tw.status == http.StatusNotModified:
+		event.State = "not_modified"
+	case tw.status >= 400:
+		event.State = "error"
+		event.Error = http.StatusText(tw.status)
+	default:
+		event.State = "complete"
+		machine.RecordImage(rel, event.SHA256)
+	}
+
+	recordTransfer(context.Background(), machine, eventName, event)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestWebserver serves dir, with its own Broker and Machines.
+func newTestWebserver(t *testing.T, dir string) (*http.ServeMux, *Broker, *Machines) {
+	t.Helper()
+
+	broker := NewBroker()
+	m := NewMachines(broker)
+	mux, err := webserver(dir, broker, m, NewAllocator(net.ParseIP("fec0::")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mux, broker, m
+}
+
+func TestServeMACTree(t *testing.T) {
+	dir := t.TempDir()
+	macDir := filepath.Join(dir, "04:42:1a:03:9b:20")
+	if err := os.MkdirAll(filepath.Join(macDir, "images"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(macDir, "images", "root.squashfs"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../secret", filepath.Join(macDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	httpFileEvents = nil
+	if err := httpFileEvents.Set("images/*.squashfs=http_fetch_rootfs"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { httpFileEvents = nil }()
+
+	mux, _, m := newTestWebserver(t, dir)
+
+	get := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("GET", "/mac/04:42:1a:03:9b:20/images/root.squashfs", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("Wanted the file, got %d %q", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("Wanted an ETag and content type, got %v", w.Header())
+	}
+
+	w = get("GET", "/mac/04:42:1a:03:9b:20/images/root.squashfs", http.Header{"Range": {"bytes=2-4"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Fatalf("Wanted a partial response, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = get("GET", "/mac/04:42:1a:03:9b:20/images/root.squashfs", http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("Wanted 304 for a matching ETag, got %d", w.Code)
+	}
+
+	w = get("HEAD", "/mac/04:42:1a:03:9b:20/images/root.squashfs", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "10" {
+		t.Fatalf("Wanted a bodiless HEAD response, got %d %v", w.Code, w.Header())
+	}
+
+	// Symlinks are followed, like those into the Nix store
+	w = get("GET", "/mac/04:42:1a:03:9b:20/escape", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "secret" {
+		t.Fatalf("Wanted the symlink followed, got %d %q", w.Code, w.Body.String())
+	}
+
+	if _, _, _, err := openTreeFile([]string{macDir}, "../secret"); err == nil {
+		t.Fatal("Wanted a path climbing out of the MAC's directory to be refused")
+	}
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	var transfers []TransferEvent
+	for _, ev := range m.GetMachine(mac).Events.Slice() {
+		if ev.Event == "http_fetch_rootfs" {
+			transfers = append(transfers, ev.Detail.(TransferEvent))
+		}
+	}
+	if len(transfers) != 6 || transfers[1].State != "complete" || transfers[5].State != "not_modified" {
+		t.Fatalf("Wanted start/finish pairs for the three GETs, got %v", transfers)
+	}
+
+	resumed, done := transfers[2], transfers[3]
+	if resumed.State != "resumed" || resumed.Range != "bytes=2-4" || resumed.Offset != 2 || resumed.TotalBytes != 3 {
+		t.Fatalf("Wanted the range request to resume at 2 for 3 bytes, got %+v", resumed)
+	}
+	if done.State != "complete" || done.SentBytes != 3 {
+		t.Fatalf("Wanted the range to complete after 3 bytes, got %+v", done)
+	}
+}
+
+func TestServeFallbackDirectories(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"default/boot.efi":           "default",
+		"group/rack1/boot.efi":       "rack1",
+		"oui/04:42:1a/vmlinuz":       "oui",
+		"04:42:1a:03:9b:20/boot.efi": "mine",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inventory = &Inventory{
+		Groups: map[string]*InventoryGroup{"rack1": {}},
+		Machines: map[string]*InventoryMachine{
+			"04:42:1a:03:9b:21": {Groups: []string{"rack1"}},
+		},
+	}
+	defer func() { inventory = nil }()
+
+	mux, _, m := newTestWebserver(t, dir)
+
+	for target, want := range map[string]string{
+		"/mac/04:42:1a:03:9b:20/boot.efi": "mine",
+		"/mac/04:42:1a:03:9b:21/boot.efi": "rack1",
+		"/mac/04:42:1a:03:9b:22/boot.efi": "default",
+		"/mac/04:42:1a:03:9b:22/vmlinuz":  "oui",
+		"/mac/00:00:5e:00:53:01/vmlinuz":  "",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+		if want == "" {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s: wanted 404, got %d", target, w.Code)
+			}
+		} else if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: wanted %q, got %d %q", target, want, w.Code, w.Body.String())
+		}
+	}
+
+	mac, _ := net.ParseMAC("00:00:5e:00:53:01")
+	last := m.GetMachine(mac).Events.At(m.GetMachine(mac).Events.Len() - 1)
+	if last.Event != "boot_file_missing" {
+		t.Fatalf("Wanted a boot_file_missing event, got %v", last)
+	}
+
+	mac, _ = net.ParseMAC("04:42:1a:03:9b:21")
+	last = m.GetMachine(mac).Events.At(m.GetMachine(mac).Events.Len() - 1)
+	if got := last.Detail.(TransferEvent).Directory; got != filepath.Join(dir, "group/rack1") {
+		t.Fatalf("Wanted the group directory to be reported, got %q", got)
+	}
+}
+
+// failingResponseWriter fails writes once it has taken a megabyte.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	written int
+}
+
+func (f *failingResponseWriter) Write(b []byte) (int, error) {
+	if f.written += len(b); f.written > 1<<20 {
+		return 0, errors.New("connection reset")
+	}
+	return len(b), nil
+}
+
+func TestServeMultipleRangesToFailingClient(t *testing.T) {
+	dir := t.TempDir()
+	macDir := filepath.Join(dir, "04:42:1a:03:9b:20")
+	if err := os.MkdirAll(macDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(macDir, "root.squashfs"), bytes.Repeat([]byte("0123456789"), 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, _, m := newTestWebserver(t, dir)
+
+	// http.ServeContent sends multiple ranges from another goroutine, which
+	// outlives it when the client goes away
+	r := httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/root.squashfs", nil)
+	r.Header.Set("Range", "bytes=0-6000000,7000000-9999999")
+	mux.ServeHTTP(&failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}, r)
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	events := m.GetMachine(mac).Events.Slice()
+	last, ok := events[len(events)-1].Detail.(TransferEvent)
+	if !ok || last.State != "error" {
+		t.Fatalf("Wanted the transfer to fail, got %+v", events[len(events)-1])
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Inventory describes machines we know about ahead of time, and the groups
+// they belong to. It is loaded from the JSON file passed as -inventory-file:
+//
+//	{
+//	  "groups": {
+//	    "rack1": {"boot_file_params": ["console=ttyS0,115200"]},
+//	    "legacy": {"boot_mode": "kernel", "kernel_cmdline": "console=ttyS0 hostname={{.Hostname}}"},
+//	    "flaky-nics": {"ipxe_flavor": "snponly"},
+//	    "shared-uki": {
+//	      "uki_cmdline": "hostname={{.Hostname}}",
+//	      "uki_credentials": {"hostname": "{{.Hostname}}"}
+//	    }
+//	  },
+//	  "machines": {
+//	    "04:42:1a:03:9b:20": {
+//	      "hostname": "r1n1",
+//	      "groups": ["rack1"],
+//	      "labels": {"rack": "r1"},
+//	      "boot_file_params": ["hostname={{.Hostname}}"]
+//	    }
+//	  }
+//	}
+type Inventory struct {
+	Groups   map[string]*InventoryGroup   `json:"groups"`
+	Machines map[string]*InventoryMachine `json:"machines"`
+}
+
+type InventoryGroup struct {
+	BootFileParams []string `json:"boot_file_params,omitempty"`
+	BootMode       string   `json:"boot_mode,omitempty"`
+	KernelCmdline  string   `json:"kernel_cmdline,omitempty"`
+	IPXEFlavor     string   `json:"ipxe_flavor,omitempty"`
+	// UKICmdline and UKICredentials are served as systemd-stub extras next to
+	// boot.efi, see ukiExtras
+	UKICmdline     string            `json:"uki_cmdline,omitempty"`
+	UKICredentials map[string]string `json:"uki_credentials,omitempty"`
+
+	bootFileParams []*template.Template
+	kernelCmdline  *template.Template
+	ukiCmdline     *template.Template
+	ukiCredentials map[string]*template.Template
+}
+
+type InventoryMachine struct {
+	Hostname       string            `json:"hostname,omitempty"`
+	Groups         []string          `json:"groups,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	BootFileParams []string          `json:"boot_file_params,omitempty"`
+	BootMode       string            `json:"boot_mode,omitempty"`
+	KernelCmdline  string            `json:"kernel_cmdline,omitempty"`
+	IPXEFlavor     string            `json:"ipxe_flavor,omitempty"`
+	UKICmdline     string            `json:"uki_cmdline,omitempty"`
+	UKICredentials map[string]string `json:"uki_credentials,omitempty"`
+
+	bootFileParams []*template.Template
+	kernelCmdline  *template.Template
+	ukiCmdline     *template.Template
+	ukiCredentials map[string]*template.Template
+}
+
+var inventory *Inventory
+
+func LoadInventory(path string) (*Inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the inventory %q: %w", path, err)
+	}
+
+	var raw Inventory
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing the inventory %q: %w", path, err)
+	}
+
+	inv := &Inventory{
+		Groups:   make(map[string]*InventoryGroup),
+		Machines: make(map[string]*InventoryMachine),
+	}
+
+	for name, group := range raw.Groups {
+		// Group names are also directory names, see bootFileDirs
+		if !fs.ValidPath(name) || strings.Contains(name, "/") || name == "." {
+			return nil, fmt.Errorf("inventory group %q must be usable as a directory name", name)
+		}
+
+		if group == nil {
+			group = &InventoryGroup{}
+		}
+
+		group.bootFileParams, err = parseBootFileParams("group "+name, group.BootFileParams)
+		if err != nil {
+			return nil, err
+		}
+
+		group.kernelCmdline, err = parseBootMode("group "+name, group.BootMode, group.KernelCmdline)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkIPXEFlavor("group "+name, group.IPXEFlavor); err != nil {
+			return nil, err
+		}
+
+		group.ukiCmdline, group.ukiCredentials, err = parseUKIExtras("group "+name, group.UKICmdline, group.UKICredentials)
+		if err != nil {
+			return nil, err
+		}
+
+		inv.Groups[name] = group
+	}
+
+	for macStr, machine := range raw.Machines {
+		// Normalize the keys, so lookups don't depend on how the MAC was written
+		mac, err := net.ParseMAC(macStr)
+		if err != nil {
+			return nil, fmt.Errorf("inventory machine %q: %w", macStr, err)
+		}
+
+		if machine == nil {
+			machine = &InventoryMachine{}
+		}
+
+		for _, group := range machine.Groups {
+			if inv.Groups[group] == nil {
+				return nil, fmt.Errorf("inventory machine %s is in the undefined group %q", mac, group)
+			}
+		}
+
+		machine.bootFileParams, err = parseBootFileParams("machine "+mac.String(), machine.BootFileParams)
+		if err != nil {
+			return nil, err
+		}
+
+		machine.kernelCmdline, err = parseBootMode("machine "+mac.String(), machine.BootMode, machine.KernelCmdline)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkIPXEFlavor("machine "+mac.String(), machine.IPXEFlavor); err != nil {
+			return nil, err
+		}
+
+		machine.ukiCmdline, machine.ukiCredentials, err = parseUKIExtras("machine "+mac.String(), machine.UKICmdline, machine.UKICredentials)
+		if err != nil {
+			return nil, err
+		}
+
+		inv.Machines[mac.String()] = machine
+	}
+
+	return inv, nil
+}
+
+func parseBootFileParams(owner string, params []string) ([]*template.Template, error) {
+	out := make([]*template.Template, 0, len(params))
+	for i, param := range params {
+		tmpl, err := newBootTemplate(fmt.Sprintf("%s boot_file_params[%d]", owner, i), param)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the boot file parameters of %s: %w", owner, err)
+		}
+		out = append(out, tmpl)
+	}
+
+	return out, nil
+}
+
+// parseBootMode checks the boot mode and parses the kernel command line
+// template, which is nil if there isn't one.
+func parseBootMode(owner, mode, cmdline string) (*template.Template, error) {
+	if mode != "" && !validBootMode(mode) {
+		return nil, fmt.Errorf("invalid boot mode %q for %s, wanted %s or %s", mode, owner, bootModeUKI, bootModeKernel)
+	}
+
+	if cmdline == "" {
+		return nil, nil
+	}
+
+	tmpl, err := newBootTemplate(owner+" kernel_cmdline", cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the kernel command line of %s: %w", owner, err)
+	}
+
+	return tmpl, nil
+}
+
+// parseUKIExtras parses the UKI command line and credential templates. The
+// credential names are also file names, see ukiExtras.
+func parseUKIExtras(owner, cmdline string, credentials map[string]string) (*template.Template, map[string]*template.Template, error) {
+	var cmdlineTmpl *template.Template
+	if cmdline != "" {
+		var err error
+		cmdlineTmpl, err = newBootTemplate(owner+" uki_cmdline", cmdline)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing the UKI command line of %s: %w", owner, err)
+		}
+	}
+
+	credentialTmpls := make(map[string]*template.Template, len(credentials))
+	for name, text := range credentials {
+		if !fs.ValidPath(name) || strings.Contains(name, "/") || name == "." {
+			return nil, nil, fmt.Errorf("UKI credential %q of %s must be usable as a file name", name, owner)
+		}
+
+		tmpl, err := newBootTemplate(fmt.Sprintf("%s uki_credentials[%s]", owner, name), text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing the UKI credential %q of %s: %w", name, owner, err)
+		}
+		credentialTmpls[name] = tmpl
+	}
+
+	return cmdlineTmpl, credentialTmpls, nil
+}
+
+// Machine returns the inventory entry for the MAC, or nil.
+func (inv *Inventory) Machine(mac net.HardwareAddr) *InventoryMachine {
+	if inv == nil {
+		return nil
+	}
+
+	return inv.Machines[mac.String()]
+}
+
+// BootFileParams renders the machine's boot file parameters. The machine's
+// own parameters win; otherwise the first of its groups with parameters is
+// used.
+func (inv *Inventory) BootFileParams(mac net.HardwareAddr, data interface{}) ([]string, error) {
+	machine := inv.Machine(mac)
+	if machine == nil {
+		return nil, nil
+	}
+
+	tmpls := machine.bootFileParams
+	if len(tmpls) == 0 {
+		for _, name := range machine.Groups {
+			if group := inv.Groups[name]; len(group.bootFileParams) > 0 {
+				tmpls = group.bootFileParams
+				break
+			}
+		}
+	}
+
+	out := make([]string, 0, len(tmpls))
+	for _, tmpl := range tmpls {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering %s: %w", tmpl.Name(), err)
+		}
+		out = append(out, buf.String())
+	}
+
+	return out, nil
+}
+
+func checkIPXEFlavor(owner, flavor string) error {
+	if flavor != "" && !validIPXEFlavor(flavor) {
+		return fmt.Errorf("invalid iPXE flavor %q for %s, wanted %s, %s or %s", flavor, owner, ipxeFull, ipxeSNPOnly, ipxeUNDIOnly)
+	}
+
+	return nil
+}
+
+// IPXEFlavor returns the machine's iPXE flavor, or "" if neither the machine
+// nor any of its groups has one, picked like BootMode.
+func (inv *Inventory) IPXEFlavor(mac net.HardwareAddr) string {
+	machine := inv.Machine(mac)
+	if machine == nil {
+		return ""
+	}
+
+	if machine.IPXEFlavor != "" {
+		return machine.IPXEFlavor
+	}
+
+	for _, name := range machine.Groups {
+		if group := inv.Groups[name]; group.IPXEFlavor != "" {
+			return group.IPXEFlavor
+		}
+	}
+
+	return ""
+}
+
+// BootMode returns the machine's boot mode, or "" if neither the machine nor
+// any of its groups has one. The machine's own mode wins; otherwise the first
+// of its groups with a mode is used.
+func (inv *Inventory) BootMode(mac net.HardwareAddr) string {
+	machine := inv.Machine(mac)
+	if machine == nil {
+		return ""
+	}
+
+	if machine.BootMode != "" {
+		return machine.BootMode
+	}
+
+	for _, name := range machine.Groups {
+		if group := inv.Groups[name]; group.BootMode != "" {
+			return group.BootMode
+		}
+	}
+
+	return ""
+}
+
+// KernelCmdline renders the machine's kernel command line, picked like
+// BootMode. ok is false if neither the machine nor its groups have one.
+func (inv *Inventory) KernelCmdline(mac net.HardwareAddr, data interface{}) (cmdline string, ok bool, err error) {
+	machine := inv.Machine(mac)
+	if machine == nil {
+		return "", false, nil
+	}
+
+	tmpl := machine.kernelCmdline
+	for _, name := range machine.Groups {
+		if tmpl != nil {
+			break
+		}
+		tmpl = inv.Groups[name].kernelCmdline
+	}
+
+	if tmpl == nil {
+		return "", false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", true, fmt.Errorf("rendering %s: %w", tmpl.Name(), err)
+	}
+
+	return buf.String(), true, nil
+}
+
+// ukiCmdline picks the machine's UKI addon command line template like
+// BootMode, or nil if neither the machine nor its groups have one.
+func (inv *Inventory) ukiCmdline(mac net.HardwareAddr) *template.Template {
+	machine := inv.Machine(mac)
+	if machine == nil {
+		return nil
+	}
+
+	tmpl := machine.ukiCmdline
+	for _, name := range machine.Groups {
+		if tmpl != nil {
+			break
+		}
+		tmpl = inv.Groups[name].ukiCmdline
+	}
+
+	return tmpl
+}
+
+// HasUKICmdline reports whether the machine has a UKI addon command line.
+func (inv *Inventory) HasUKICmdline(mac net.HardwareAddr) bool {
+	return inv.ukiCmdline(mac) != nil
+}
+
+// UKICmdline renders the machine's UKI addon command line. ok is false if it
+// doesn't have one.
+func (inv *Inventory) UKICmdline(mac net.HardwareAddr, data interface{}) (cmdline string, ok bool, err error) {
+	tmpl := inv.ukiCmdline(mac)
+	if tmpl == nil {
+		return "", false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", true, fmt.Errorf("rendering %s: %w", tmpl.Name(), err)
+	}
+
+	return buf.String(), true, nil
+}
+
+// ukiCredentials collects the machine's UKI credential templates by name.
+// The machine's own win, then those of its groups, in order.
+func (inv *Inventory) ukiCredentials(mac net.HardwareAddr) map[string]*template.Template {
+	machine := inv.Machine(mac)
+	if machine == nil {
+		return nil
+	}
+
+	tmpls := make(map[string]*template.Template)
+	for name, tmpl := range machine.ukiCredentials {
+		tmpls[name] = tmpl
+	}
+
+	for _, group := range machine.Groups {
+		for name, tmpl := range inv.Groups[group].ukiCredentials {
+			if _, ok := tmpls[name]; !ok {
+				tmpls[name] = tmpl
+			}
+		}
+	}
+
+	return tmpls
+}
+
+// UKICredentialNames lists the machine's UKI credentials, sorted.
+func (inv *Inventory) UKICredentialNames(mac net.HardwareAddr) []string {
+	var names []string
+	for name := range inv.ukiCredentials(mac) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// UKICredential renders one of the machine's UKI credentials. ok is false if
+// it doesn't have one by that name.
+func (inv *Inventory) UKICredential(mac net.HardwareAddr, name string, data interface{}) (credential []byte, ok bool, err error) {
+	tmpl, ok := inv.ukiCredentials(mac)[name]
+	if !ok {
+		return nil, false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, true, fmt.Errorf("rendering %s: %w", tmpl.Name(), err)
+	}
+
+	return buf.Bytes(), true, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func loadTestInventory(t *testing.T, contents string) *Inventory {
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("WriteFile failure: %v", err)
+	}
+
+	inv, err := LoadInventory(path)
+	if err != nil {
+		t.Fatalf("LoadInventory failure: %v", err)
+	}
+
+	return inv
+}
+
+func TestInventoryBootFileParams(t *testing.T) {
+	inv := loadTestInventory(t, `{
+		"groups": {
+			"empty": {},
+			"rack1": {"boot_file_params": ["console=ttyS0", "mac={{.MAC}}"]}
+		},
+		"machines": {
+			"04-42-1A-03-9B-20": {"groups": ["empty", "rack1"]},
+			"04:42:1a:03:9b:21": {"groups": ["rack1"], "boot_file_params": ["own"]}
+		}
+	}`)
+
+	data := map[string]interface{}{"MAC": "04:42:1a:03:9b:20"}
+
+	got, err := inv.BootFileParams(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20}, data)
+	if err != nil {
+		t.Fatalf("BootFileParams failure: %v", err)
+	}
+	if want := []string{"console=ttyS0", "mac=04:42:1a:03:9b:20"}; !slices.Equal(got, want) {
+		t.Fatalf("Wanted %v, got %v", want, got)
+	}
+
+	got, err = inv.BootFileParams(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x21}, data)
+	if err != nil {
+		t.Fatalf("BootFileParams failure: %v", err)
+	}
+	if want := []string{"own"}; !slices.Equal(got, want) {
+		t.Fatalf("Wanted %v, got %v", want, got)
+	}
+
+	got, err = inv.BootFileParams(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x22}, data)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Wanted nothing for an unknown machine, got %v (%v)", got, err)
+	}
+}
+
+func TestNilInventoryHasNoBootFileParams(t *testing.T) {
+	var inv *Inventory
+	got, err := inv.BootFileParams(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20}, nil)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Wanted nothing, got %v (%v)", got, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"path"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// iPXE flavors: the full build with its own NIC drivers; snponly, which
+// drives the NIC through the firmware's SNP, for NICs the full build gets
+// wrong; and undionly, which chainloads from BIOS PXE through the NIC's UNDI.
+type ipxeFlavor string
+
+const (
+	ipxeFull     ipxeFlavor = "ipxe"
+	ipxeSNPOnly  ipxeFlavor = "snponly"
+	ipxeUNDIOnly ipxeFlavor = "undionly"
+)
+
+// ipxeFlavors are the flavors in the order we pick them, after a machine's
+// own. Each is configured per architecture, so undionly is only there for
+// BIOS clients.
+var ipxeFlavors = []ipxeFlavor{ipxeFull, ipxeSNPOnly, ipxeUNDIOnly}
+
+// ipxeFlavorFiles are the names the flavors are served as
+var ipxeFlavorFiles = map[ipxeFlavor]string{
+	ipxeFull:     "ipxe.efi",
+	ipxeSNPOnly:  "snponly.efi",
+	ipxeUNDIOnly: "undionly.kpxe",
+}
+
+func validIPXEFlavor(flavor string) bool {
+	_, ok := ipxeFlavorFiles[ipxeFlavor(flavor)]
+	return ok
+}
+
+// ipxeFlavorOfFile is the flavor served as name.
+func ipxeFlavorOfFile(name string) (ipxeFlavor, bool) {
+	for flavor, file := range ipxeFlavorFiles {
+		if file == name {
+			return flavor, true
+		}
+	}
+
+	return "", false
+}
+
+// defaultArch is the architecture a path without one is for.
+func (f ipxeFlavor) defaultArch() iana.Arch {
+	if f == ipxeUNDIOnly {
+		return iana.INTEL_X86PC
+	}
+
+	return iana.EFI_X86_64
+}
+
+// ipxeBinaryKey identifies an iPXE binary.
+type ipxeBinaryKey struct {
+	flavor ipxeFlavor
+	arch   iana.Arch
+}
+
+func (k ipxeBinaryKey) String() string {
+	return string(k.flavor) + "/" + archName(k.arch)
+}
+
+// ipxeBinaryFor picks the iPXE binary to point the machine at: the first
+// flavor we have for one of its architectures, trying its inventory's
+// ipxe_flavor first.
+func ipxeBinaryFor(mac net.HardwareAddr, archs iana.Archs) (ipxeBinaryKey, bool) {
+	flavors := ipxeFlavors
+	if flavor := inventory.IPXEFlavor(mac); flavor != "" {
+		flavors = append([]ipxeFlavor{ipxeFlavor(flavor)}, flavors...)
+	}
+
+	for _, flavor := range flavors {
+		for _, arch := range archs {
+			key := ipxeBinaryKey{flavor: flavor, arch: arch}
+			if _, ok := ipxeBinary(key); ok {
+				return key, true
+			}
+		}
+	}
+
+	return ipxeBinaryKey{}, false
+}
+
+// ipxeTftpPath is the path we point PXE clients at, see tftpReadHandler.
+func ipxeTftpPath(mac string, key ipxeBinaryKey) string {
+	return path.Join(mac, archName(key.arch), ipxeFlavorFiles[key.flavor])
+}
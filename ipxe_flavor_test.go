@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestIPXEBinaryFor(t *testing.T) {
+	ipxeBinaries = map[ipxeBinaryKey][]byte{
+		{ipxeFull, iana.EFI_X86_64}:      []byte("ipxe"),
+		{ipxeSNPOnly, iana.EFI_X86_64}:   []byte("snponly"),
+		{ipxeSNPOnly, iana.EFI_ARM64}:    []byte("snponly"),
+		{ipxeUNDIOnly, iana.INTEL_X86PC}: []byte("undionly"),
+	}
+	defer func() { ipxeBinaries = make(map[ipxeBinaryKey][]byte) }()
+
+	inventory = loadTestInventory(t, `{
+		"groups": {"flaky-nics": {"ipxe_flavor": "snponly"}},
+		"machines": {
+			"04:42:1a:03:9b:21": {"groups": ["flaky-nics"]},
+			"04:42:1a:03:9b:22": {"ipxe_flavor": "undionly"}
+		}
+	}`)
+	defer func() { inventory = nil }()
+
+	plain, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	flaky, _ := net.ParseMAC("04:42:1a:03:9b:21")
+	confused, _ := net.ParseMAC("04:42:1a:03:9b:22")
+
+	for _, tc := range []struct {
+		mac   net.HardwareAddr
+		archs iana.Archs
+		want  string
+	}{
+		{plain, iana.Archs{iana.EFI_X86_64}, "04:42:1a:03:9b:20/EFI_X86_64/ipxe.efi"},
+		{plain, iana.Archs{iana.INTEL_X86PC}, "04:42:1a:03:9b:20/INTEL_X86PC/undionly.kpxe"},
+		// Only snponly is configured for arm64
+		{plain, iana.Archs{iana.EFI_ARM64}, "04:42:1a:03:9b:20/EFI_ARM64/snponly.efi"},
+		{flaky, iana.Archs{iana.EFI_X86_64}, "04:42:1a:03:9b:21/EFI_X86_64/snponly.efi"},
+		// An override we have no binary for the architecture of is ignored
+		{confused, iana.Archs{iana.EFI_X86_64}, "04:42:1a:03:9b:22/EFI_X86_64/ipxe.efi"},
+		{plain, iana.Archs{iana.EFI_IA32}, ""},
+	} {
+		key, ok := ipxeBinaryFor(tc.mac, tc.archs)
+		got := ""
+		if ok {
+			got = ipxeTftpPath(tc.mac.String(), key)
+		}
+		if got != tc.want {
+			t.Errorf("%s %v: got %q, wanted %q", tc.mac, tc.archs, got, tc.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	if err := os.WriteFile(path, []byte(`{"machines": {"04:42:1a:03:9b:20": {"ipxe_flavor": "full"}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadInventory(path); err == nil {
+		t.Fatalf("Wanted an unknown flavor to be refused")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+)
+
+// ipxeScriptName is the file in a machine's tree which is rendered from
+// ipxeScriptTemplate rather than read from disk.
+const ipxeScriptName = "boot.ipxe"
+
+// Template iPXE is chained to instead of a boot URL. If nil, iPXE is chained
+// to the rendered boot URL template, unless the machine is in kernel boot
+// mode, see ipxeScriptTemplateFor.
+var ipxeScriptTemplate *template.Template
+
+// IPXEScriptEvent is the detail of an ipxe_script event.
+type IPXEScriptEvent struct {
+	// Branch is what the script chose to do, as marked by the template's
+	// calls to branch
+	Branch string `json:"branch,omitempty"`
+	Intent string `json:"intent"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newIPXEScriptTemplate parses an iPXE script template. Besides the boot
+// template functions, it has `branch NAME`, which renders nothing and
+// records NAME as the branch the script took, and `fileURL . NAME`, the URL
+// of a file in the machine's tree.
+func newIPXEScriptTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).
+		Funcs(bootTemplateFuncs).
+		Funcs(template.FuncMap{
+			"branch":  func(string) string { return "" },
+			"fileURL": fileURL,
+		}).
+		Option("missingkey=zero").
+		Parse(text)
+}
+
+// fileURL is the URL of a file in the machine's tree on our HTTP server,
+// carrying a signature for the file and the context's payload when they are
+// checked.
+func fileURL(ctx BootTemplateContext, name string) string {
+	u := url.URL{
+		Scheme: "http",
+		Host:   "[" + ctx.BaseAddress + "]",
+		Path:   "/mac/" + ctx.MAC + "/" + name,
+	}
+
+	query := url.Values{}
+	if ctx.Signature != "" {
+		mac, _ := net.ParseMAC(ctx.MAC)
+		expires, _ := strconv.ParseInt(ctx.Expires, 10, 64)
+		query.Set("expires", ctx.Expires)
+		query.Set("signature", signBootURL(mac, name, expires))
+	}
+	if *requireBootPayload {
+		query.Set("payload", ctx.Payload)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// ipxeScriptURL is where iPXE fetches the machine's script from.
+func ipxeScriptURL(a *Allocator, mac net.HardwareAddr, machine *Machine) string {
+	return fileURL(machineTemplateContext(a, mac, machine, nil), ipxeScriptName)
+}
+
+// renderIPXEScript renders a machine's script, and returns the last branch
+// it marked.
+func renderIPXEScript(tmpl *template.Template, ctx BootTemplateContext) (script []byte, branch string, err error) {
+	tmpl, err = tmpl.Clone()
+	if err != nil {
+		return nil, "", err
+	}
+
+	tmpl.Funcs(template.FuncMap{"branch": func(name string) string {
+		branch = name
+		return ""
+	}})
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		return nil, branch, fmt.Errorf("rendering the iPXE script template: %w", err)
+	}
+
+	return buf.Bytes(), branch, nil
+}
+
+// serveIPXEScript renders and serves the machine's iPXE script from tmpl,
+// reporting the branch it took.
+func serveIPXEScript(w http.ResponseWriter, r *http.Request, tmpl *template.Template,
+	a *Allocator, mac net.HardwareAddr, machine *Machine) {
+
+	ctx := machineTemplateContext(a, mac, machine, nil)
+
+	cmdline, err := renderKernelCmdline(mac, ctx)
+	if err != nil {
+		log.Printf("Failed to render the kernel command line for %s: %v", mac, err)
+		machine.Notify("ipxe_script", IPXEScriptEvent{Intent: ctx.Intent, Error: err.Error()})
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	ctx.Cmdline = cmdline
+
+	params, err := inventory.BootFileParams(mac, ctx)
+	if err != nil {
+		log.Printf("Failed to render the boot file parameters for %s: %v", mac, err)
+	}
+	ctx.BootFileParams = params
+
+	script, branch, err := renderIPXEScript(tmpl, ctx)
+	if err != nil {
+		log.Printf("Failed to render the iPXE script for %s: %v", mac, err)
+		machine.Notify("ipxe_script", IPXEScriptEvent{Branch: branch, Intent: ctx.Intent, Error: err.Error()})
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	machine.Notify("ipxe_script", IPXEScriptEvent{Branch: branch, Intent: ctx.Intent})
+	w.Write(script)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestIPXEScript(t *testing.T) {
+	var err error
+	ipxeScriptTemplate, err = newIPXEScriptTemplate("test", `#!ipxe
+{{if eq .Intent "local"}}{{branch "local"}}exit
+{{else}}{{branch "uki"}}chain http://[{{.BaseAddress}}]/mac/{{.MAC}}/boot.efi
+{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { ipxeScriptTemplate = nil }()
+
+	bootIntents, err = LoadBootIntents(filepath.Join(t.TempDir(), "intents.json"), intentAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { bootIntents = nil }()
+
+	mac := net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20}
+
+	t.Run("iPXE is chained to the script, even to boot locally", func(t *testing.T) {
+		s := newTestLeaseQueryHandler()
+
+		msg, err := dhcpv6.NewMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.MessageType = dhcpv6.MessageTypeSolicit
+		msg.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: mac}))
+		msg.AddOption(dhcpv6.OptClientArchType(iana.EFI_X86_64))
+		msg.AddOption(&dhcpv6.OptVendorClass{Data: [][]byte{[]byte("PXEClient:Arch:00007:UNDI:003016")}})
+		msg.AddOption(&dhcpv6.OptUserClass{UserClasses: [][]byte{[]byte("iPXE")}})
+		msg.AddOption(&dhcpv6.OptIANA{})
+
+		if _, err := bootIntents.Set(mac, intentLocal); err != nil {
+			t.Fatal(err)
+		}
+		defer bootIntents.Set(mac, intentAlways)
+
+		want := "http://[fec0::]/mac/04:42:1a:03:9b:20/boot.ipxe"
+		if got := bootFileURLFor(t, s, msg); got != want {
+			t.Fatalf("Wanted %q, got %q", want, got)
+		}
+	})
+
+	t.Run("the script follows the intent", func(t *testing.T) {
+		mux, broker, _ := newTestWebserver(t, t.TempDir())
+
+		subscriber, unsubscribe := broker.SubscribeBuffered(16)
+		defer unsubscribe()
+
+		fetch := func() (string, IPXEScriptEvent) {
+			t.Helper()
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/boot.ipxe", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Wanted the script, got %d %q", w.Code, w.Body.String())
+			}
+
+			for ev := range subscriber {
+				if ev.Event.Event == "ipxe_script" {
+					return w.Body.String(), ev.Event.Detail.(IPXEScriptEvent)
+				}
+			}
+			t.Fatal("No ipxe_script event")
+			return "", IPXEScriptEvent{}
+		}
+
+		script, ev := fetch()
+		if !strings.Contains(script, "chain http://[fec0::]/mac/04:42:1a:03:9b:20/boot.efi") || ev.Branch != "uki" {
+			t.Fatalf("Wanted the uki branch, got %q %+v", script, ev)
+		}
+
+		if _, err := bootIntents.Set(mac, intentLocal); err != nil {
+			t.Fatal(err)
+		}
+
+		script, ev = fetch()
+		if !strings.Contains(script, "exit") || ev.Branch != "local" || ev.Intent != intentLocal {
+			t.Fatalf("Wanted the local branch, got %q %+v", script, ev)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ipxeReloadDelay lets a file being written settle before it's reloaded.
+const ipxeReloadDelay = 250 * time.Millisecond
+
+// IPXEBinaryEvent is the detail of the ipxe_binary_reloaded and
+// ipxe_binary_reload_failed events.
+type IPXEBinaryEvent struct {
+	Flavors       []string `json:"flavors"`
+	Architectures []string `json:"architectures"`
+	Path          string   `json:"path"`
+	Size          int      `json:"size,omitempty"`
+	SHA256        string   `json:"sha256,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// IPXEWatcher reloads the iPXE binaries when their files change, so a rebuilt
+// iPXE is served without a restart. It watches the files' directories rather
+// than the files, to see files replaced by a rename or a new symlink.
+type IPXEWatcher struct {
+	watcher *fsnotify.Watcher
+	broker  *Broker
+	// keys are the binaries of each path
+	keys map[string][]ipxeBinaryKey
+}
+
+func NewIPXEWatcher(paths map[ipxeBinaryKey]string, broker *Broker) (*IPXEWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating the iPXE binary watcher: %w", err)
+	}
+
+	w := &IPXEWatcher{
+		watcher: watcher,
+		broker:  broker,
+		keys:    make(map[string][]ipxeBinaryKey),
+	}
+
+	for key, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+
+		if len(w.keys[path]) == 0 {
+			if err := watcher.Add(filepath.Dir(path)); err != nil {
+				watcher.Close()
+				return nil, fmt.Errorf("watching iPXE binary %q: %w", path, err)
+			}
+		}
+		w.keys[path] = append(w.keys[path], key)
+	}
+
+	return w, nil
+}
+
+// Run reloads binaries until Close is called.
+func (w *IPXEWatcher) Run() {
+	pending := make(map[string]*time.Timer)
+
+	for {
+		select {
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if _, watched := w.keys[ev.Name]; !watched || !ev.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+
+			// Writes come in bursts, so wait for the last one
+			if timer, ok := pending[ev.Name]; ok {
+				timer.Reset(ipxeReloadDelay)
+			} else {
+				path := ev.Name
+				pending[path] = time.AfterFunc(ipxeReloadDelay, func() { w.reload(path) })
+			}
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watching the iPXE binaries: %v", err)
+		}
+	}
+}
+
+func (w *IPXEWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// reload replaces the binary at path, keeping the one we have if the new one
+// can't be read.
+func (w *IPXEWatcher) reload(path string) {
+	keys := w.keys[path]
+
+	detail := IPXEBinaryEvent{Path: path}
+	for _, key := range keys {
+		if !slices.Contains(detail.Flavors, string(key.flavor)) {
+			detail.Flavors = append(detail.Flavors, string(key.flavor))
+		}
+		if !slices.Contains(detail.Architectures, archName(key.arch)) {
+			detail.Architectures = append(detail.Architectures, archName(key.arch))
+		}
+	}
+	sort.Strings(detail.Flavors)
+	sort.Strings(detail.Architectures)
+
+	data, err := readIPXEBinary(path)
+	if err != nil {
+		log.Printf("Keeping the old iPXE binary: %v", err)
+		detail.Error = err.Error()
+		w.broker.Publish(IdentifiedEvent{Event: NewEvent("ipxe_binary_reload_failed", false, detail)})
+		return
+	}
+
+	ipxeBinariesMu.Lock()
+	unchanged := bytes.Equal(ipxeBinaries[keys[0]], data)
+	for _, key := range keys {
+		ipxeBinaries[key] = data
+	}
+	ipxeBinariesMu.Unlock()
+
+	if unchanged {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	detail.Size = len(data)
+	detail.SHA256 = sha256Hex(sum[:])
+
+	log.Printf("Reloaded iPXE binary %q for %v (%d bytes)", path, keys, len(data))
+	w.broker.Publish(IdentifiedEvent{Event: NewEvent("ipxe_binary_reloaded", false, detail)})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestIPXEWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ipxe.efi")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	x8664 := ipxeBinaryKey{flavor: ipxeFull, arch: iana.EFI_X86_64}
+	bc := ipxeBinaryKey{flavor: ipxeFull, arch: iana.EFI_BC}
+	paths := map[ipxeBinaryKey]string{x8664: path, bc: path}
+	for key, path := range paths {
+		if err := LoadIPXEBinary(key, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() { ipxeBinaries = make(map[ipxeBinaryKey][]byte) }()
+
+	broker := NewBroker()
+	w, err := NewIPXEWatcher(paths, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	go w.Run()
+
+	subscriber, unsubscribe := broker.SubscribeBuffered(16)
+	defer unsubscribe()
+
+	wait := func() IdentifiedEvent {
+		select {
+		case ev := <-subscriber:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a reload")
+			return IdentifiedEvent{}
+		}
+	}
+
+	// Replaced with a rename, like an atomic copy
+	tmp := filepath.Join(dir, ".ipxe.efi.tmp")
+	if err := os.WriteFile(tmp, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := wait()
+	detail, ok := ev.Event.Detail.(IPXEBinaryEvent)
+	if ev.Event.Event != "ipxe_binary_reloaded" || !ok || detail.Size != 3 || len(detail.Architectures) != 2 {
+		t.Fatalf("Wanted a reload, got %+v", ev.Event)
+	}
+	for _, key := range []ipxeBinaryKey{x8664, bc} {
+		if binary, _ := ipxeBinary(key); string(binary) != "new" {
+			t.Fatalf("Wanted the new binary for %s, got %q", key, binary)
+		}
+	}
+
+	// A broken build keeps the binary we have
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := wait(); ev.Event.Event != "ipxe_binary_reload_failed" {
+		t.Fatalf("Wanted a failed reload, got %+v", ev.Event)
+	}
+	if binary, _ := ipxeBinary(x8664); string(binary) != "new" {
+		t.Fatalf("Wanted to keep the new binary, got %q", binary)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"text/template"
+)
+
+// Boot modes say what a machine boots over HTTP.
+const (
+	// bootModeUKI chains to a unified kernel image, boot.efi, which carries
+	// its own command line
+	bootModeUKI = "uki"
+	// bootModeKernel has iPXE fetch a generated script, which boots the
+	// kernel and initrd files with a command line from the inventory
+	bootModeKernel = "kernel"
+)
+
+func validBootMode(mode string) bool {
+	return mode == bootModeUKI || mode == bootModeKernel
+}
+
+// Template of the kernel command line for machines without one in the
+// inventory. If nil, they get an empty command line.
+var kernelCmdlineTemplate *template.Template
+
+// defaultIPXEScriptTemplate is served to kernel boot mode machines, and UKI
+// machines with generated extras, when there is no
+// -ipxe-script-template-file. iPXE shows the images it fetched to the UKI as
+// files, which is where systemd-stub looks for the extras.
+var defaultIPXEScriptTemplate = template.Must(newIPXEScriptTemplate("defaultIPXEScript", `#!ipxe
+{{if eq .Intent "local"}}{{branch "local"}}exit
+{{else if eq .BootMode "kernel"}}{{branch "kernel"}}kernel {{fileURL . "kernel"}} {{.Cmdline}}
+initrd {{fileURL . "initrd"}}
+boot
+{{else}}{{branch "uki"}}{{range .UKIExtras}}imgfetch --name {{.}} {{fileURL $ .}}
+{{end}}chain {{fileURL . "boot.efi"}}
+{{end}}`))
+
+// bootModeFor returns the machine's boot mode from the inventory, falling
+// back to -boot-mode.
+func bootModeFor(mac net.HardwareAddr) string {
+	if mode := inventory.BootMode(mac); mode != "" {
+		return mode
+	}
+
+	return *defaultBootMode
+}
+
+// kernelBootEnabled reports whether any machine could be in kernel boot
+// mode.
+func kernelBootEnabled() bool {
+	if *defaultBootMode == bootModeKernel {
+		return true
+	}
+
+	if inventory == nil {
+		return false
+	}
+
+	for _, group := range inventory.Groups {
+		if group.BootMode == bootModeKernel {
+			return true
+		}
+	}
+
+	for _, machine := range inventory.Machines {
+		if machine.BootMode == bootModeKernel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ipxeScriptTemplateFor picks the iPXE script template for a machine, or nil
+// if iPXE should be chained to the boot URL instead.
+func ipxeScriptTemplateFor(mac net.HardwareAddr) *template.Template {
+	if ipxeScriptTemplate != nil {
+		return ipxeScriptTemplate
+	}
+
+	if bootModeFor(mac) == bootModeKernel || len(ukiExtraNames(mac)) > 0 {
+		return defaultIPXEScriptTemplate
+	}
+
+	return nil
+}
+
+// renderKernelCmdline renders the machine's kernel command line from the
+// inventory, or from -kernel-cmdline.
+func renderKernelCmdline(mac net.HardwareAddr, ctx BootTemplateContext) (string, error) {
+	cmdline, ok, err := inventory.KernelCmdline(mac, ctx)
+	if ok || err != nil {
+		return cmdline, err
+	}
+
+	if kernelCmdlineTemplate == nil {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := kernelCmdlineTemplate.Execute(&buf, ctx); err != nil {
+		return "", fmt.Errorf("rendering the kernel command line template: %w", err)
+	}
+
+	return buf.String(), nil
+}
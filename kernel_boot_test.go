@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKernelBoot(t *testing.T) {
+	inventory = loadTestInventory(t, `{
+		"groups": {
+			"legacy": {"boot_mode": "kernel", "kernel_cmdline": "console=ttyS0 hostname={{.Hostname}}"}
+		},
+		"machines": {
+			"04:42:1a:03:9b:20": {"hostname": "r1n1", "groups": ["legacy"]},
+			"04:42:1a:03:9b:21": {"hostname": "r1n2"}
+		}
+	}`)
+	defer func() { inventory = nil }()
+
+	dir := t.TempDir()
+	for _, mac := range []string{"04:42:1a:03:9b:20", "04:42:1a:03:9b:21"} {
+		if err := os.MkdirAll(filepath.Join(dir, mac), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"kernel", "initrd"} {
+			if err := os.WriteFile(filepath.Join(dir, mac, name), []byte(name), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	mux, _, m := newTestWebserver(t, dir)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	machine := m.GetOrInitMachine(mac)
+	machine.Event(context.Background(), "point_ipxe_to_http_boot", nil)
+
+	w := get("/mac/04:42:1a:03:9b:20/boot.ipxe")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wanted the script, got %d %q", w.Code, w.Body.String())
+	}
+	for _, want := range []string{
+		"kernel http://[fec0::]/mac/04:42:1a:03:9b:20/kernel console=ttyS0 hostname=r1n1\n",
+		"initrd http://[fec0::]/mac/04:42:1a:03:9b:20/initrd\n",
+		"boot\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("Wanted %q in the script, got %q", want, w.Body.String())
+		}
+	}
+
+	get("/mac/04:42:1a:03:9b:20/kernel")
+	if state := machine.State(); state != "http_fetch_kernel" {
+		t.Fatalf("Wanted http_fetch_kernel, got %s", state)
+	}
+
+	get("/mac/04:42:1a:03:9b:20/initrd")
+	if state := machine.State(); state != "http_fetch_initrd" {
+		t.Fatalf("Wanted http_fetch_initrd, got %s", state)
+	}
+
+	// Machines in uki mode don't get a script unless there's a template
+	w = get("/mac/04:42:1a:03:9b:21/boot.ipxe")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Wanted no script for a uki machine, got %d %q", w.Code, w.Body.String())
+	}
+}
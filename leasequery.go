@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// Leasequery (RFC 5007) and bulk leasequery (RFC 5460).
+//
+// We don't keep leases, but every address we hand out is derived from the
+// client's MAC, so any machine in `Machines` has exactly one binding: the
+// allocator's address for its MAC.
+
+// Query types from RFC 5007 section 4.1.2.1 and RFC 5460 section 5.1. We
+// don't keep the relay options clients came through, so QUERY_BY_RELAY_ID (3)
+// and QUERY_BY_REMOTE_ID (5) are answered as unknown query types.
+const (
+	lqQueryByAddress     = 1
+	lqQueryByClientID    = 2
+	lqQueryByLinkAddress = 4
+)
+
+// Sub-options of the OPTION_VENDOR_OPTS we add to each OPTION_CLIENT_DATA.
+const (
+	vendorOptionState    dhcpv6.OptionCode = 1
+	vendorOptionLastSeen dhcpv6.OptionCode = 2
+)
+
+// Bulk leasequery connections are dropped after this long without a query.
+// This is BULK_LQ_DATA_TIMEOUT from RFC 5460 section 6.
+const bulkLeaseQueryIdleTimeout = 300 * time.Second
+
+type lqQuery struct {
+	QueryType   uint8
+	LinkAddress net.IP
+	Options     dhcpv6.MessageOptions
+}
+
+func parseLQQuery(msg *dhcpv6.Message) (*lqQuery, error) {
+	opt := msg.GetOneOption(dhcpv6.OptionLQQuery)
+	if opt == nil {
+		return nil, fmt.Errorf("no OPTION_LQ_QUERY in %s", msg.Type())
+	}
+
+	data := opt.ToBytes()
+	if len(data) < 1+net.IPv6len {
+		return nil, fmt.Errorf("OPTION_LQ_QUERY is too short (%d bytes)", len(data))
+	}
+
+	query := &lqQuery{
+		QueryType:   data[0],
+		LinkAddress: net.IP(append([]byte(nil), data[1:1+net.IPv6len]...)),
+	}
+
+	if err := query.Options.FromBytes(data[1+net.IPv6len:]); err != nil {
+		return nil, fmt.Errorf("parsing the OPTION_LQ_QUERY query-options: %w", err)
+	}
+
+	return query, nil
+}
+
+func newLeaseQueryReply(msg *dhcpv6.Message) (*dhcpv6.Message, error) {
+	cid := msg.GetOneOption(dhcpv6.OptionClientID)
+	if cid == nil {
+		return nil, errors.New("client ID cannot be nil when building LEASEQUERY-REPLY")
+	}
+
+	resp := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeLeaseQueryReply,
+		TransactionID: msg.TransactionID,
+	}
+	resp.AddOption(cid)
+
+	return resp, nil
+}
+
+func peerIP(peer net.Addr) net.IP {
+	switch addr := peer.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+// leaseQueryAllowedFrom reports whether peer may query. Leasequeries give
+// away every machine's DUID and state, so nobody may without an allow-list.
+func (s *DHCPv6Handler) leaseQueryAllowedFrom(peer net.Addr) bool {
+	ip := peerIP(peer)
+	for _, network := range s.leaseQueryAllowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// leaseQueryBindings finds the machines matching a query. A non-nil status
+// means the query failed and should be answered with that status alone.
+func (s *DHCPv6Handler) leaseQueryBindings(peer net.Addr, msg *dhcpv6.Message, bulk bool) ([]*Machine, *dhcpv6.OptStatusCode) {
+	if !s.leaseQueryAllowedFrom(peer) {
+		return nil, &dhcpv6.OptStatusCode{
+			StatusCode:    iana.StatusNotAllowed,
+			StatusMessage: "leasequery is not allowed from this address",
+		}
+	}
+
+	query, err := parseLQQuery(msg)
+	if err != nil {
+		return nil, &dhcpv6.OptStatusCode{
+			StatusCode:    iana.StatusMalformedQuery,
+			StatusMessage: err.Error(),
+		}
+	}
+
+	if !query.LinkAddress.IsUnspecified() && !s.allocator.Contains(query.LinkAddress) {
+		return nil, &dhcpv6.OptStatusCode{
+			StatusCode:    iana.StatusNotConfigured,
+			StatusMessage: fmt.Sprintf("link-address %s is not configured here", query.LinkAddress),
+		}
+	}
+
+	switch query.QueryType {
+	case lqQueryByAddress:
+		opt, ok := query.Options.GetOne(dhcpv6.OptionIAAddr).(*dhcpv6.OptIAAddress)
+		if !ok {
+			return nil, &dhcpv6.OptStatusCode{
+				StatusCode:    iana.StatusMalformedQuery,
+				StatusMessage: "QUERY_BY_ADDRESS without an OPTION_IAADDR",
+			}
+		}
+
+		mac, err := s.allocator.MACFor(opt.IPv6Addr)
+		if err != nil {
+			return nil, nil
+		}
+
+		if machine := machines.GetMachine(mac); machine != nil {
+			return []*Machine{machine}, nil
+		}
+		return nil, nil
+	case lqQueryByClientID:
+		duid := query.Options.ClientID()
+		if duid == nil {
+			return nil, &dhcpv6.OptStatusCode{
+				StatusCode:    iana.StatusMalformedQuery,
+				StatusMessage: "QUERY_BY_CLIENTID without an OPTION_CLIENTID",
+			}
+		}
+
+		for _, machine := range machines.All() {
+			if cid := machine.ClientID(); cid != nil && cid.Equal(duid) {
+				return []*Machine{machine}, nil
+			}
+		}
+
+		// Clients which never told us their DUID can still be found by the
+		// MAC inside a link-layer DUID.
+		var mac net.HardwareAddr
+		switch d := duid.(type) {
+		case *dhcpv6.DUIDLL:
+			mac = d.LinkLayerAddr
+		case *dhcpv6.DUIDLLT:
+			mac = d.LinkLayerAddr
+		}
+		if mac != nil {
+			if machine := machines.GetMachine(mac); machine != nil {
+				return []*Machine{machine}, nil
+			}
+		}
+		return nil, nil
+	case lqQueryByLinkAddress:
+		if bulk {
+			// We only serve the one link, so every machine is on it.
+			return machines.All(), nil
+		}
+	}
+
+	return nil, &dhcpv6.OptStatusCode{
+		StatusCode:    iana.StatusUnknownQueryType,
+		StatusMessage: fmt.Sprintf("unsupported query type %d", query.QueryType),
+	}
+}
+
+// clientData builds the OPTION_CLIENT_DATA describing a machine's binding.
+func (s *DHCPv6Handler) clientData(machine *Machine) dhcpv6.Option {
+	mac := net.HardwareAddr(machine.Mac)
+
+	duid := machine.ClientID()
+	if duid == nil {
+		duid = &dhcpv6.DUIDLL{
+			HWType:        iana.HWTypeEthernet,
+			LinkLayerAddr: mac,
+		}
+	}
+
+	lastSeen := machine.LastSeen()
+	var clt uint32
+	if !lastSeen.IsZero() {
+		clt = uint32(time.Since(lastSeen).Seconds())
+	}
+
+	var opts dhcpv6.Options
+	opts.Add(dhcpv6.OptClientID(duid))
+	opts.Add(&dhcpv6.OptIAAddress{
+		IPv6Addr:          s.allocator.AddressFor(mac),
+		PreferredLifetime: leaseLifetime,
+		ValidLifetime:     leaseLifetime,
+	})
+	opts.Add(&dhcpv6.OptionGeneric{
+		OptionCode: dhcpv6.OptionCLTTime,
+		OptionData: binary.BigEndian.AppendUint32(nil, clt),
+	})
+
+	vendor := &dhcpv6.OptVendorOpts{EnterpriseNumber: uint32(*vendorEnterpriseNumber)}
+	vendor.VendorOpts.Add(&dhcpv6.OptionGeneric{
+		OptionCode: vendorOptionState,
+		OptionData: []byte(machine.State()),
+	})
+	if !lastSeen.IsZero() {
+		vendor.VendorOpts.Add(&dhcpv6.OptionGeneric{
+			OptionCode: vendorOptionLastSeen,
+			OptionData: []byte(lastSeen.UTC().Format(time.RFC3339)),
+		})
+	}
+	opts.Add(vendor)
+
+	return &dhcpv6.OptionGeneric{
+		OptionCode: dhcpv6.OptionClientData,
+		OptionData: opts.ToBytes(),
+	}
+}
+
+// answerLeaseQuery fills in a LEASEQUERY-REPLY for a query received over UDP.
+func (s *DHCPv6Handler) answerLeaseQuery(peer net.Addr, msg *dhcpv6.Message, resp dhcpv6.DHCPv6) {
+	bindings, status := s.leaseQueryBindings(peer, msg, false)
+	if status != nil {
+		log.Printf("Refusing leasequery from %s: %s", peer, status.StatusMessage)
+		resp.AddOption(status)
+		return
+	}
+
+	if len(bindings) > 0 {
+		resp.AddOption(s.clientData(bindings[0]))
+	}
+
+	resp.AddOption(&dhcpv6.OptStatusCode{
+		StatusCode:    iana.StatusSuccess,
+		StatusMessage: "success",
+	})
+}
+
+// serveBulkLeaseQuery accepts bulk leasequery connections over TCP.
+func (s *DHCPv6Handler) serveBulkLeaseQuery(listenAddr string) error {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("listening for bulk leasequery on %s: %w", listenAddr, err)
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accepting a bulk leasequery connection: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := s.handleBulkLeaseQueryConn(conn); err != nil {
+				log.Printf("bulk leasequery connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *DHCPv6Handler) handleBulkLeaseQueryConn(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(bulkLeaseQueryIdleTimeout)); err != nil {
+			return err
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+
+		msg, err := dhcpv6.MessageFromBytes(buf)
+		if err != nil {
+			return fmt.Errorf("parsing a bulk leasequery message: %w", err)
+		}
+
+		if msg.Type() != dhcpv6.MessageTypeLeaseQuery {
+			return fmt.Errorf("unexpected %s on a bulk leasequery connection", msg.Type())
+		}
+
+		if err := s.checkClientID(msg); err != nil {
+			return err
+		}
+
+		for _, resp := range s.bulkLeaseQueryResponses(conn.RemoteAddr(), msg) {
+			if err := writeBulkLeaseQueryMessage(w, resp); err != nil {
+				return err
+			}
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// bulkLeaseQueryResponses answers a query with a LEASEQUERY-REPLY carrying
+// the first binding. Any further bindings follow in LEASEQUERY-DATA messages,
+// terminated by a LEASEQUERY-DONE.
+func (s *DHCPv6Handler) bulkLeaseQueryResponses(peer net.Addr, msg *dhcpv6.Message) []*dhcpv6.Message {
+	reply, err := newLeaseQueryReply(msg)
+	if err != nil {
+		// checkClientID has already made sure this can't happen
+		log.Printf("building a bulk LEASEQUERY-REPLY: %v", err)
+		return nil
+	}
+	reply.AddOption(dhcpv6.OptServerID(s.serverDuid))
+
+	bindings, status := s.leaseQueryBindings(peer, msg, true)
+	if status != nil {
+		log.Printf("Refusing bulk leasequery from %s: %s", peer, status.StatusMessage)
+		reply.AddOption(status)
+		return []*dhcpv6.Message{reply}
+	}
+
+	if len(bindings) > 0 {
+		reply.AddOption(s.clientData(bindings[0]))
+	}
+	reply.AddOption(&dhcpv6.OptStatusCode{
+		StatusCode:    iana.StatusSuccess,
+		StatusMessage: "success",
+	})
+
+	out := []*dhcpv6.Message{reply}
+	if len(bindings) <= 1 {
+		return out
+	}
+
+	for _, machine := range bindings[1:] {
+		data := &dhcpv6.Message{
+			MessageType:   dhcpv6.MessageTypeLeaseQueryData,
+			TransactionID: msg.TransactionID,
+		}
+		data.AddOption(s.clientData(machine))
+		out = append(out, data)
+	}
+
+	done := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeLeaseQueryDone,
+		TransactionID: msg.TransactionID,
+	}
+	done.AddOption(&dhcpv6.OptStatusCode{
+		StatusCode:    iana.StatusSuccess,
+		StatusMessage: "success",
+	})
+
+	return append(out, done)
+}
+
+func writeBulkLeaseQueryMessage(w io.Writer, msg *dhcpv6.Message) error {
+	b := msg.ToBytes()
+	if len(b) > 0xffff {
+		return fmt.Errorf("%s is too large to frame (%d bytes)", msg.Type(), len(b))
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint16(len(b))); err != nil {
+		return err
+	}
+
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func newTestLeaseQuery(t *testing.T, queryType uint8, queryOptions ...dhcpv6.Option) *dhcpv6.Message {
+	msg, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatalf("NewMessage failure: %v", err)
+	}
+	msg.MessageType = dhcpv6.MessageTypeLeaseQuery
+	msg.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{
+		HWType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+	}))
+
+	data := []byte{queryType}
+	data = append(data, net.IPv6unspecified...)
+	data = append(data, dhcpv6.Options(queryOptions).ToBytes()...)
+	msg.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionLQQuery, OptionData: data})
+
+	return msg
+}
+
+func newTestLeaseQueryHandler() *DHCPv6Handler {
+	machines = NewMachines(NewBroker())
+	_, everyone, _ := net.ParseCIDR("::/0")
+
+	return &DHCPv6Handler{
+		leaseQueryAllowed: []*net.IPNet{everyone},
+		allocator:         NewAllocator(net.ParseIP("fd19:287e:c5a0:4931::")),
+		serverDuid: &dhcpv6.DUIDLL{
+			HWType:        iana.HWTypeEthernet,
+			LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0xff},
+		},
+	}
+}
+
+func TestLeaseQueryByAddress(t *testing.T) {
+	s := newTestLeaseQueryHandler()
+	peer := &net.UDPAddr{IP: net.ParseIP("fe80::1")}
+
+	mac := net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20}
+	machines.GetOrInitMachine(mac)
+
+	query := newTestLeaseQuery(t, lqQueryByAddress, &dhcpv6.OptIAAddress{IPv6Addr: s.allocator.AddressFor(mac)})
+	bindings, status := s.leaseQueryBindings(peer, query, false)
+	if status != nil {
+		t.Fatalf("Unexpected status: %v", status)
+	}
+	if len(bindings) != 1 || bindings[0].Mac.String() != mac.String() {
+		t.Fatalf("Wanted just %s, got %v", mac, bindings)
+	}
+
+	unknown := newTestLeaseQuery(t, lqQueryByAddress, &dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("fd19:287e:c5a0:4931:0:2de:adbe:ef01")})
+	bindings, status = s.leaseQueryBindings(peer, unknown, false)
+	if status != nil || len(bindings) != 0 {
+		t.Fatalf("Wanted no bindings and no status, got %v and %v", bindings, status)
+	}
+}
+
+func TestLeaseQueryByLinkAddressIsBulkOnly(t *testing.T) {
+	s := newTestLeaseQueryHandler()
+	peer := &net.TCPAddr{IP: net.ParseIP("fe80::1")}
+
+	machines.GetOrInitMachine(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20})
+	machines.GetOrInitMachine(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x21})
+	machines.GetOrInitMachine(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x22})
+
+	query := newTestLeaseQuery(t, lqQueryByLinkAddress)
+
+	if _, status := s.leaseQueryBindings(peer, query, false); status == nil || status.StatusCode != iana.StatusUnknownQueryType {
+		t.Fatalf("Wanted UnknownQueryType over UDP, got %v", status)
+	}
+
+	var types []dhcpv6.MessageType
+	for _, resp := range s.bulkLeaseQueryResponses(peer, query) {
+		types = append(types, resp.Type())
+	}
+
+	want := []dhcpv6.MessageType{
+		dhcpv6.MessageTypeLeaseQueryReply,
+		dhcpv6.MessageTypeLeaseQueryData,
+		dhcpv6.MessageTypeLeaseQueryData,
+		dhcpv6.MessageTypeLeaseQueryDone,
+	}
+	if len(types) != len(want) {
+		t.Fatalf("Wanted %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("Wanted %v, got %v", want, types)
+		}
+	}
+}
+
+func TestLeaseQueryNotAllowed(t *testing.T) {
+	s := newTestLeaseQueryHandler()
+	_, allowed, _ := net.ParseCIDR("fd00::/8")
+	s.leaseQueryAllowed = []*net.IPNet{allowed}
+
+	query := newTestLeaseQuery(t, lqQueryByLinkAddress)
+	_, status := s.leaseQueryBindings(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, query, true)
+	if status == nil || status.StatusCode != iana.StatusNotAllowed {
+		t.Fatalf("Wanted NotAllowed, got %v", status)
+	}
+
+	s.leaseQueryAllowed = nil
+	if _, status := s.leaseQueryBindings(&net.TCPAddr{IP: net.ParseIP("fd00::1")}, query, true); status == nil || status.StatusCode != iana.StatusNotAllowed {
+		t.Fatalf("Wanted NotAllowed without an allow-list, got %v", status)
+	}
+}
+
+func TestLeaseQueryByRelayUnsupported(t *testing.T) {
+	s := newTestLeaseQueryHandler()
+	peer := &net.TCPAddr{IP: net.ParseIP("fd19:287e:c5a0:4931::1")}
+
+	// QUERY_BY_RELAY_ID and QUERY_BY_REMOTE_ID
+	for _, queryType := range []uint8{3, 5} {
+		query := newTestLeaseQuery(t, queryType)
+		if _, status := s.leaseQueryBindings(peer, query, true); status == nil || status.StatusCode != iana.StatusUnknownQueryType {
+			t.Fatalf("Wanted query type %d unknown, got %v", queryType, status)
+		}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"log"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/looplab/fsm"
 )
 
@@ -37,6 +39,21 @@ func (m *Machines) GetOrInitMachine(mac net.HardwareAddr) *Machine {
 	return m.machines[key]
 }
 
+// GetOrAdoptMachine is GetOrInitMachine for machines we learned about from an
+// HA peer: a new machine doesn't get an init event of its own, since the
+// peer's timeline already has one.
+func (m *Machines) GetOrAdoptMachine(mac net.HardwareAddr) *Machine {
+	key := MACKey(mac.String())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.machines[key] == nil {
+		m.machines[key] = newMachine(mac, m.broker)
+	}
+
+	return m.machines[key]
+}
+
 // Lookup the machine stats
 func (m *Machines) GetMachine(mac net.HardwareAddr) *Machine {
 	key := MACKey(mac.String())
@@ -46,6 +63,22 @@ func (m *Machines) GetMachine(mac net.HardwareAddr) *Machine {
 	return m.machines[key]
 }
 
+// All returns a snapshot of every known machine, ordered by MAC address.
+func (m *Machines) All() []*Machine {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]*Machine, 0, len(m.machines))
+	for _, machine := range m.machines {
+		out = append(out, machine)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Mac.String() < out[j].Mac.String()
+	})
+
+	return out
+}
+
 func (m *Machines) MarshalJSON() ([]byte, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -59,6 +92,13 @@ type Machine struct {
 	fsm         *fsm.FSM
 	Events      *Ring[Event]
 	broker      *Broker
+	lastSeen    time.Time
+	clientID    dhcpv6.DUID
+
+	bootAttempts int
+
+	// SHA-256s of the files the machine last fetched completely, by name
+	images map[string]string
 }
 
 type MAC net.HardwareAddr
@@ -68,6 +108,10 @@ type IdentifiedEvent struct {
 	Mac         MAC    `json:"mac"`
 	IPv6Address net.IP `json:"ipv6_address"`
 	Event       Event  `json:"event"`
+
+	// Origin is the name of the HA peer the event happened on, or empty if
+	// it happened here.
+	Origin string `json:"origin,omitempty"`
 }
 
 type Event struct {
@@ -88,6 +132,26 @@ func (m MAC) MarshalJSON() ([]byte, error) {
 	return json.Marshal(net.HardwareAddr(m).String())
 }
 
+func (m *MAC) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	if s == "" {
+		*m = nil
+		return nil
+	}
+
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return err
+	}
+
+	*m = MAC(mac)
+	return nil
+}
+
 func (m MAC) String() string {
 	return net.HardwareAddr(m).String()
 }
@@ -108,7 +172,59 @@ func NewEvent(event string, repeat bool, detail interface{}) Event {
 	return ev
 }
 
+// machineTransitions are the FSM's events. Every event is named after the
+// state it moves the machine into.
+var machineTransitions = fsm.Events{
+	{Name: "firmware_init", Src: []string{"reset"}, Dst: "firmware_init"},
+
+	{Name: "http_boot", Src: []string{"firmware_init", "reset"}, Dst: "http_boot"},
+
+	{Name: "point_pxe_to_ipxe_over_tftp", Src: []string{"firmware_init", "reset"}, Dst: "point_pxe_to_ipxe_over_tftp"},
+	{Name: "serve_ipxe_over_tftp", Src: []string{"point_pxe_to_ipxe_over_tftp"}, Dst: "serve_ipxe_over_tftp"},
+	{Name: "point_ipxe_to_http_boot", Src: []string{"serve_ipxe_over_tftp"}, Dst: "point_ipxe_to_http_boot"},
+
+	{Name: "http_fetch_uki", Src: []string{"http_boot", "point_ipxe_to_http_boot"}, Dst: "http_fetch_uki"},
+
+	{Name: "http_fetch_kernel", Src: []string{"http_boot", "point_ipxe_to_http_boot"}, Dst: "http_fetch_kernel"},
+	{Name: "http_fetch_initrd", Src: []string{"http_fetch_kernel"}, Dst: "http_fetch_initrd"},
+
+	{Name: "os_init", Src: []string{"http_fetch_uki", "http_fetch_kernel", "http_fetch_initrd"}, Dst: "os_init"},
+}
+
+// Events which mean the machine has started another attempt at booting.
+var bootAttemptEvents = map[string]bool{
+	"http_boot":                   true,
+	"point_pxe_to_ipxe_over_tftp": true,
+}
+
+// isMachineState reports whether an event name is also an FSM state, as
+// opposed to bookkeeping events like init and jump_to.
+func isMachineState(event string) bool {
+	for _, t := range machineTransitions {
+		if t.Dst == event {
+			return true
+		}
+	}
+
+	return false
+}
+
 func NewMachine(mac net.HardwareAddr, broker *Broker) *Machine {
+	machine := newMachine(mac, broker)
+
+	init := NewEvent("init", false, nil)
+	machine.Events.Push(init)
+	broker.Publish(IdentifiedEvent{
+		Mac:   MAC(mac),
+		Event: init,
+	})
+
+	return machine
+}
+
+// newMachine sets up a machine without recording or announcing its init
+// event.
+func newMachine(mac net.HardwareAddr, broker *Broker) *Machine {
 	machine := Machine{
 		Mac:    MAC(mac),
 		broker: broker,
@@ -117,19 +233,7 @@ func NewMachine(mac net.HardwareAddr, broker *Broker) *Machine {
 
 	machine.fsm = fsm.NewFSM(
 		"reset",
-		fsm.Events{
-			{Name: "firmware_init", Src: []string{"reset"}, Dst: "firmware_init"},
-
-			{Name: "http_boot", Src: []string{"firmware_init", "reset"}, Dst: "http_boot"},
-
-			{Name: "point_pxe_to_ipxe_over_tftp", Src: []string{"firmware_init", "reset"}, Dst: "point_pxe_to_ipxe_over_tftp"},
-			{Name: "serve_ipxe_over_tftp", Src: []string{"point_pxe_to_ipxe_over_tftp"}, Dst: "serve_ipxe_over_tftp"},
-			{Name: "point_ipxe_to_http_boot", Src: []string{"serve_ipxe_over_tftp"}, Dst: "point_ipxe_to_http_boot"},
-
-			{Name: "http_fetch_uki", Src: []string{"http_boot", "point_ipxe_to_http_boot"}, Dst: "http_fetch_uki"},
-
-			{Name: "os_init", Src: []string{"http_fetch_uki"}, Dst: "os_init"},
-		},
+		machineTransitions,
 		fsm.Callbacks{
 			"enter_state": func(_ context.Context, e *fsm.Event) {
 				var arg interface{}
@@ -146,13 +250,6 @@ func NewMachine(mac net.HardwareAddr, broker *Broker) *Machine {
 		},
 	)
 
-	init := NewEvent("init", false, nil)
-	machine.Events.Push(init)
-	broker.Publish(IdentifiedEvent{
-		Mac:   MAC(mac),
-		Event: init,
-	})
-
 	return &machine
 }
 
@@ -162,6 +259,46 @@ func (m *Machine) SetIPv6Address(ip net.IP) {
 	m.IPv6Address = ip
 }
 
+// Seen records that the machine just sent us a DHCPv6 message with the given
+// client identifier.
+func (m *Machine) Seen(clientID dhcpv6.DUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSeen = time.Now()
+	if clientID != nil {
+		m.clientID = clientID
+	}
+}
+
+// LastSeen is the last time the machine sent us a DHCPv6 message, or the zero
+// time if it never has.
+func (m *Machine) LastSeen() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastSeen
+}
+
+// ClientID is the DUID the machine last identified itself with, if any.
+func (m *Machine) ClientID() dhcpv6.DUID {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.clientID
+}
+
+// State is the machine's current FSM state.
+func (m *Machine) State() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.fsm.Current()
+}
+
+// BootAttempts counts how many times the machine has started booting.
+func (m *Machine) BootAttempts() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.bootAttempts
+}
+
 func (m *Machine) Can(event string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -179,6 +316,9 @@ func (m *Machine) Event(ctx context.Context, event string, detail interface{}) e
 	defer m.mu.Unlock()
 
 	repeat := m.fsm.Is(event)
+	if !repeat && bootAttemptEvents[event] {
+		m.bootAttempts++
+	}
 
 	identifiedEvent := IdentifiedEvent{
 		Mac:         m.Mac,
@@ -202,6 +342,58 @@ func (m *Machine) Event(ctx context.Context, event string, detail interface{}) e
 	}
 }
 
+// Notify records an event which doesn't move the machine's FSM, like a
+// refused request.
+func (m *Machine) Notify(event string, detail interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ev := NewEvent(event, false, detail)
+	m.Events.Push(ev)
+
+	m.broker.Publish(IdentifiedEvent{
+		Mac:         m.Mac,
+		IPv6Address: m.IPv6Address,
+		Event:       ev,
+	})
+}
+
+// RecordImage remembers the SHA-256 of a file the machine fetched.
+func (m *Machine) RecordImage(name, sha256 string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.images == nil {
+		m.images = make(map[string]string)
+	}
+	m.images[name] = sha256
+}
+
+// Images returns the SHA-256s of the files the machine last fetched, by name.
+func (m *Machine) Images() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	images := make(map[string]string, len(m.images))
+	for name, sum := range m.images {
+		images[name] = sum
+	}
+	return images
+}
+
+// Progress publishes an update to an earlier non-FSM event, like bytes sent
+// in a transfer, without recording it in the timeline.
+func (m *Machine) Progress(event string, detail interface{}) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	m.broker.Publish(IdentifiedEvent{
+		Mac:         m.Mac,
+		IPv6Address: m.IPv6Address,
+		Event:       NewEvent(event, true, detail),
+	})
+}
+
 func (m *Machine) resetToWithoutLocking(event string, detail interface{}) {
 	jump := NewEvent("jump_to", false, nil)
 	m.Events.Push(jump)
@@ -223,3 +415,87 @@ func (m *Machine) resetToWithoutLocking(event string, detail interface{}) {
 		Event:       ev,
 	})
 }
+
+// hasEventWithoutLocking reports whether an identical event is already in the
+// machine's timeline.
+func (m *Machine) hasEventWithoutLocking(ev Event) bool {
+	for _, existing := range m.Events.Slice() {
+		if existing.Event == ev.Event && existing.Timestamp == ev.Timestamp && existing.Repeated == ev.Repeated {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ApplyPeerEvent records an event which happened on an HA peer, and
+// republishes it locally.
+func (m *Machine) ApplyPeerEvent(ev IdentifiedEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ev.IPv6Address != nil {
+		m.IPv6Address = ev.IPv6Address
+	}
+
+	// Repeated events aren't kept in the timeline, see Event.
+	if !ev.Event.Repeated {
+		if m.hasEventWithoutLocking(ev.Event) {
+			return
+		}
+
+		m.Events.Push(ev.Event)
+		if isMachineState(ev.Event.Event) {
+			m.fsm.SetState(ev.Event.Event)
+		}
+	}
+
+	m.broker.Publish(ev)
+}
+
+// MergePeerEvents folds a peer's copy of the machine's timeline into ours,
+// ordered by timestamp, and moves the FSM to the newest state.
+func (m *Machine) MergePeerEvents(ipv6Address net.IP, events []Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.IPv6Address == nil && ipv6Address != nil {
+		m.IPv6Address = ipv6Address
+	}
+
+	merged := m.Events.Slice()
+	for _, ev := range events {
+		if !m.hasEventWithoutLocking(ev) {
+			merged = append(merged, ev)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, errA := time.Parse(time.RFC3339Nano, merged[i].Timestamp)
+		b, errB := time.Parse(time.RFC3339Nano, merged[j].Timestamp)
+		if errA != nil || errB != nil {
+			return false
+		}
+		return a.Before(b)
+	})
+
+	ring := NewRing[Event](m.Events.Cap())
+	for _, ev := range merged {
+		ring.Push(ev)
+	}
+	m.Events = ring
+
+	for i := ring.Len() - 1; i >= 0; i-- {
+		if ev := ring.At(i); isMachineState(ev.Event) {
+			m.fsm.SetState(ev.Event)
+			break
+		}
+	}
+}
+
+// Snapshot returns a copy of the machine's address and timeline.
+func (m *Machine) Snapshot() (net.IP, []Event) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.IPv6Address, m.Events.Slice()
+}
@@ -14,7 +14,6 @@ import (
 	"runtime"
 	"slices"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv6"
@@ -23,30 +22,94 @@ import (
 
 	"github.com/matthewpi/certwatcher"
 	"github.com/mdlayher/netx/eui64"
-	"github.com/pin/tftp/v3"
 )
 
 // DHCPv6Handler offers DHCPv6 addresses based on the requester's MAC address.
 type DHCPv6Handler struct {
-	baseAddress net.IP
-	serverDuid  dhcpv6.DUIDLL
+	allocator         *Allocator
+	serverDuid        dhcpv6.DUID
+	preference        int
+	leaseQueryAllowed []*net.IPNet
 }
 
 var (
-	baseAddress         = flag.String("base-address", "fec0::", "IPv6 base address to distribute MAC-based IPs through, we assume its a /80")
-	networkInterface    = flag.String("interface", "eth0", "Interface to listen on")
-	tftpListenAddr      = flag.String("tftp-listen-addr", ":69", "Address/port to listen for TFTP on. Note: if not all addresses, you must listen on a `base-address`-member address.")
-	httpListenAddr      = flag.String("http-listen-addr", ":80", "Address/port to listen for HTTP on. Note: if not all addresses, you must listen on a `base-address`-member address.")
-	httpsListenAddr     = flag.String("https-listen-addr", ":443", "Address/port to listen for HTTPS on. Note: if not all addresses, you must listen on a `base-address`-member address.")
-	dhcpv6ListenPort    = flag.Int("dhcpv6-listen-port", dhcpv6.DefaultServerPort, "Port to listen for DHCPv6 requests (only useful for testing.)")
-	httpBootURLTemplate = flag.String("http-boot-url-template", "", "URL template for HTTP boot requests, like http://netboot.target/?mac={{.MAC}}")
-	tlsCertFile         = flag.String("tls-cert-file", "", "Path to TLS Certificate File")
-	tlsKeyFile          = flag.String("tls-key-file", "", "Path to TLS Key File")
-	netbootDir          = flag.String("netboot-dir", "", "Path to MACs to serve for netboot")
-	ipxeX8664EfiPath    = flag.String("ipxe-x86-64-efi", "", "Path to the iPXE EFI binary for x86_64 to serve over TFTP")
+	baseAddress          = flag.String("base-address", "fec0::", "IPv6 base address to distribute MAC-based IPs through, we assume its a /80")
+	networkInterface     = flag.String("interface", "eth0", "Interface to listen on")
+	tftpListenAddr       = flag.String("tftp-listen-addr", ":69", "Address/port to listen for TFTP on. Note: if not all addresses, you must listen on a `base-address`-member address.")
+	httpListenAddr       = flag.String("http-listen-addr", ":80", "Address/port to listen for HTTP on. Note: if not all addresses, you must listen on a `base-address`-member address.")
+	httpsListenAddr      = flag.String("https-listen-addr", ":443", "Address/port to listen for HTTPS on. Note: if not all addresses, you must listen on a `base-address`-member address.")
+	dhcpv6ListenPort     = flag.Int("dhcpv6-listen-port", dhcpv6.DefaultServerPort, "Port to listen for DHCPv6 requests (only useful for testing.)")
+	httpBootURLTemplate  = flag.String("http-boot-url-template", "", "URL template for HTTP boot requests, like http://netboot.target/?mac={{.MAC}}")
+	ipxeScriptFile       = flag.String("ipxe-script-template-file", "", "Path to an iPXE script template, served as boot.ipxe from each MAC's directory. When set, iPXE is chained to the script instead of the boot URL.")
+	defaultBootMode      = flag.String("boot-mode", bootModeUKI, "Boot mode of machines without one in the inventory: uki, or kernel to have iPXE boot the kernel and initrd files")
+	kernelCmdline        = flag.String("kernel-cmdline", "", "Kernel command line template for kernel boot mode machines without one in the inventory, like console=ttyS0 hostname={{.Hostname}}")
+	tlsCertFile          = flag.String("tls-cert-file", "", "Path to TLS Certificate File")
+	tlsKeyFile           = flag.String("tls-key-file", "", "Path to TLS Key File")
+	netbootDir           = flag.String("netboot-dir", "", "Path to MACs to serve for netboot")
+	ipxeX8664EfiPath     = flag.String("ipxe-x86-64-efi", "", "Path to the iPXE EFI binary for x86_64 to serve over TFTP")
+	ipxeUNDIOnlyPath     = flag.String("ipxe-undionly-kpxe", "", "Path to the iPXE undionly.kpxe binary to serve over TFTP to BIOS PXE clients")
+	tftpTimeout          = flag.Duration("tftp-timeout", 5*time.Second, "How long the TFTP server waits for a client to acknowledge a datagram before sending it again")
+	tftpRetries          = flag.Int("tftp-retries", 5, "How many times the TFTP server sends a datagram before giving up on the transfer")
+	tftpMaxBlockSize     = flag.Int("tftp-max-blksize", 0, "Largest TFTP block size to agree to when clients ask for a larger one, above 512. 0 agrees to any.")
+	tftpWindowSize       = flag.Uint("tftp-window-size", 1, "How many TFTP blocks to send before waiting for an acknowledgement. The RFC 7440 windowsize option isn't supported, so this isn't negotiated with clients.")
+	tftpSinglePort       = flag.Bool("tftp-single-port", false, "Serve TFTP transfers from the listening port, rather than a new port per transfer, for firewalls and NAT which only allow port 69")
+	tftpUploadDir        = flag.String("tftp-upload-dir", "", "Path to receive TFTP uploads into, in a directory per MAC. Empty refuses uploads.")
+	tftpUploadMaxSize    = flag.Int64("tftp-upload-max-size", 64<<20, "Largest TFTP upload to accept, in bytes")
+	tftpUploadQuota      = flag.Int64("tftp-upload-quota", 256<<20, "Most bytes of TFTP uploads to keep per MAC")
+	tftpUploadTotalQuota = flag.Int64("tftp-upload-total-quota", 4<<30, "Most bytes of TFTP uploads to keep in -tftp-upload-dir")
+	tftpRoot             = flag.String("tftp-root", "", "Path to serve other TFTP files from, each MAC's own directory in it taking precedence")
+
+	maxTransfers             = flag.Int("max-transfers", 0, "Most boot file transfers over HTTP and TFTP to run at once, queueing the rest. 0 is no limit.")
+	maxTransfersPerClient    = flag.Int("max-transfers-per-client", 0, "Most boot file transfers to run at once for each client, queueing the rest. 0 is no limit.")
+	maxTransferRate          = flag.Int64("max-transfer-rate", 0, "Most bytes per second to send boot files at, altogether. 0 is no limit.")
+	maxTransferRatePerClient = flag.Int64("max-transfer-rate-per-client", 0, "Most bytes per second to send boot files to each client at. 0 is no limit.")
+	transferQueueTimeout     = flag.Duration("transfer-queue-timeout", time.Minute, "How long a transfer waits in the queue for -max-transfers before it's refused")
+
+	bulkLeaseQueryListenAddr = flag.String("bulk-leasequery-listen-addr", "", "Address/port to listen for bulk leasequery (RFC 5460) over TCP on, like :547. Empty disables bulk leasequery.")
+	leaseQueryAllowedNets    = flag.String("leasequery-allowed-networks", "", "Comma separated CIDRs allowed to send leasequeries. Empty refuses every leasequery.")
+	vendorEnterpriseNumber   = flag.Uint("vendor-enterprise-number", 32473, "IANA enterprise number used for our vendor options in leasequery replies")
+
+	serverDUID       = flag.String("server-duid", "", "Server DUID as hex, like 00:03:00:01:02:de:ad:be:ef:01. Defaults to a DUID-LL of the interface.")
+	serverDUIDFile   = flag.String("server-duid-file", "", "File to persist a generated DUID-LLT in, so the server DUID is stable across restarts and hardware changes")
+	serverPreference = flag.Int("server-preference", 0, "Server Preference (0-255) to send in Advertise messages, used by clients to choose between HA peers")
+	peerName         = flag.String("peer-name", "", "Name of this daemon among its HA peers. Defaults to the hostname.")
+	peerListenAddr   = flag.String("peer-listen-addr", "", "Address/port to accept HA peer connections on. Empty disables listening.")
+	peerAddrs        = flag.String("peers", "", "Comma separated address/ports of HA peers to connect to")
+	peerSecretFile   = flag.String("peer-secret-file", "", "Path to the secret shared by all HA peers")
+
+	inventoryFile = flag.String("inventory-file", "", "Path to a JSON inventory of machines and groups")
+
+	imageCatalogDir = flag.String("image-catalog-dir", "", "Path to a catalog of boot images, in directories named like name@version, which machines can be pinned to")
+	imagePinsFile   = flag.String("image-pins-file", "", "File to persist which catalog image each machine is pinned to")
+	rolloutsFile    = flag.String("rollouts-file", "", "File to persist image rollouts in")
+
+	bootIntentsFile   = flag.String("boot-intents-file", "", "File to persist the machines' boot intents in")
+	defaultBootIntent = flag.String("default-boot-intent", intentAlways, "Boot intent of machines without one of their own: always, local or reprovision-once")
+
+	bootPayloadKeyFile = flag.String("boot-payload-key-file", "", "Path to a key to sign the boot template Payload with. Without it, the Payload is unsigned.")
+	bootPayloadTTL     = flag.Duration("boot-payload-ttl", 15*time.Minute, "How long a signed boot payload is valid for")
+	adminTokenFile     = flag.String("admin-token-file", "", "Path to a bearer token for the endpoints which pin images, set boot intents, manage rollouts, serve uploads or report boot.efi info. Without it, they are refused.")
+	bootURLKeyFile     = flag.String("boot-url-key-file", "", "Path to a key to sign boot URLs with. When set, each file in a MAC's tree is only served to unexpired URLs signed for it, from the MAC's own address.")
+	bootURLTTL         = flag.Duration("boot-url-ttl", 5*time.Minute, "How long a signed boot URL is valid for")
+	requireSourceMAC   = flag.Bool("require-source-mac", false, "Refuse HTTP and TFTP requests for a MAC in the path unless they come from that MAC's assigned address")
+	authenticodeCerts  = flag.String("authenticode-trusted-certs", "", "Path to PEM or DER certificates, or a directory of them, which PE files served from -netboot-dir must be signed by or chain to")
+	authenticodePolicy = flag.String("authenticode-policy", authenticodeFlag, "What to do with PE files which fail -authenticode-trusted-certs: flag, to serve them and report the failure, or refuse")
+	requireBootPayload = flag.Bool("require-boot-payload", false, "Refuse to serve boot.efi unless the request carries a signed payload issued to its MAC")
+
+	httpBootURLTemplatesForArch = make(archFlag)
+	ipxeBinaryPaths             = make(archFlag)
+	ipxeSNPOnlyPaths            = make(archFlag)
 )
 
-var httpBootTemplate *template.Template
+func init() {
+	flag.Var(httpBootURLTemplatesForArch, "http-boot-url-template-for-arch", "ARCH=TEMPLATE boot URL template for a client architecture type, like EFI_ARM64_HTTP=http://netboot.target/arm64/?mac={{.MAC}}. May be repeated.")
+	flag.Var(&httpFileEvents, "http-file-event", "PATTERN=EVENT event to report HTTP transfers of files matching a path.Match pattern as, like *.squashfs=http_fetch_rootfs. May be repeated. boot.efi, kernel and initrd default to http_fetch_uki, http_fetch_kernel and http_fetch_initrd, and everything else to http_fetch_file.")
+	flag.Var(ipxeBinaryPaths, "ipxe-binary", "ARCH=PATH iPXE binary to serve over TFTP to PXE clients of an architecture type, like EFI_ARM64=/path/to/ipxe.efi. May be repeated.")
+	flag.Var(ipxeSNPOnlyPaths, "ipxe-snponly-binary", "ARCH=PATH iPXE snponly.efi binary to serve over TFTP to PXE clients of an architecture type, for machines whose NICs need it. May be repeated.")
+}
+
+// How long the addresses we hand out are valid for.
+const leaseLifetime = 1200 * time.Second
 
 var machines *Machines
 
@@ -131,12 +194,25 @@ func (s *DHCPv6Handler) handleMsg(conn net.PacketConn, peer net.Addr,
 			err = fmt.Errorf("DHCPv6 new reply from message error: %s", err)
 			return
 		}
+	case dhcpv6.MessageTypeLeaseQuery:
+		resp, err = newLeaseQueryReply(msg)
+		if err != nil {
+			err = fmt.Errorf("DHCPv6 new leasequery reply from message error: %s", err)
+			return
+		}
 	default:
 		err = fmt.Errorf("unknown DHCPv6 message type")
 		return
 	}
 
-	resp.AddOption(dhcpv6.OptServerID(&s.serverDuid))
+	resp.AddOption(dhcpv6.OptServerID(s.serverDuid))
+
+	if resp.Type() == dhcpv6.MessageTypeAdvertise && s.preference > 0 {
+		resp.AddOption(&dhcpv6.OptionGeneric{
+			OptionCode: dhcpv6.OptionPreference,
+			OptionData: []byte{byte(s.preference)},
+		})
+	}
 
 	err = s.process(peer, msg, req, resp)
 	if err != nil {
@@ -184,7 +260,7 @@ func (s *DHCPv6Handler) checkServerID(msg *dhcpv6.Message) error {
 			return fmt.Errorf("dhcpv6: drop packet: no ServerID option in message %s", msg.Type().String())
 		}
 
-		if !sid.Equal(&s.serverDuid) {
+		if !sid.Equal(s.serverDuid) {
 			return fmt.Errorf("dhcpv6: drop packet: mismatched ServerID option in message %s: %s",
 				msg.Type().String(), sid.String())
 		}
@@ -267,6 +343,11 @@ func wantsiPxeChainToHttp(msg *dhcpv6.Message) bool {
 	return isPxeClient(msg) && isUserIpxe(msg)
 }
 
+// wantsBootFile reports whether we'd send the client a Boot File URL.
+func wantsBootFile(msg *dhcpv6.Message) bool {
+	return wantsHttpBootFile(msg) || wantsiPxeOverTftp(msg) || wantsiPxeChainToHttp(msg)
+}
+
 type archPayload struct {
 	Architectures []string `json:"architectures"`
 }
@@ -314,6 +395,9 @@ func (s *DHCPv6Handler) process(peer net.Addr, msg *dhcpv6.Message,
 			StatusMessage: "success",
 		})
 		return
+	case dhcpv6.MessageTypeLeaseQuery:
+		s.answerLeaseQuery(peer, msg, resp)
+		return
 	default:
 		err = fmt.Errorf("DHCPv6 ignore message type %s", msg.Type())
 		return
@@ -330,10 +414,9 @@ func (s *DHCPv6Handler) process(peer net.Addr, msg *dhcpv6.Message,
 	}
 
 	machine := machines.GetOrInitMachine(mac)
+	machine.Seen(msg.Options.ClientID())
 
-	prefix := make([]byte, 10)
-	copy(prefix, s.baseAddress[:10])
-	leasedIP = append(prefix, mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+	leasedIP = s.allocator.AddressFor(mac)
 
 	machine.SetIPv6Address(leasedIP)
 	log.Printf("Assigning %v to %v", leasedIP, mac)
@@ -357,8 +440,8 @@ func (s *DHCPv6Handler) process(peer net.Addr, msg *dhcpv6.Message,
 
 	oiaAddr := &dhcpv6.OptIAAddress{
 		IPv6Addr:          leasedIP,
-		PreferredLifetime: 1200 * time.Second,
-		ValidLifetime:     1200 * time.Second,
+		PreferredLifetime: leaseLifetime,
+		ValidLifetime:     leaseLifetime,
 	}
 
 	oia.Options = dhcpv6.IdentityOptions{
@@ -378,20 +461,27 @@ func (s *DHCPv6Handler) process(peer net.Addr, msg *dhcpv6.Message,
 		dhcpv6.WithDNS(net.ParseIP("2606:4700:4700::1111"), net.ParseIP("2001:4860:4860::8888"))(resp)
 	}
 
-	if httpBootTemplate != nil {
-		if wantsHttpBootFile(msg) {
+	if httpBootEnabled() {
+		if wantsiPxeChainToHttp(msg) && ipxeScriptTemplateFor(mac) != nil {
+			// The script decides what to boot, including exiting to the
+			// local disk, so iPXE always gets it
+			machine.Event(context.Background(), "point_ipxe_to_http_boot", nil)
+			resp.AddOption(dhcpv6.OptBootFileURL(ipxeScriptURL(s.allocator, mac, machine)))
+		} else if wantsBootFile(msg) && bootIntents.Intent(mac) == intentLocal {
+			// Without a Boot File URL, firmware moves on to its next boot
+			// option, usually the local disk
+			machine.Notify("boot_withheld", BootIntentEvent{Intent: intentLocal})
+		} else if wantsHttpBootFile(msg) && bootTemplateFor(msg.Options.ArchTypes()) == nil {
+			machine.Notify("unsupported_arch", UnsupportedArchEvent{
+				Protocol:      "http",
+				Architectures: archsToStrings(msg.Options.ArchTypes()),
+				Error:         "no http boot template for the client's architectures",
+			})
+		} else if wantsHttpBootFile(msg) {
 			machine.Event(context.Background(), "http_boot", nil)
-			payload, err := archsToEncoded(msg.Options.ArchTypes())
-			if err != nil {
-				log.Printf("failed to construct the arch payload: %s", err)
-			}
 
-			var buf bytes.Buffer
-			if err := httpBootTemplate.Execute(&buf, map[string]string{
-				"MAC":         mac.String(),
-				"BaseAddress": *baseAddress,
-				"Payload":     payload,
-			}); err != nil {
+			bootURL, params, err := s.renderBootURL(mac, machine, msg, req)
+			if err != nil {
 				log.Printf("failed to render the http boot template: %v", err)
 			} else {
 				resp.AddOption(&dhcpv6.OptVendorClass{
@@ -400,27 +490,43 @@ func (s *DHCPv6Handler) process(peer net.Addr, msg *dhcpv6.Message,
 				})
 
 				// ref: https://lenovopress.lenovo.com/lp0736.pdf
-				resp.AddOption(dhcpv6.OptBootFileURL(buf.String()))
+				resp.AddOption(dhcpv6.OptBootFileURL(bootURL))
+				if len(params) > 0 {
+					// ref: RFC 5970 section 3.2
+					resp.AddOption(dhcpv6.OptBootFileParam(params...))
+				}
 			}
 		} else if wantsiPxeOverTftp(msg) {
-			machine.Event(context.Background(), "point_pxe_to_ipxe_over_tftp", nil)
-			resp.AddOption(dhcpv6.OptBootFileURL(fmt.Sprintf("tftp://[%s]/%s/ipxe.efi", *baseAddress, mac.String())))
+			key, ok := ipxeBinaryFor(mac, msg.Options.ArchTypes())
+			if !ok {
+				machine.Notify("unsupported_arch", UnsupportedArchEvent{
+					Protocol:      "tftp",
+					Architectures: archsToStrings(msg.Options.ArchTypes()),
+					Error:         "no iPXE binary for the client's architectures",
+				})
+			} else {
+				machine.Event(context.Background(), "point_pxe_to_ipxe_over_tftp", nil)
+				resp.AddOption(dhcpv6.OptBootFileURL(fmt.Sprintf("tftp://[%s]/%s", *baseAddress, ipxeTftpPath(mac.String(), key))))
+			}
+		} else if wantsiPxeChainToHttp(msg) && bootTemplateFor(msg.Options.ArchTypes()) == nil {
+			machine.Notify("unsupported_arch", UnsupportedArchEvent{
+				Protocol:      "http",
+				Architectures: archsToStrings(msg.Options.ArchTypes()),
+				Error:         "no http boot template for the client's architectures",
+			})
 		} else if wantsiPxeChainToHttp(msg) {
 			machine.Event(context.Background(), "point_ipxe_to_http_boot", nil)
-			payload, err := archsToEncoded(msg.Options.ArchTypes())
-			if err != nil {
-				log.Printf("failed to construct the arch payload: %s", err)
-			}
 
-			var buf bytes.Buffer
-			if err := httpBootTemplate.Execute(&buf, map[string]string{
-				"MAC":         mac.String(),
-				"BaseAddress": *baseAddress,
-				"Payload":     payload,
-			}); err != nil {
+			// iPXE doesn't read option 60, so the parameters are carried
+			// through the chain in the boot URL's query.
+			bootURL, params, err := s.renderBootURL(mac, machine, msg, req)
+			if err != nil {
 				log.Printf("failed to render the http boot template: %v", err)
 			} else {
-				resp.AddOption(dhcpv6.OptBootFileURL(buf.String()))
+				resp.AddOption(dhcpv6.OptBootFileURL(appendQuery(bootURL, "param", params...)))
+				if len(params) > 0 {
+					resp.AddOption(dhcpv6.OptBootFileParam(params...))
+				}
 			}
 		} else {
 			if (msg.Type() == dhcpv6.MessageTypeSolicit || msg.Type() == dhcpv6.MessageTypeRequest) &&
@@ -464,11 +570,41 @@ func main() {
 	var err error
 
 	if *ipxeX8664EfiPath != "" {
-		if err := LoadIPXEBinary(*ipxeX8664EfiPath); err != nil {
+		// EFI BC is what x86-64 firmware has historically called itself
+		for _, arch := range []iana.Arch{iana.EFI_X86_64, iana.EFI_BC} {
+			if _, ok := ipxeBinaryPaths[arch]; !ok {
+				ipxeBinaryPaths[arch] = *ipxeX8664EfiPath
+			}
+		}
+	}
+
+	// Each flavor is configured separately, see ipxeBinaryFor
+	ipxePaths := make(map[ipxeBinaryKey]string)
+	for arch, path := range ipxeBinaryPaths {
+		ipxePaths[ipxeBinaryKey{flavor: ipxeFull, arch: arch}] = path
+	}
+	for arch, path := range ipxeSNPOnlyPaths {
+		ipxePaths[ipxeBinaryKey{flavor: ipxeSNPOnly, arch: arch}] = path
+	}
+	if *ipxeUNDIOnlyPath != "" {
+		ipxePaths[ipxeBinaryKey{flavor: ipxeUNDIOnly, arch: iana.INTEL_X86PC}] = *ipxeUNDIOnlyPath
+	}
+
+	if len(ipxePaths) == 0 {
+		log.Fatalf("The -ipxe-x86-64-efi, -ipxe-binary, -ipxe-snponly-binary or -ipxe-undionly-kpxe flags must be provided to specify the paths to iPXE binaries")
+	}
+
+	for key, path := range ipxePaths {
+		if err := LoadIPXEBinary(key, path); err != nil {
 			log.Fatalf("Failed to load the iPXE binary: %v", err)
 		}
-	} else {
-		log.Fatalf("The -ipxe-x86-64-efi flag must be provided to specify the path to the iPXE EFI binary")
+	}
+
+	if *tftpMaxBlockSize != 0 && (*tftpMaxBlockSize <= tftpDefaultBlockSize || *tftpMaxBlockSize > tftpLargestBlockSize) {
+		log.Fatalf("-tftp-max-blksize must be 0, or above %d and at most %d", tftpDefaultBlockSize, tftpLargestBlockSize)
+	}
+	if *tftpRetries < 1 || *tftpTimeout <= 0 {
+		log.Fatalf("-tftp-retries and -tftp-timeout must be positive")
 	}
 
 	useTls := false
@@ -478,13 +614,117 @@ func main() {
 		useTls = true
 	}
 
+	if *inventoryFile != "" {
+		inventory, err = LoadInventory(*inventoryFile)
+		if err != nil {
+			log.Fatalf("Failed to load the inventory: %v", err)
+		}
+	}
+
+	if *imageCatalogDir != "" {
+		catalog, err = LoadCatalog(*imageCatalogDir, *imagePinsFile)
+		if err != nil {
+			log.Fatalf("Failed to load the image catalog: %v", err)
+		}
+	}
+
+	if *tftpUploadDir != "" {
+		uploads, err = NewUploads(*tftpUploadDir, *tftpUploadMaxSize, *tftpUploadQuota, *tftpUploadTotalQuota)
+		if err != nil {
+			log.Fatalf("Failed to set up TFTP uploads: %v", err)
+		}
+	}
+
+	if *maxTransfers < 0 || *maxTransfersPerClient < 0 || *maxTransferRate < 0 || *maxTransferRatePerClient < 0 {
+		log.Fatalf("Transfer limits can't be negative")
+	}
+	if *maxTransfers > 0 || *maxTransfersPerClient > 0 || *maxTransferRate > 0 || *maxTransferRatePerClient > 0 {
+		transferLimits = NewTransferLimits(*maxTransfers, *maxTransfersPerClient, *maxTransferRate, *maxTransferRatePerClient)
+	}
+
+	if *bootPayloadKeyFile != "" {
+		bootPayloadKey, err = os.ReadFile(*bootPayloadKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read the boot payload key: %v", err)
+		}
+		bootPayloadKey = bytes.TrimSpace(bootPayloadKey)
+		if len(bootPayloadKey) == 0 {
+			log.Fatalf("The boot payload key in %s is empty", *bootPayloadKeyFile)
+		}
+	} else if *requireBootPayload {
+		log.Fatalf("The -boot-payload-key-file flag must be provided with -require-boot-payload")
+	}
+
+	if *adminTokenFile != "" {
+		adminToken, err = os.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatalf("Failed to read the admin token: %v", err)
+		}
+		adminToken = bytes.TrimSpace(adminToken)
+		if len(adminToken) == 0 {
+			log.Fatalf("The admin token in %s is empty", *adminTokenFile)
+		}
+	}
+
+	if *bootURLKeyFile != "" {
+		bootURLKey, err = os.ReadFile(*bootURLKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read the boot URL key: %v", err)
+		}
+		bootURLKey = bytes.TrimSpace(bootURLKey)
+		if len(bootURLKey) == 0 {
+			log.Fatalf("The boot URL key in %s is empty", *bootURLKeyFile)
+		}
+	}
+
 	if *httpBootURLTemplate != "" {
-		httpBootTemplate, err = template.New("httpBootURL").Parse(*httpBootURLTemplate)
+		httpBootTemplate, err = newBootTemplate("httpBootURL", *httpBootURLTemplate)
 		if err != nil {
 			log.Fatalf("failed to parse template: %v", err)
 		}
 	}
 
+	if !validBootMode(*defaultBootMode) {
+		log.Fatalf("Invalid -boot-mode %q, wanted %s or %s", *defaultBootMode, bootModeUKI, bootModeKernel)
+	}
+
+	if *kernelCmdline != "" {
+		kernelCmdlineTemplate, err = newBootTemplate("kernelCmdline", *kernelCmdline)
+		if err != nil {
+			log.Fatalf("Failed to parse the kernel command line template: %v", err)
+		}
+	}
+
+	if *authenticodePolicy != authenticodeFlag && *authenticodePolicy != authenticodeRefuse {
+		log.Fatalf("Invalid -authenticode-policy %q, wanted %s or %s", *authenticodePolicy, authenticodeFlag, authenticodeRefuse)
+	}
+
+	if *authenticodeCerts != "" {
+		authenticodeTrusted, err = LoadAuthenticodeCerts(*authenticodeCerts)
+		if err != nil {
+			log.Fatalf("Failed to load the Authenticode certificates: %v", err)
+		}
+	}
+
+	if *ipxeScriptFile != "" {
+		text, err := os.ReadFile(*ipxeScriptFile)
+		if err != nil {
+			log.Fatalf("Failed to read the iPXE script template: %v", err)
+		}
+
+		ipxeScriptTemplate, err = newIPXEScriptTemplate("ipxeScript", string(text))
+		if err != nil {
+			log.Fatalf("Failed to parse the iPXE script template: %v", err)
+		}
+	}
+
+	for arch, text := range httpBootURLTemplatesForArch {
+		httpBootTemplatesByArch[arch], err = newBootTemplate("httpBootURL "+archName(arch), text)
+		if err != nil {
+			log.Fatalf("failed to parse the template for %s: %v", archName(arch), err)
+		}
+	}
+
 	iface, err := net.InterfaceByName(*networkInterface)
 	if err != nil {
 		log.Fatalf("finding interface %s by name: %s", *networkInterface, err)
@@ -496,21 +736,106 @@ func main() {
 		log.Fatalf("invalid IPv6 base-address: %s", *baseAddress)
 	}
 
+	var leaseQueryAllowed []*net.IPNet
+	for _, cidr := range strings.Split(*leaseQueryAllowedNets, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("invalid -leasequery-allowed-networks entry %q: %v", cidr, err)
+		}
+		leaseQueryAllowed = append(leaseQueryAllowed, network)
+	}
+
+	if *serverPreference < 0 || *serverPreference > 255 {
+		log.Fatalf("invalid -server-preference %d: must be between 0 and 255", *serverPreference)
+	}
+
+	duid, err := loadServerDUID(*serverDUID, *serverDUIDFile, iface.HardwareAddr)
+	if err != nil {
+		log.Fatalf("Failed to set up the server DUID: %v", err)
+	}
+	log.Printf("Server DUID: %s", formatDUID(duid))
+
 	dhcpv6Handler := DHCPv6Handler{
-		baseAddress: parsedBaseIP,
-		serverDuid: dhcpv6.DUIDLL{
-			HWType:        iana.HWTypeEthernet,
-			LinkLayerAddr: iface.HardwareAddr,
-		},
+		allocator:         NewAllocator(parsedBaseIP),
+		serverDuid:        duid,
+		preference:        *serverPreference,
+		leaseQueryAllowed: leaseQueryAllowed,
 	}
 
 	broker := NewBroker()
 	machines = NewMachines(broker)
 
+	bootIntents, err = LoadBootIntents(*bootIntentsFile, *defaultBootIntent)
+	if err != nil {
+		log.Fatalf("Failed to load the boot intents: %v", err)
+	}
+	bootIntents.Watch(broker)
+
+	ipxeWatcher, err := NewIPXEWatcher(ipxePaths, broker)
+	if err != nil {
+		log.Printf("iPXE binaries won't be reloaded when they change: %v", err)
+	} else {
+		go ipxeWatcher.Run()
+	}
+
+	if catalog != nil {
+		rollouts, err = LoadRollouts(*rolloutsFile, broker)
+		if err != nil {
+			log.Fatalf("Failed to load the rollouts: %v", err)
+		}
+		rollouts.Watch()
+		go rollouts.Run(10 * time.Second)
+	}
+
+	if *peerListenAddr != "" || *peerAddrs != "" {
+		if *peerSecretFile == "" {
+			log.Fatalf("The -peer-secret-file flag must be provided to peer with other daemons")
+		}
+
+		secret, err := os.ReadFile(*peerSecretFile)
+		if err != nil {
+			log.Fatalf("Failed to read the peer secret: %v", err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			log.Fatalf("The peer secret in %s is empty", *peerSecretFile)
+		}
+
+		name := *peerName
+		if name == "" {
+			name, err = os.Hostname()
+			if err != nil {
+				log.Fatalf("Failed to get the hostname for -peer-name: %v", err)
+			}
+		}
+
+		peering := NewPeering(name, secret, machines, broker)
+		peering.Forward()
+
+		if *peerListenAddr != "" {
+			go func() {
+				log.Printf("Accepting HA peers on %s", *peerListenAddr)
+				if err := peering.ListenAndServe(*peerListenAddr); err != nil {
+					log.Fatalf("Peer listener failed: %v", err)
+				}
+			}()
+		}
+
+		for _, addr := range strings.Split(*peerAddrs, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				go peering.DialForever(addr)
+			}
+		}
+	}
+
 	go func() {
 		log.Printf("Starting the TFTP server on %s", *tftpListenAddr)
-		tftpServer := tftp.NewServer(tftpReadHandler, nil)
-		tftpServer.SetTimeout(5 * time.Second) // optional
+		tftpServer := newTFTPServer(dhcpv6Handler.allocator, *tftpRoot)
 
 		e := tftpServer.ListenAndServe(*tftpListenAddr) // blocks until s.Shutdown() is called
 		if e != nil {
@@ -518,7 +843,16 @@ func main() {
 		}
 	}()
 
-	mux, err := webserver(*netbootDir, broker, machines)
+	if *bulkLeaseQueryListenAddr != "" {
+		go func() {
+			log.Printf("Bulk leasequery listening via TCP on %s", *bulkLeaseQueryListenAddr)
+			if err := dhcpv6Handler.serveBulkLeaseQuery(*bulkLeaseQueryListenAddr); err != nil {
+				log.Fatalf("Bulk leasequery server failed: %v", err)
+			}
+		}()
+	}
+
+	mux, err := webserver(*netbootDir, broker, machines, dhcpv6Handler.allocator)
 	if err != nil {
 		log.Fatalf("Failed to initialize webserver: %v", err)
 	}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// HA peering: daemons serving the same segment hand out identical addresses,
+// so the only state worth sharing is the machines' event timelines. Peers
+// keep a TCP connection to each other and exchange every IdentifiedEvent that
+// originated locally.
+//
+// Connections are authenticated with a shared secret. Both sides send a
+// random nonce and prove knowledge of the secret over the pair of nonces.
+// Each subsequent line carries an HMAC over a per-direction session key and a
+// sequence number, so frames can't be forged, altered or replayed.
+
+const (
+	peerAuthLabel        = "dhcpv6macd-peer-auth"
+	peerSessionLabel     = "dhcpv6macd-peer-session"
+	peerHandshakeTimeout = 10 * time.Second
+	peerRedialDelay      = 5 * time.Second
+	peerSendQueue        = 1024
+	peerMaxLineBytes     = 16 * 1024 * 1024
+)
+
+type Peering struct {
+	name     string
+	secret   []byte
+	machines *Machines
+	broker   *Broker
+
+	mu    sync.Mutex
+	conns map[*peerConn]struct{}
+}
+
+type peerConn struct {
+	name string
+	conn net.Conn
+	send chan []byte
+}
+
+type peerHello struct {
+	Name  string `json:"name"`
+	Nonce string `json:"nonce"`
+}
+
+type peerProof struct {
+	Proof string `json:"proof"`
+}
+
+type peerFrame struct {
+	Seq  uint64          `json:"seq"`
+	Body json.RawMessage `json:"body"`
+	Tag  string          `json:"tag"`
+}
+
+type peerMessage struct {
+	Event    *IdentifiedEvent  `json:"event,omitempty"`
+	Snapshot []machineSnapshot `json:"snapshot,omitempty"`
+}
+
+type machineSnapshot struct {
+	Mac         MAC     `json:"mac"`
+	IPv6Address net.IP  `json:"ipv6_address"`
+	Events      []Event `json:"events"`
+}
+
+func NewPeering(name string, secret []byte, m *Machines, b *Broker) *Peering {
+	return &Peering{
+		name:     name,
+		secret:   secret,
+		machines: m,
+		broker:   b,
+		conns:    make(map[*peerConn]struct{}),
+	}
+}
+
+// Forward has locally originated events forwarded to every connected peer.
+func (p *Peering) Forward() {
+	p.broker.Observe(p.forward)
+}
+
+func (p *Peering) forward(ev IdentifiedEvent) {
+	if ev.Origin != "" || ev.Mac == nil {
+		// Peer events were already shared by their origin, and events
+		// without a MAC are just log lines.
+		return
+	}
+
+	ev.Origin = p.name
+	p.broadcast(peerMessage{Event: &ev})
+}
+
+// ListenAndServe accepts connections from peers on addr.
+func (p *Peering) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for peers on %s: %w", addr, err)
+	}
+
+	return p.Serve(ln)
+}
+
+// Serve accepts connections from peers on ln.
+func (p *Peering) Serve(ln net.Listener) error {
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accepting a peer connection: %w", err)
+		}
+
+		go func() {
+			if err := p.handle(conn); err != nil {
+				log.Printf("Peer connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// DialForever keeps a connection to the peer at addr open, reconnecting
+// whenever it drops. It blocks forever.
+func (p *Peering) DialForever(addr string) {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, peerHandshakeTimeout)
+		if err != nil {
+			log.Printf("Connecting to peer %s: %v", addr, err)
+		} else if err := p.handle(conn); err != nil {
+			log.Printf("Peer connection to %s: %v", addr, err)
+		}
+
+		time.Sleep(peerRedialDelay)
+	}
+}
+
+func (p *Peering) handle(conn net.Conn) error {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	remoteName, sendKey, recvKey, err := p.handshake(conn, r, w)
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	log.Printf("Peered with %s (%s)", remoteName, conn.RemoteAddr())
+	p.broker.PublishFyi(fmt.Sprintf("peered with %s", remoteName))
+
+	pc := &peerConn{
+		name: remoteName,
+		conn: conn,
+		send: make(chan []byte, peerSendQueue),
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		var seq uint64
+		for body := range pc.send {
+			if err := writePeerLine(w, peerFrame{
+				Seq:  seq,
+				Body: body,
+				Tag:  peerTag(sendKey, seq, body),
+			}); err != nil {
+				writeErr <- err
+				conn.Close()
+				return
+			}
+			seq++
+		}
+	}()
+
+	p.mu.Lock()
+	p.conns[pc] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, pc)
+		p.mu.Unlock()
+		close(pc.send)
+	}()
+
+	// Send our full picture, so the peer catches up on anything it missed
+	// while we were apart. Events racing with it are deduplicated.
+	body, err := json.Marshal(peerMessage{Snapshot: p.snapshot()})
+	if err != nil {
+		return fmt.Errorf("marshalling a snapshot: %w", err)
+	}
+	pc.send <- body
+
+	var seq uint64
+	for {
+		var frame peerFrame
+		if err := readPeerLine(r, &frame); err != nil {
+			select {
+			case err := <-writeErr:
+				return fmt.Errorf("writing to %s: %w", remoteName, err)
+			default:
+				return fmt.Errorf("reading from %s: %w", remoteName, err)
+			}
+		}
+
+		if frame.Seq != seq || !hmac.Equal([]byte(frame.Tag), []byte(peerTag(recvKey, frame.Seq, frame.Body))) {
+			return fmt.Errorf("frame %d from %s failed authentication", frame.Seq, remoteName)
+		}
+		seq++
+
+		var msg peerMessage
+		if err := json.Unmarshal(frame.Body, &msg); err != nil {
+			return fmt.Errorf("decoding a message from %s: %w", remoteName, err)
+		}
+
+		p.apply(remoteName, msg)
+	}
+}
+
+func (p *Peering) handshake(conn net.Conn, r *bufio.Reader, w *bufio.Writer) (remoteName string, sendKey, recvKey []byte, err error) {
+	if err = conn.SetDeadline(time.Now().Add(peerHandshakeTimeout)); err != nil {
+		return
+	}
+
+	nonce := make([]byte, 32)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	if err = writePeerLine(w, peerHello{Name: p.name, Nonce: hex.EncodeToString(nonce)}); err != nil {
+		return
+	}
+
+	var hello peerHello
+	if err = readPeerLine(r, &hello); err != nil {
+		return
+	}
+
+	remoteNonce, err := hex.DecodeString(hello.Nonce)
+	if err != nil || len(remoteNonce) != len(nonce) {
+		err = errors.New("peer sent a malformed nonce")
+		return
+	}
+
+	if hello.Name == p.name {
+		err = fmt.Errorf("peer has our own name (%s), is it us?", p.name)
+		return
+	}
+
+	if err = writePeerLine(w, peerProof{Proof: p.authCode(peerAuthLabel, remoteNonce, nonce, []byte(p.name))}); err != nil {
+		return
+	}
+
+	var proof peerProof
+	if err = readPeerLine(r, &proof); err != nil {
+		return
+	}
+
+	want := p.authCode(peerAuthLabel, nonce, remoteNonce, []byte(hello.Name))
+	if !hmac.Equal([]byte(proof.Proof), []byte(want)) {
+		err = fmt.Errorf("peer %s does not know the shared secret", hello.Name)
+		return
+	}
+
+	sendKey, _ = hex.DecodeString(p.authCode(peerSessionLabel, nonce, remoteNonce))
+	recvKey, _ = hex.DecodeString(p.authCode(peerSessionLabel, remoteNonce, nonce))
+	remoteName = hello.Name
+
+	err = conn.SetDeadline(time.Time{})
+	return
+}
+
+func (p *Peering) authCode(label string, parts ...[]byte) string {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write([]byte(label))
+	for _, part := range parts {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(part))))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func peerTag(key []byte, seq uint64, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(binary.BigEndian.AppendUint64(nil, seq))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writePeerLine(w *bufio.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func readPeerLine(r *bufio.Reader, v interface{}) error {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		line = append(line, chunk...)
+		if len(line) > peerMaxLineBytes {
+			return errors.New("peer line too long")
+		}
+		if !isPrefix {
+			break
+		}
+	}
+
+	return json.Unmarshal(line, v)
+}
+
+func (p *Peering) broadcast(msg peerMessage) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("JSON marshal failure of a peer message", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for pc := range p.conns {
+		select {
+		case pc.send <- body:
+		default:
+			// The peer is too far behind to follow event by event, so
+			// drop it. It catches up from our snapshot when it
+			// reconnects.
+			log.Printf("Peer %s is too slow, disconnecting it to resync", pc.name)
+			delete(p.conns, pc)
+			pc.conn.Close()
+		}
+	}
+}
+
+func (p *Peering) snapshot() []machineSnapshot {
+	all := p.machines.All()
+	out := make([]machineSnapshot, 0, len(all))
+	for _, machine := range all {
+		ip, events := machine.Snapshot()
+		out = append(out, machineSnapshot{
+			Mac:         machine.Mac,
+			IPv6Address: ip,
+			Events:      events,
+		})
+	}
+
+	return out
+}
+
+func (p *Peering) apply(remoteName string, msg peerMessage) {
+	for _, snap := range msg.Snapshot {
+		if snap.Mac == nil {
+			continue
+		}
+
+		machine := p.machines.GetOrAdoptMachine(net.HardwareAddr(snap.Mac))
+		machine.MergePeerEvents(snap.IPv6Address, snap.Events)
+	}
+
+	if msg.Event != nil && msg.Event.Mac != nil {
+		ev := *msg.Event
+		if ev.Origin == "" {
+			ev.Origin = remoteName
+		}
+
+		machine := p.machines.GetOrAdoptMachine(net.HardwareAddr(ev.Mac))
+		machine.ApplyPeerEvent(ev)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type testPeer struct {
+	broker   *Broker
+	machines *Machines
+	peering  *Peering
+}
+
+func newTestPeer(name, secret string) *testPeer {
+	broker := NewBroker()
+	machines := NewMachines(broker)
+	peering := NewPeering(name, []byte(secret), machines, broker)
+	peering.Forward()
+
+	return &testPeer{broker: broker, machines: machines, peering: peering}
+}
+
+// connectTestPeers has b connect to a over loopback, and returns once the
+// connection is authenticated on both ends.
+func connectTestPeers(t *testing.T, a, b *testPeer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failure: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go a.peering.Serve(ln)
+	go b.peering.DialForever(ln.Addr().String())
+
+	waitFor(t, func() bool {
+		return a.peering.connected() == 1 && b.peering.connected() == 1
+	})
+}
+
+func (p *Peering) connected() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func timeline(m *Machines, mac net.HardwareAddr) string {
+	machine := m.GetMachine(mac)
+	if machine == nil {
+		return "<nil>"
+	}
+
+	_, events := machine.Snapshot()
+	return fmt.Sprintf("%s %v", machine.State(), events)
+}
+
+func TestPeersShareTimelines(t *testing.T) {
+	mac := net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20}
+	a := newTestPeer("a", "hunter2")
+	b := newTestPeer("b", "hunter2")
+
+	// Known to a before b shows up, so it arrives in a snapshot.
+	a.machines.GetOrInitMachine(mac).Event(context.Background(), "firmware_init", nil)
+
+	connectTestPeers(t, a, b)
+
+	waitFor(t, func() bool {
+		return timeline(a.machines, mac) == timeline(b.machines, mac)
+	})
+
+	// Happens on b while connected, so it arrives as a live event.
+	b.machines.GetMachine(mac).Event(context.Background(), "http_boot", nil)
+
+	waitFor(t, func() bool {
+		return a.machines.GetMachine(mac).State() == "http_boot"
+	})
+
+	if got, want := timeline(a.machines, mac), timeline(b.machines, mac); got != want {
+		t.Fatalf("Timelines diverged:\na: %s\nb: %s", got, want)
+	}
+
+	if n := a.machines.GetMachine(mac).Events.Len(); n != 3 {
+		t.Fatalf("Wanted init, firmware_init and http_boot, got %d events: %s", n, timeline(a.machines, mac))
+	}
+}
+
+func TestPeersRejectWrongSecret(t *testing.T) {
+	a := newTestPeer("a", "hunter2")
+	b := newTestPeer("b", "hunter3")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failure: %v", err)
+	}
+	defer ln.Close()
+
+	errs := make(chan error, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		errs <- a.peering.handle(conn)
+	}()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			errs <- err
+			return
+		}
+		errs <- b.peering.handle(conn)
+	}()
+
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatalf("Expected the handshake to fail")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the handshake to fail")
+		}
+	}
+
+	if a.peering.connected() != 0 || b.peering.connected() != 0 {
+		t.Fatalf("Expected no peers to be connected")
+	}
+}
+
+func TestPeersDisconnectSlowPeers(t *testing.T) {
+	a := newTestPeer("a", "hunter2")
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// A peer whose queue is full
+	pc := &peerConn{name: "b", conn: local, send: make(chan []byte)}
+	a.peering.conns[pc] = struct{}{}
+
+	a.machines.GetOrInitMachine(net.HardwareAddr{0x04, 0x42, 0x1a, 0x03, 0x9b, 0x20})
+
+	if n := a.peering.connected(); n != 0 {
+		t.Fatalf("Wanted the slow peer dropped, so it resyncs, got %d peers", n)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Wanted the slow peer's connection closed")
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "io"
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
 
 type TransferEvent struct {
 	Protocol   string `json:"protocol"`
@@ -9,6 +13,80 @@ type TransferEvent struct {
 	SentBytes  int64  `json:"sent_bytes"`
 	TotalBytes int64  `json:"total_bytes"`
 	Error      string `json:"error,omitempty"`
+
+	// Directory is where the file was found, see bootFileDirs
+	Directory string `json:"directory,omitempty"`
+	// SHA256 is the hex SHA-256 of the whole file
+	SHA256 string `json:"sha256,omitempty"`
+	// Range is the Range header of a byte-range request, like bytes=1024-.
+	// SentBytes and TotalBytes then count the bytes of the served ranges, and
+	// Offset is where the first range starts in the file.
+	Range  string `json:"range,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	// Image and ImageVersion are the catalog image the file came from, and
+	// Rollout the rollout which picked it, if any
+	Image        string `json:"image,omitempty"`
+	ImageVersion string `json:"image_version,omitempty"`
+	Rollout      string `json:"rollout,omitempty"`
+	// UKI is the embedded metadata of a unified kernel image
+	UKI *UKIInfo `json:"uki,omitempty"`
+	// Signature is the result of checking a PE file's Authenticode
+	// signature, with -authenticode-trusted-certs
+	Signature *SignatureInfo `json:"signature,omitempty"`
+	// IPXEFlavor is the flavor of an iPXE binary, like snponly
+	IPXEFlavor string `json:"ipxe_flavor,omitempty"`
+	// QueuePosition is how many transfers were waiting for a slot, including
+	// a queued one, and QueuedMillis how long a transfer waited, see
+	// TransferLimits
+	QueuePosition int   `json:"queue_position,omitempty"`
+	QueuedMillis  int64 `json:"queued_ms,omitempty"`
+	// DurationMillis and BytesPerSecond are how long a finished transfer
+	// took, and its throughput
+	DurationMillis int64   `json:"duration_ms,omitempty"`
+	BytesPerSecond float64 `json:"bytes_per_second,omitempty"`
+	// BlockSize is the block size a TFTP transfer negotiated, and
+	// Retransmits how many of its datagrams went unacknowledged
+	BlockSize   int `json:"block_size,omitempty"`
+	Retransmits int `json:"retransmits,omitempty"`
+	// WindowSize is how many blocks a TFTP transfer sent before waiting for
+	// an acknowledgement. It's -tftp-window-size rather than a negotiated
+	// value: the TFTP library doesn't support the RFC 7440 windowsize
+	// option.
+	WindowSize int `json:"window_size,omitempty"`
+}
+
+// transferEventOf is an event's detail as a TransferEvent, whether it's one
+// of ours or was decoded from a peer's JSON.
+func transferEventOf(detail interface{}) (TransferEvent, bool) {
+	switch detail := detail.(type) {
+	case TransferEvent:
+		return detail, true
+	case map[string]interface{}:
+		if _, ok := detail["protocol"]; !ok {
+			return TransferEvent{}, false
+		}
+
+		data, err := json.Marshal(detail)
+		if err != nil {
+			return TransferEvent{}, false
+		}
+
+		var transfer TransferEvent
+		if err := json.Unmarshal(data, &transfer); err != nil {
+			return TransferEvent{}, false
+		}
+		return transfer, true
+	}
+
+	return TransferEvent{}, false
+}
+
+// finished records how long the transfer took, and its throughput.
+func (e *TransferEvent) finished(d time.Duration) {
+	e.DurationMillis = d.Milliseconds()
+	if d > 0 {
+		e.BytesPerSecond = float64(e.SentBytes) / d.Seconds()
+	}
 }
 
 const fiveMiB = 5 * 1024 * 1024
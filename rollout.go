@@ -0,0 +1,576 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rollout moves an inventory group from one catalog image to another, a
+// percentage of the group at a time. Machines are bucketed by a hash of the
+// rollout name and their MAC, so the same machines are picked every time.
+//
+// The machines which join at a step are its canaries. The rollout advances
+// once they all reach os_init, or when its deadline passes after the first
+// canary starts booting if none of them are still booting by then. A canary
+// transfer error, or a canary still booting at the deadline, rolls the whole
+// group back to the old image.
+type Rollout struct {
+	Name  string `json:"name"`
+	Group string `json:"group"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	// Steps are ascending percentages of the group, ending at 100
+	Steps []int `json:"steps"`
+	// Deadline is how long canaries get to reach os_init, like "15m"
+	Deadline string `json:"deadline"`
+
+	State        string            `json:"state"`
+	Step         int               `json:"step"`
+	StepStarted  time.Time         `json:"step_started"`
+	FirstBoot    time.Time         `json:"first_boot,omitempty"`
+	Reason       string            `json:"reason,omitempty"`
+	CanaryStates map[string]string `json:"canaries"`
+
+	deadline time.Duration
+}
+
+const (
+	rolloutCanary     = "canary"
+	rolloutCompleted  = "completed"
+	rolloutRolledBack = "rolled_back"
+
+	canaryPending = "pending"
+	canaryBooting = "booting"
+	canaryOSInit  = "os_init"
+	canaryFailed  = "failed"
+)
+
+// RolloutEvent is the detail of the rollout_* events published on the
+// Broker, which aren't about any one machine.
+type RolloutEvent struct {
+	Name    string `json:"name"`
+	Group   string `json:"group"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Percent int    `json:"percent"`
+	State   string `json:"state"`
+	Reason  string `json:"reason,omitempty"`
+	// Canaries are the machines being watched at this step
+	Canaries []string `json:"canaries,omitempty"`
+}
+
+// rolloutBucket puts a machine in one of 100 buckets for a rollout.
+func rolloutBucket(name string, mac net.HardwareAddr) int {
+	sum := sha256.Sum256([]byte(name + "/" + mac.String()))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+func (r *Rollout) percent() int {
+	if r.State == rolloutCompleted {
+		return 100
+	}
+	if r.State == rolloutRolledBack {
+		return 0
+	}
+	return r.Steps[r.Step]
+}
+
+// imageFor picks the image reference of a machine in the rollout's group.
+func (r *Rollout) imageFor(mac net.HardwareAddr) string {
+	if rolloutBucket(r.Name, mac) < r.percent() {
+		return r.To
+	}
+	return r.From
+}
+
+func (r *Rollout) validate() error {
+	if r.Name == "" || r.Group == "" || r.From == "" || r.To == "" {
+		return errors.New("a rollout needs a name, group, from and to")
+	}
+
+	if len(r.Steps) == 0 || r.Steps[len(r.Steps)-1] != 100 {
+		return errors.New("rollout steps must end at 100")
+	}
+
+	for i, step := range r.Steps {
+		if step <= 0 || (i > 0 && step <= r.Steps[i-1]) {
+			return fmt.Errorf("rollout steps must be ascending percentages, got %v", r.Steps)
+		}
+	}
+
+	deadline, err := time.ParseDuration(r.Deadline)
+	if err != nil || deadline <= 0 {
+		return fmt.Errorf("invalid rollout deadline %q", r.Deadline)
+	}
+	r.deadline = deadline
+
+	return nil
+}
+
+// Rollouts tracks the rollouts in progress, and finished ones until they are
+// deleted.
+type Rollouts struct {
+	file   string
+	broker *Broker
+
+	mu       sync.Mutex
+	rollouts map[string]*Rollout
+	// generation counts the snapshots of rollouts taken to be saved
+	generation uint64
+
+	// fileMu orders writes to file, and saved is the generation in it
+	fileMu sync.Mutex
+	saved  uint64
+}
+
+var rollouts *Rollouts
+
+// LoadRollouts resumes the rollouts persisted in file, if any.
+func LoadRollouts(file string, broker *Broker) (*Rollouts, error) {
+	rs := &Rollouts{file: file, broker: broker, rollouts: make(map[string]*Rollout)}
+
+	if file == "" {
+		return rs, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading the rollouts %q: %w", file, err)
+	}
+
+	if err := json.Unmarshal(data, &rs.rollouts); err != nil {
+		return nil, fmt.Errorf("parsing the rollouts %q: %w", file, err)
+	}
+
+	for name, r := range rs.rollouts {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rollout %s: %w", name, err)
+		}
+	}
+
+	return rs, nil
+}
+
+// groupMembers are the inventory machines in a group, sorted.
+func groupMembers(group string) []net.HardwareAddr {
+	if inventory == nil {
+		return nil
+	}
+
+	var members []net.HardwareAddr
+	for macStr, machine := range inventory.Machines {
+		for _, g := range machine.Groups {
+			if g == group {
+				mac, _ := net.ParseMAC(macStr)
+				members = append(members, mac)
+				break
+			}
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].String() < members[j].String() })
+	return members
+}
+
+// Start begins a rollout at its first step.
+func (rs *Rollouts) Start(r Rollout, now time.Time) (Rollout, error) {
+	if err := r.validate(); err != nil {
+		return Rollout{}, err
+	}
+
+	if inventory == nil || inventory.Groups[r.Group] == nil {
+		return Rollout{}, fmt.Errorf("no inventory group %q", r.Group)
+	}
+
+	for _, ref := range []string{r.From, r.To} {
+		if _, err := catalog.Resolve(ref); err != nil {
+			return Rollout{}, err
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if existing, ok := rs.rollouts[r.Name]; ok && existing.State == rolloutCanary {
+		return Rollout{}, fmt.Errorf("rollout %q is already in progress", r.Name)
+	}
+
+	rollout := &r
+	rs.rollouts[r.Name] = rollout
+	rs.enterStepWithoutLocking(rollout, 0, now, "rollout_started")
+	rs.saveWithoutLocking()
+	return rollout.copy(), nil
+}
+
+// enterStepWithoutLocking moves the rollout to a step, skipping over steps
+// which add no machines.
+func (rs *Rollouts) enterStepWithoutLocking(r *Rollout, step int, now time.Time, event string) {
+	for ; step < len(r.Steps); step++ {
+		previous := 0
+		if step > 0 {
+			previous = r.Steps[step-1]
+		}
+
+		canaries := make(map[string]string)
+		for _, mac := range groupMembers(r.Group) {
+			if bucket := rolloutBucket(r.Name, mac); bucket >= previous && bucket < r.Steps[step] {
+				canaries[mac.String()] = canaryPending
+			}
+		}
+
+		r.State = rolloutCanary
+		r.Step = step
+		r.StepStarted = now
+		r.FirstBoot = time.Time{}
+		r.CanaryStates = canaries
+
+		if len(canaries) > 0 {
+			rs.publishWithoutLocking(r, event)
+			return
+		}
+	}
+
+	r.State = rolloutCompleted
+	r.CanaryStates = nil
+	rs.publishWithoutLocking(r, "rollout_completed")
+}
+
+func (rs *Rollouts) advanceWithoutLocking(r *Rollout, now time.Time) {
+	rs.enterStepWithoutLocking(r, r.Step+1, now, "rollout_advanced")
+}
+
+func (rs *Rollouts) rollbackWithoutLocking(r *Rollout, reason string) {
+	r.State = rolloutRolledBack
+	r.Reason = reason
+	rs.publishWithoutLocking(r, "rollout_rolled_back")
+}
+
+func (rs *Rollouts) publishWithoutLocking(r *Rollout, event string) {
+	detail := RolloutEvent{
+		Name:    r.Name,
+		Group:   r.Group,
+		From:    r.From,
+		To:      r.To,
+		Percent: r.percent(),
+		State:   r.State,
+		Reason:  r.Reason,
+	}
+
+	for mac := range r.CanaryStates {
+		detail.Canaries = append(detail.Canaries, mac)
+	}
+	sort.Strings(detail.Canaries)
+
+	rs.broker.Publish(IdentifiedEvent{Event: NewEvent(event, false, detail)})
+}
+
+// snapshotWithoutLocking encodes the rollouts to be saved.
+func (rs *Rollouts) snapshotWithoutLocking() ([]byte, uint64, error) {
+	rs.generation++
+	data, err := json.Marshal(rs.rollouts)
+	return data, rs.generation, err
+}
+
+// write saves a snapshot to the file, unless a later one is already there.
+func (rs *Rollouts) write(data []byte, generation uint64) error {
+	rs.fileMu.Lock()
+	defer rs.fileMu.Unlock()
+
+	if generation <= rs.saved {
+		return nil
+	}
+
+	if err := writeJSONFile(rs.file, json.RawMessage(data)); err != nil {
+		return err
+	}
+	rs.saved = generation
+	return nil
+}
+
+func (rs *Rollouts) saveWithoutLocking() error {
+	if rs.file == "" {
+		return nil
+	}
+
+	data, generation, err := rs.snapshotWithoutLocking()
+	if err == nil {
+		err = rs.write(data, generation)
+	}
+	if err != nil {
+		log.Printf("Failed to persist the rollouts: %v", err)
+	}
+	return err
+}
+
+// saveLaterWithoutLocking saves the rollouts from another goroutine, for the
+// observer, which mustn't hold up the event being published.
+func (rs *Rollouts) saveLaterWithoutLocking() {
+	if rs.file == "" {
+		return
+	}
+
+	data, generation, err := rs.snapshotWithoutLocking()
+	if err != nil {
+		log.Printf("Failed to persist the rollouts: %v", err)
+		return
+	}
+
+	go func() {
+		if err := rs.write(data, generation); err != nil {
+			log.Printf("Failed to persist the rollouts: %v", err)
+		}
+	}()
+}
+
+// Rollback rolls a rollout back by hand.
+func (rs *Rollouts) Rollback(name, reason string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.rollouts[name]
+	if !ok {
+		return fmt.Errorf("no rollout %q", name)
+	}
+
+	rs.rollbackWithoutLocking(r, reason)
+	rs.saveWithoutLocking()
+	return nil
+}
+
+// Delete forgets a rollout, so its group goes back to whatever else picks
+// their images.
+func (rs *Rollouts) Delete(name string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if _, ok := rs.rollouts[name]; !ok {
+		return fmt.Errorf("no rollout %q", name)
+	}
+
+	delete(rs.rollouts, name)
+	return rs.saveWithoutLocking()
+}
+
+// Get returns a copy of a rollout.
+func (rs *Rollouts) Get(name string) (Rollout, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.rollouts[name]
+	if !ok {
+		return Rollout{}, false
+	}
+	return r.copy(), true
+}
+
+// All returns copies of the rollouts, sorted by name.
+func (rs *Rollouts) All() []Rollout {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	all := make([]Rollout, 0, len(rs.rollouts))
+	for _, r := range rs.rollouts {
+		all = append(all, r.copy())
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+func (r *Rollout) copy() Rollout {
+	c := *r
+	c.CanaryStates = make(map[string]string, len(r.CanaryStates))
+	for mac, state := range r.CanaryStates {
+		c.CanaryStates[mac] = state
+	}
+	return c
+}
+
+// Refs are the image references the rollouts serve to their groups: both
+// images while one is in progress, then the one it finished on.
+func (rs *Rollouts) Refs() []string {
+	if rs == nil {
+		return nil
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var refs []string
+	for _, r := range rs.rollouts {
+		switch r.State {
+		case rolloutCompleted:
+			refs = append(refs, r.To)
+		case rolloutRolledBack:
+			refs = append(refs, r.From)
+		default:
+			refs = append(refs, r.From, r.To)
+		}
+	}
+	return refs
+}
+
+// ImageFor picks the image reference for a machine from the first rollout,
+// by name, which covers its group.
+func (rs *Rollouts) ImageFor(mac net.HardwareAddr) (ref, rollout string, ok bool) {
+	if rs == nil {
+		return "", "", false
+	}
+
+	entry := inventory.Machine(mac)
+	if entry == nil {
+		return "", "", false
+	}
+
+	for _, r := range rs.All() {
+		for _, group := range entry.Groups {
+			if group == r.Group {
+				return r.imageFor(mac), r.Name, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// observe follows canaries through the machine events on the Broker.
+func (rs *Rollouts) observe(ev IdentifiedEvent, now time.Time) {
+	if ev.Mac == nil {
+		return
+	}
+	mac := ev.Mac.String()
+
+	transfer, isTransfer := transferEventOf(ev.Event.Detail)
+	failed := isTransfer && (transfer.State == "error" || transfer.State == "aborted")
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	changed := false
+	defer func() {
+		if changed {
+			rs.saveLaterWithoutLocking()
+		}
+	}()
+
+	for _, r := range rs.rollouts {
+		state, ok := r.CanaryStates[mac]
+		if r.State != rolloutCanary || !ok {
+			continue
+		}
+
+		if failed {
+			r.CanaryStates[mac] = canaryFailed
+			rs.rollbackWithoutLocking(r, fmt.Sprintf("canary %s failed %s: %s", mac, ev.Event.Event, transfer.Error))
+			changed = true
+			continue
+		}
+
+		switch {
+		case ev.Event.Event == "os_init":
+			r.CanaryStates[mac] = canaryOSInit
+		case state == canaryPending && (bootAttemptEvents[ev.Event.Event] || ev.Event.Event == "http_fetch_uki"):
+			r.CanaryStates[mac] = canaryBooting
+			if r.FirstBoot.IsZero() {
+				r.FirstBoot = now
+			}
+		default:
+			continue
+		}
+		changed = true
+
+		allUp := true
+		for _, state := range r.CanaryStates {
+			allUp = allUp && state == canaryOSInit
+		}
+		if allUp {
+			rs.advanceWithoutLocking(r, now)
+		} else {
+			rs.publishWithoutLocking(r, "rollout_canary")
+		}
+	}
+}
+
+// checkDeadlines advances or rolls back rollouts whose canaries have had
+// their time.
+func (rs *Rollouts) checkDeadlines(now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	changed := false
+	for _, r := range rs.rollouts {
+		if r.State != rolloutCanary || r.FirstBoot.IsZero() || now.Before(r.FirstBoot.Add(r.deadline)) {
+			continue
+		}
+		changed = true
+
+		var stuck []string
+		for mac, state := range r.CanaryStates {
+			if state == canaryBooting {
+				stuck = append(stuck, mac)
+			}
+		}
+		sort.Strings(stuck)
+
+		if len(stuck) > 0 {
+			rs.rollbackWithoutLocking(r, fmt.Sprintf("canaries %v didn't reach os_init within %s", stuck, r.Deadline))
+		} else {
+			rs.advanceWithoutLocking(r, now)
+		}
+	}
+
+	if changed {
+		rs.saveWithoutLocking()
+	}
+}
+
+// Watch follows canaries through every machine event as it's published, as
+// a missed failure or os_init would leave a rollout on the wrong step.
+func (rs *Rollouts) Watch() {
+	rs.broker.Observe(func(ev IdentifiedEvent) {
+		rs.observe(ev, time.Now())
+	})
+}
+
+// Run checks deadlines every interval.
+func (rs *Rollouts) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		rs.checkDeadlines(now)
+	}
+}
+
+// imageFor picks the catalog image to serve a machine: the one it is pinned
+// to, else the one its group's rollout picks for it.
+func imageFor(mac net.HardwareAddr) (image Image, rollout string, ok bool) {
+	if image, ok := catalog.Pinned(mac); ok {
+		return image, "", true
+	}
+
+	ref, rollout, ok := rollouts.ImageFor(mac)
+	if !ok {
+		return Image{}, "", false
+	}
+
+	image, err := catalog.Resolve(ref)
+	if err != nil {
+		log.Printf("Rollout %s picked %s for %s: %v", rollout, ref, mac, err)
+		return Image{}, "", false
+	}
+
+	return image, rollout, true
+}
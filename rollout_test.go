@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestRollouts(t *testing.T) (*Rollouts, []net.HardwareAddr) {
+	_, c := newTestCatalog(t)
+	catalog = c
+	t.Cleanup(func() { catalog = nil })
+
+	inventory = &Inventory{
+		Groups:   map[string]*InventoryGroup{"rack1": {}},
+		Machines: make(map[string]*InventoryMachine),
+	}
+	t.Cleanup(func() { inventory = nil })
+
+	var macs []net.HardwareAddr
+	for i := 0; i < 20; i++ {
+		mac, _ := net.ParseMAC(fmt.Sprintf("04:42:1a:03:9b:%02x", i))
+		inventory.Machines[mac.String()] = &InventoryMachine{Groups: []string{"rack1"}}
+		macs = append(macs, mac)
+	}
+
+	rs, err := LoadRollouts(filepath.Join(t.TempDir(), "rollouts.json"), NewBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs, macs
+}
+
+func machineEvent(mac net.HardwareAddr, event string, detail interface{}) IdentifiedEvent {
+	return IdentifiedEvent{Mac: MAC(mac), Event: NewEvent(event, false, detail)}
+}
+
+func TestRolloutAdvancesAndRollsBack(t *testing.T) {
+	rs, macs := newTestRollouts(t)
+	now := time.Unix(1760000000, 0)
+
+	ch, unsubscribe := rs.broker.SubscribeBuffered(64)
+	defer unsubscribe()
+
+	rollout, err := rs.Start(Rollout{
+		Name:     "installer",
+		Group:    "rack1",
+		From:     "nixos-installer@2025-09-01",
+		To:       "nixos-installer@2025-10-01",
+		Steps:    []int{50, 100},
+		Deadline: "10m",
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-ch; ev.Event.Event != "rollout_started" {
+		t.Fatalf("Wanted a rollout_started event, got %v", ev)
+	}
+
+	var canaries, rest []net.HardwareAddr
+	for _, mac := range macs {
+		if rolloutBucket("installer", mac) < 50 {
+			canaries = append(canaries, mac)
+		} else {
+			rest = append(rest, mac)
+		}
+	}
+	if len(rollout.CanaryStates) != len(canaries) || len(canaries) == 0 || len(rest) == 0 {
+		t.Fatalf("Wanted the first half of the buckets as canaries, got %v", rollout.CanaryStates)
+	}
+
+	if ref, _, _ := rs.ImageFor(canaries[0]); ref != "nixos-installer@2025-10-01" {
+		t.Fatalf("Wanted a canary to get the new image, got %s", ref)
+	}
+	if ref, _, _ := rs.ImageFor(rest[0]); ref != "nixos-installer@2025-09-01" {
+		t.Fatalf("Wanted the rest to keep the old image, got %s", ref)
+	}
+
+	for _, mac := range canaries {
+		rs.observe(machineEvent(mac, "http_fetch_uki", TransferEvent{State: "init"}), now)
+		rs.observe(machineEvent(mac, "os_init", nil), now.Add(time.Minute))
+	}
+
+	rollout, _ = rs.Get("installer")
+	if rollout.Step != 1 || len(rollout.CanaryStates) != len(rest) {
+		t.Fatalf("Wanted the rollout to advance to the rest, got %+v", rollout)
+	}
+
+	// One canary starts booting and never comes up
+	rs.observe(machineEvent(rest[0], "http_boot", nil), now.Add(2*time.Minute))
+	rs.checkDeadlines(now.Add(11 * time.Minute))
+
+	rollout, _ = rs.Get("installer")
+	if rollout.State != rolloutCanary {
+		t.Fatalf("Wanted the rollout to wait out the deadline, got %s", rollout.State)
+	}
+
+	rs.checkDeadlines(now.Add(13 * time.Minute))
+
+	rollout, _ = rs.Get("installer")
+	if rollout.State != rolloutRolledBack {
+		t.Fatalf("Wanted a stuck canary to roll the rollout back, got %+v", rollout)
+	}
+	if ref, _, _ := rs.ImageFor(canaries[0]); ref != "nixos-installer@2025-09-01" {
+		t.Fatalf("Wanted everyone back on the old image, got %s", ref)
+	}
+
+	reloaded, err := LoadRollouts(rs.file, NewBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollout, _ := reloaded.Get("installer"); rollout.State != rolloutRolledBack {
+		t.Fatalf("Wanted the rollout to be persisted, got %+v", rollout)
+	}
+}
+
+func TestRolloutRollsBackOnTransferErrors(t *testing.T) {
+	rs, macs := newTestRollouts(t)
+	now := time.Unix(1760000000, 0)
+
+	if _, err := rs.Start(Rollout{
+		Name:     "installer",
+		Group:    "rack1",
+		From:     "nixos-installer@2025-09-01",
+		To:       "nixos-installer",
+		Steps:    []int{100},
+		Deadline: "10m",
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	rollouts = rs
+	defer func() { rollouts = nil }()
+
+	unpinned := func() (refs []string) {
+		images, err := catalog.Unpinned()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, image := range images {
+			refs = append(refs, image.Ref())
+		}
+		return refs
+	}
+	if refs := unpinned(); !slices.Equal(refs, []string{"memtest@7.20"}) {
+		t.Fatalf("Wanted both images of the rollout in use, got %v", refs)
+	}
+
+	// The failure is seen however many events came before it
+	rs.Watch()
+	for range 100 {
+		rs.broker.Publish(machineEvent(macs[3], "http_fetch_file", TransferEvent{State: "sending"}))
+	}
+
+	// A canary refused a slot in the transfer queue hasn't failed
+	rs.broker.Publish(machineEvent(macs[3], "http_fetch_uki", TransferEvent{State: "refused", Error: errQueueTimeout.Error()}))
+	if rollout, _ := rs.Get("installer"); rollout.State != rolloutCanary {
+		t.Fatalf("Wanted a queue timeout not to roll the rollout back, got %+v", rollout)
+	}
+	// The failure happened on an HA peer, so its detail was decoded from JSON
+	var peerEvent IdentifiedEvent
+	data, _ := json.Marshal(machineEvent(macs[3], "http_fetch_uki", TransferEvent{Protocol: "http", State: "aborted", Error: "file changed during the transfer"}))
+	if err := json.Unmarshal(data, &peerEvent); err != nil {
+		t.Fatal(err)
+	}
+	peerEvent.Origin = "peer"
+	rs.broker.Publish(peerEvent)
+
+	if rollout, _ := rs.Get("installer"); rollout.State != rolloutRolledBack || rollout.CanaryStates[macs[3].String()] != canaryFailed {
+		t.Fatalf("Wanted a transfer error to roll the rollout back, got %+v", rollout)
+	}
+
+	// The observer saves it without holding up the event
+	deadline := time.Now().Add(time.Second)
+	for {
+		reloaded, err := LoadRollouts(rs.file, NewBroker())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rollout, _ := reloaded.Get("installer"); rollout.State == rolloutRolledBack {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Wanted the rollback to be persisted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if refs := unpinned(); !slices.Equal(refs, []string{"memtest@7.20", "nixos-installer@2025-10-01"}) {
+		t.Fatalf("Wanted the image rolled back from to be unused, got %v", refs)
+	}
+}
+
+func TestRolloutValidation(t *testing.T) {
+	rs, _ := newTestRollouts(t)
+
+	for _, r := range []Rollout{
+		{Name: "x", Group: "rack1", From: "nixos-installer@2025-09-01", To: "nixos-installer", Steps: []int{50}, Deadline: "10m"},
+		{Name: "x", Group: "rack1", From: "nixos-installer@2025-09-01", To: "nixos-installer", Steps: []int{50, 20, 100}, Deadline: "10m"},
+		{Name: "x", Group: "rack2", From: "nixos-installer@2025-09-01", To: "nixos-installer", Steps: []int{100}, Deadline: "10m"},
+		{Name: "x", Group: "rack1", From: "nixos-installer@2025-09-01", To: "missing", Steps: []int{100}, Deadline: "10m"},
+		{Name: "x", Group: "rack1", From: "nixos-installer@2025-09-01", To: "nixos-installer", Steps: []int{100}, Deadline: "soon"},
+	} {
+		if _, err := rs.Start(r, time.Now()); err == nil {
+			t.Errorf("Wanted %+v to be refused", r)
+		}
+	}
+
+	if _, err := os.Stat(rs.file); err == nil {
+		t.Fatalf("Wanted nothing to be persisted")
+	}
+}
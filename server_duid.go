@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// duidEpoch is the start of DUID-LLT time, see RFC 8415 section 11.2.
+var duidEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// parseDUID parses a DUID written as hex, optionally separated by colons or
+// dashes, like 00:03:00:01:02:de:ad:be:ef:01.
+func parseDUID(s string) (dhcpv6.DUID, error) {
+	s = strings.TrimSpace(s)
+	s = strings.NewReplacer(":", "", "-", "").Replace(s)
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("DUID %q is not hex: %w", s, err)
+	}
+
+	return dhcpv6.DUIDFromBytes(b)
+}
+
+func formatDUID(d dhcpv6.DUID) string {
+	b := d.ToBytes()
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// loadServerDUID picks the server's DUID. An explicit DUID wins. Otherwise,
+// with a state file we reuse the DUID-LLT we generated on first start, so the
+// DUID survives hardware changes. Without either we fall back to the
+// interface's DUID-LL.
+func loadServerDUID(explicit, stateFile string, hwaddr net.HardwareAddr) (dhcpv6.DUID, error) {
+	if explicit != "" {
+		return parseDUID(explicit)
+	}
+
+	if stateFile == "" {
+		return &dhcpv6.DUIDLL{
+			HWType:        iana.HWTypeEthernet,
+			LinkLayerAddr: hwaddr,
+		}, nil
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if err == nil {
+		duid, err := parseDUID(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("reading the server DUID from %s: %w", stateFile, err)
+		}
+		return duid, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading the server DUID from %s: %w", stateFile, err)
+	}
+
+	duid := &dhcpv6.DUIDLLT{
+		HWType:        iana.HWTypeEthernet,
+		Time:          uint32(time.Since(duidEpoch).Seconds()),
+		LinkLayerAddr: hwaddr,
+	}
+
+	if err := os.WriteFile(stateFile, []byte(formatDUID(duid)+"\n"), 0o644); err != nil {
+		return nil, fmt.Errorf("persisting the server DUID to %s: %w", stateFile, err)
+	}
+	log.Printf("Generated server DUID %s and saved it to %s", formatDUID(duid), stateFile)
+
+	return duid, nil
+}
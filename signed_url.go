@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key to sign boot URLs with. If nil, boot URLs aren't signed or checked.
+var bootURLKey []byte
+
+// signBootURL signs a URL for the file rel in mac's tree, like boot.efi,
+// which is valid until expires, a Unix timestamp. The signature only unlocks
+// that one file.
+func signBootURL(mac net.HardwareAddr, rel string, expires int64) string {
+	h := hmac.New(sha256.New, bootURLKey)
+	fmt.Fprintf(h, "%s\n%s\n%d", mac, rel, expires)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signedURLFile is the file in a machine's tree a URL path is for: what
+// follows /mac/{mac}/, or the whole path if it doesn't name a MAC.
+func signedURLFile(urlPath string) string {
+	rel := strings.TrimLeft(urlPath, "/")
+	if after, ok := strings.CutPrefix(rel, "mac/"); ok {
+		if _, file, ok := strings.Cut(after, "/"); ok {
+			return file
+		}
+	}
+
+	return rel
+}
+
+// signRenderedBootURL signs a rendered boot URL for mac, unless its template
+// already did.
+func signRenderedBootURL(bootURL string, mac net.HardwareAddr, now time.Time) string {
+	if bootURLKey == nil {
+		return bootURL
+	}
+
+	u, err := url.Parse(bootURL)
+	if err != nil || u.Query().Has("signature") {
+		return bootURL
+	}
+
+	expires := now.Add(*bootURLTTL).Unix()
+	bootURL = appendQuery(bootURL, "expires", strconv.FormatInt(expires, 10))
+	return appendQuery(bootURL, "signature", signBootURL(mac, signedURLFile(u.Path), expires))
+}
+
+// checkSignedBootURL verifies the request's `expires` and `signature` query
+// parameters were issued for the file rel in mac's tree, and that the
+// request comes from the address we assigned mac.
+func checkSignedBootURL(r *http.Request, mac net.HardwareAddr, rel string, allocator *Allocator, now time.Time) error {
+	params := r.URL.Query()
+
+	expires, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		return errors.New("missing or malformed expires")
+	}
+
+	signature, err := hex.DecodeString(params.Get("signature"))
+	if err != nil || len(signature) == 0 {
+		return errors.New("missing or malformed signature")
+	}
+
+	want, _ := hex.DecodeString(signBootURL(mac, rel, expires))
+	if !hmac.Equal(signature, want) {
+		return errors.New("invalid signature")
+	}
+
+	if now.Unix() >= expires {
+		return fmt.Errorf("expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+
+	if source := remoteIP(r); !source.Equal(allocator.AddressFor(mac)) {
+		return fmt.Errorf("request came from %s, not %s", r.RemoteAddr, allocator.AddressFor(mac))
+	}
+
+	return nil
+}
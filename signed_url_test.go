@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSignedBootURL(t *testing.T) {
+	bootURLKey = []byte("hunter2")
+	defer func() { bootURLKey = nil }()
+
+	allocator := NewAllocator(net.ParseIP("fec0::"))
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	other, _ := net.ParseMAC("04:42:1a:03:9b:21")
+	now := time.Unix(1760000000, 0)
+	expires := now.Add(time.Minute).Unix()
+
+	requestFile := func(mac net.HardwareAddr, rel string, from net.IP, expires int64, signature string) error {
+		r := httptest.NewRequest("GET", "/mac/"+mac.String()+"/"+rel+"?expires="+strconv.FormatInt(expires, 10)+"&signature="+signature, nil)
+		r.RemoteAddr = net.JoinHostPort(from.String(), "40000")
+		return checkSignedBootURL(r, mac, rel, allocator, now)
+	}
+
+	request := func(mac net.HardwareAddr, from net.IP, expires int64, signature string) error {
+		return requestFile(mac, "boot.efi", from, expires, signature)
+	}
+
+	if err := request(mac, allocator.AddressFor(mac), expires, signBootURL(mac, "boot.efi", expires)); err != nil {
+		t.Fatalf("Wanted the signed URL to verify, got %v", err)
+	}
+
+	if err := request(other, allocator.AddressFor(other), expires, signBootURL(mac, "boot.efi", expires)); err == nil {
+		t.Fatalf("Wanted another MAC's signature to be refused")
+	}
+
+	if err := request(mac, allocator.AddressFor(other), expires, signBootURL(mac, "boot.efi", expires)); err == nil {
+		t.Fatalf("Wanted a request from another address to be refused")
+	}
+
+	if err := request(mac, allocator.AddressFor(mac), expires+60, signBootURL(mac, "boot.efi", expires)); err == nil {
+		t.Fatalf("Wanted an extended expiry to be refused")
+	}
+
+	if err := requestFile(mac, "boot.efi.extra.d/secret.cred", allocator.AddressFor(mac), expires, signBootURL(mac, "boot.efi", expires)); err == nil {
+		t.Fatalf("Wanted boot.efi's signature not to unlock other files")
+	}
+
+	past := now.Add(-time.Second).Unix()
+	if err := request(mac, allocator.AddressFor(mac), past, signBootURL(mac, "boot.efi", past)); err == nil {
+		t.Fatalf("Wanted an expired URL to be refused")
+	}
+}
+
+func TestSignRenderedBootURL(t *testing.T) {
+	bootURLKey = []byte("hunter2")
+	defer func() { bootURLKey = nil }()
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	now := time.Unix(1760000000, 0)
+	expires := now.Add(*bootURLTTL).Unix()
+
+	signed := signRenderedBootURL("http://[fec0::]/mac/04:42:1a:03:9b:20/boot.efi?rack=r1", mac, now)
+	want := "http://[fec0::]/mac/04:42:1a:03:9b:20/boot.efi?rack=r1&expires=" + strconv.FormatInt(expires, 10) +
+		"&signature=" + signBootURL(mac, "boot.efi", expires)
+	if signed != want {
+		t.Fatalf("Wanted %s,\ngot: %s", want, signed)
+	}
+
+	// MAC-less paths are signed for the file they name
+	signed = signRenderedBootURL("http://[fec0::]/uki/boot.efi", mac, now)
+	if want := signBootURL(mac, "uki/boot.efi", expires); !strings.HasSuffix(signed, "&signature="+want) {
+		t.Fatalf("Wanted a signature for uki/boot.efi, got %s", signed)
+	}
+
+	// Templates which sign the URL themselves are left alone
+	templated := "http://[fec0::]/mac/04:42:1a:03:9b:20/boot.efi?expires=1&signature=abc"
+	if signed := signRenderedBootURL(templated, mac, now); signed != templated {
+		t.Fatalf("Wanted the template's signature kept, got %s", signed)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// resolveMAC finds the MAC a request is for. Without a MAC in the path, it is
+// recovered from the source address, which we derived from the MAC. With
+// requireMatch, a MAC in the path must be the source address' own.
+func resolveMAC(a *Allocator, pathMAC net.HardwareAddr, source net.IP, requireMatch bool) (net.HardwareAddr, error) {
+	if pathMAC != nil && !requireMatch {
+		return pathMAC, nil
+	}
+
+	sourceMAC, err := a.MACFor(source)
+	if err != nil {
+		return nil, fmt.Errorf("finding the MAC of the source address: %w", err)
+	}
+
+	if pathMAC != nil && !bytes.Equal(pathMAC, sourceMAC) {
+		return nil, fmt.Errorf("requested %s, but the source address belongs to %s", pathMAC, sourceMAC)
+	}
+
+	return sourceMAC, nil
+}
@@ -0,0 +1,129 @@
+#!/usr/bin/env bash
+# Regenerates the Authenticode fixtures: an RSA CA, a signer it issued, and
+# signed.efi, unsigned.efi signed by the signer.
+#
+# signed.efi is made with sbsign when it's installed. Otherwise the PKCS#7
+# SignedData is put together by hand here, as sbsign and osslsigncode do, and
+# signed with openssl, so the fixture doesn't come from the code it tests.
+set -euo pipefail
+cd "$(dirname "$0")"
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 36500 -sha256 \
+  -subj "/CN=Test Secure Boot CA" -keyout ca.key -out ca.pem
+openssl req -newkey rsa:2048 -nodes -sha256 \
+  -subj "/CN=Test Secure Boot Signer" -keyout signer.key -out signer.csr
+openssl x509 -req -in signer.csr -CA ca.pem -CAkey ca.key -set_serial 0x2a \
+  -days 36500 -sha256 -out signer.pem
+rm signer.csr ca.key
+
+if command -v sbsign >/dev/null; then
+  sbsign --key signer.key --cert signer.pem --output signed.efi unsigned.efi
+  rm signer.key
+  exit
+fi
+
+python3 - <<'EOF'
+import hashlib, struct, subprocess
+
+def der(tag, content):
+    n = len(content)
+    if n < 0x80:
+        length = bytes([n])
+    else:
+        b = n.to_bytes((n.bit_length() + 7) // 8, "big")
+        length = bytes([0x80 | len(b)]) + b
+    return bytes([tag]) + length + content
+
+def split(b):
+    """Splits the first TLV of b into its contents and the rest of b"""
+    if b[1] < 0x80:
+        n, h = b[1], 2
+    else:
+        k = b[1] & 0x7f
+        n, h = int.from_bytes(b[2:2 + k], "big"), 2 + k
+    return b[h:h + n], b[h + n:]
+
+def tlvs(b):
+    while b:
+        contents, rest = split(b)
+        yield b[:len(b) - len(rest)]
+        b = rest
+
+def seq(*parts): return der(0x30, b"".join(parts))
+def oid(dotted):
+    parts = [int(p) for p in dotted.split(".")]
+    out = bytes([40 * parts[0] + parts[1]])
+    for p in parts[2:]:
+        b = [p & 0x7f]
+        while p > 0x7f:
+            p >>= 7
+            b.insert(0, 0x80 | (p & 0x7f))
+        out += bytes(b)
+    return der(0x06, out)
+
+NULL = b"\x05\x00"
+SHA256 = seq(oid("2.16.840.1.101.3.4.2.1"), NULL)
+
+pe = bytearray(open("unsigned.efi", "rb").read())
+pe += b"\0" * (-len(pe) % 8)
+
+# The Authenticode hash skips the checksum and the certificate table entry
+lfanew = struct.unpack_from("<I", pe, 0x3c)[0]
+optional = lfanew + 4 + 20
+magic = struct.unpack_from("<H", pe, optional)[0]
+checksum = optional + 64
+certdir = optional + (112 if magic == 0x20b else 96) + 4 * 8
+digest = hashlib.sha256(pe[:checksum] + pe[checksum + 4:certdir] + pe[certdir + 8:]).digest()
+
+obsolete = "<<<Obsolete>>>".encode("utf-16-be")
+pe_image_data = seq(der(0x03, b"\x00"), der(0xa0, der(0xa2, der(0x80, obsolete))))
+indirect = seq(
+    seq(oid("1.3.6.1.4.1.311.2.1.15"), pe_image_data),
+    seq(SHA256, der(0x04, digest)),
+)
+
+# Authenticode signs the content without its tag and length
+inner = indirect[len(indirect) - len(split(indirect)[0]):]
+attrs = [
+    seq(oid("1.2.840.113549.1.9.3"), der(0x31, oid("1.3.6.1.4.1.311.2.1.4"))),
+    seq(oid("1.3.6.1.4.1.311.2.1.12"), der(0x31, seq())),
+    seq(oid("1.2.840.113549.1.9.4"), der(0x31, der(0x04, hashlib.sha256(inner).digest()))),
+]
+signed_attrs = der(0x31, b"".join(sorted(attrs)))
+signature = subprocess.run(
+    ["openssl", "dgst", "-sha256", "-sign", "signer.key"],
+    input=signed_attrs, capture_output=True, check=True).stdout
+
+cert = subprocess.run(
+    ["openssl", "x509", "-in", "signer.pem", "-outform", "DER"],
+    capture_output=True, check=True).stdout
+# The serial and issuer are the certificate's TBS fields after the version,
+# if it has one
+fields = list(tlvs(split(split(cert)[0])[0]))
+if fields[0][0] == 0xa0:
+    fields = fields[1:]
+serial, _, issuer = fields[:3]
+
+signer_info = seq(
+    der(0x02, b"\x01"),
+    seq(issuer, serial),
+    SHA256,
+    der(0xa0, b"".join(sorted(attrs))),
+    seq(oid("1.2.840.113549.1.1.1"), NULL),
+    der(0x04, signature),
+)
+signed_data = seq(
+    der(0x02, b"\x01"),
+    der(0x31, SHA256),
+    seq(oid("1.3.6.1.4.1.311.2.1.4"), der(0xa0, indirect)),
+    der(0xa0, cert),
+    der(0x31, signer_info),
+)
+pkcs7 = seq(oid("1.2.840.113549.1.7.2"), der(0xa0, signed_data))
+pkcs7 += b"\0" * (-len(pkcs7) % 8)
+
+table = struct.pack("<IHH", 8 + len(pkcs7), 0x0200, 2) + pkcs7
+struct.pack_into("<II", pe, certdir, len(pe), len(table))
+open("signed.efi", "wb").write(pe + table)
+EOF
+rm signer.key
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+// tftpFileEvent is the event transfers from the TFTP root are reported as.
+const tftpFileEvent = "tftp_fetch_file"
+
+// tftpFileDirs are the directories a TFTP file is looked up in: the
+// machine's own directory under the root, then the root itself.
+func tftpFileDirs(tftpRoot string, mac net.HardwareAddr) []string {
+	if tftpRoot == "" {
+		return nil
+	}
+
+	if mac == nil {
+		return []string{tftpRoot}
+	}
+
+	return []string{filepath.Join(tftpRoot, mac.String()), tftpRoot}
+}
+
+// serveTFTPFile serves filename from the TFTP root, for tools which can only
+// fetch over TFTP. Like the iPXE binary, the path may start with the MAC, or
+// the MAC is recovered from the client's source address. Clients whose MAC
+// can't be recovered only get the shared files in the root.
+func serveTFTPFile(a *Allocator, tftpRoot, filename string, rf io.ReaderFrom) error {
+	source := rf.(tftp.OutgoingTransfer).RemoteAddr()
+
+	// Plenty of clients ask for absolute paths
+	rel := strings.TrimLeft(filename, "/")
+
+	var pathMAC net.HardwareAddr
+	if mac, err := parseMACFromPath(rel); err == nil {
+		pathMAC = mac
+		_, rel, _ = strings.Cut(rel, "/")
+	}
+
+	var machine *Machine
+	mac, err := resolveMAC(a, pathMAC, source.IP, *requireSourceMAC)
+	if err != nil && pathMAC != nil {
+		log.Printf("Refusing %s from %s: %v", filename, source.String(), err)
+		machines.GetOrInitMachine(pathMAC).Notify("tftp_fetch_denied", TransferEvent{
+			Protocol: "tftp",
+			Filename: filename,
+			State:    "denied",
+			Error:    err.Error(),
+		})
+		return err
+	} else if err == nil {
+		machine = machines.GetOrInitMachine(mac)
+	}
+
+	if !fs.ValidPath(rel) || rel == "." {
+		log.Printf("Refusing %s from %s: invalid path", filename, source.String())
+		if machine != nil {
+			machine.Notify("tftp_fetch_denied", TransferEvent{
+				Protocol: "tftp",
+				Filename: filename,
+				State:    "denied",
+				Error:    "invalid path",
+			})
+		}
+		return fmt.Errorf("invalid path %q", filename)
+	}
+
+	dirs := tftpFileDirs(tftpRoot, mac)
+
+	f, stat, dir, err := openTreeFile(dirs, rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Can't serve %s to %s: no such file", filename, source.String())
+		if machine != nil {
+			machine.Notify("boot_file_missing", BootFileMissingEvent{
+				Protocol:    "tftp",
+				Filename:    rel,
+				Directories: dirs,
+			})
+		}
+		// The TFTP server sends every error as "file not found"
+		return fmt.Errorf("file not found: %q", filename)
+	} else if err != nil {
+		log.Printf("Can't serve %s to %s: %v", filename, source.String(), err)
+		return err
+	}
+	defer f.Close()
+
+	name := path.Join(dir, rel)
+
+	sum, err := fileSHA256(name, f, stat)
+	if err != nil {
+		log.Printf("Not serving %s: %v", name, err)
+		return err
+	}
+
+	event := TransferEvent{
+		Protocol:   "tftp",
+		Filename:   name,
+		Directory:  dir,
+		SHA256:     sha256Hex(sum),
+		State:      "init",
+		TotalBytes: stat.Size(),
+	}
+
+	record := func() {
+		if machine != nil {
+			recordTransfer(context.Background(), machine, tftpFileEvent, event)
+		}
+	}
+
+	// Clients we can't tell apart share their address's limits
+	client := source.IP.String()
+	if mac != nil {
+		client = mac.String()
+	}
+
+	slot, err := acquireTransferSlot(context.Background(), client, source.String()+" "+name, &event, record)
+	if errors.Is(err, errDuplicateTransfer) {
+		// The first request's transfer is done, so the client won't see
+		// the error the server answers this one with
+		log.Printf("Dropped a retransmitted request for %s from %s", name, source.String())
+		return err
+	} else if err != nil {
+		log.Printf("Not serving %s to %s: %v", name, source.String(), err)
+		event.State = "refused"
+		event.Error = err.Error()
+		record()
+		return err
+	}
+	defer slot.Release()
+
+	log.Printf("Serving %s to %s", name, source.String())
+	record()
+
+	event.State = "sending"
+	rf.(tftp.OutgoingTransfer).SetSize(stat.Size())
+
+	var throttle transferThrottle
+	throttled := slot.Reader(context.Background(), f, func() {
+		if throttle.wait() {
+			event.State = "throttled"
+			record()
+		}
+	})
+
+	r := newProgressReader(throttled, func(bytes int64) error {
+		event.SentBytes = bytes
+		event.State = throttle.progressState()
+		record()
+		return nil
+	})
+	start := time.Now()
+	stop := tftpStats.watch(source)
+	n, err := rf.ReadFrom(r)
+	event.SentBytes = n
+	finishTFTPTransfer(&event, stop(), start)
+	if err != nil {
+		event.State = "error"
+		event.Error = err.Error()
+		record()
+		log.Printf("Serving failure: %v", err)
+		return err
+	}
+
+	event.State = "complete"
+	record()
+	log.Printf("%d bytes sent for %s", n, name)
+	return nil
+}
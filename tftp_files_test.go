@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeTFTPFile(t *testing.T) {
+	broker := NewBroker()
+	machines = NewMachines(broker)
+
+	root := t.TempDir()
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	other, _ := net.ParseMAC("04:42:1a:03:9b:21")
+
+	for name, data := range map[string]string{
+		"pxelinux.cfg/default":                 "shared",
+		"memtest.bin":                          "memtest",
+		"chainload/ipxe.efi":                   "custom ipxe",
+		mac.String() + "/pxelinux.cfg/default": "own",
+	} {
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(root), "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAllocator(net.ParseIP("fec0::"))
+	handler := tftpReadHandler(a, root)
+
+	subscriber, unsubscribe := broker.SubscribeBuffered(64)
+	defer unsubscribe()
+
+	for _, tc := range []struct {
+		filename string
+		source   net.IP
+		want     string
+	}{
+		{"pxelinux.cfg/default", a.AddressFor(mac), "own"},
+		{"/pxelinux.cfg/default", a.AddressFor(other), "shared"},
+		{"pxelinux.cfg/default", net.ParseIP("2001:db8::1"), "shared"},
+		{mac.String() + "/memtest.bin", net.ParseIP("2001:db8::1"), "memtest"},
+		// Only an architecture before an iPXE binary's name makes it ours
+		{"chainload/ipxe.efi", a.AddressFor(mac), "custom ipxe"},
+		{"../secret", a.AddressFor(mac), ""},
+		{"missing.bin", a.AddressFor(mac), ""},
+	} {
+		rf := &fakeTransfer{remote: net.UDPAddr{IP: tc.source, Port: 1234}}
+
+		err := handler(tc.filename, rf)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: wanted an error, served %q", tc.filename, rf.buf.String())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.filename, err)
+		} else if rf.buf.String() != tc.want || rf.size != int64(len(tc.want)) {
+			t.Errorf("%s: served %q (%d bytes), wanted %q", tc.filename, rf.buf.String(), rf.size, tc.want)
+		}
+	}
+
+	var fetched, missing bool
+	for !fetched || !missing {
+		ev := <-subscriber
+		switch ev.Event.Event {
+		case tftpFileEvent:
+			detail := ev.Event.Detail.(TransferEvent)
+			fetched = fetched || detail.State == "complete" && detail.Protocol == "tftp"
+		case "boot_file_missing":
+			detail := ev.Event.Detail.(BootFileMissingEvent)
+			if detail.Filename != "missing.bin" || detail.Protocol != "tftp" || len(detail.Directories) != 2 {
+				t.Fatalf("Wrong boot_file_missing: %+v", detail)
+			}
+			missing = true
+		}
+	}
+
+	// Without a root, only the iPXE binary is served
+	rf := &fakeTransfer{remote: net.UDPAddr{IP: a.AddressFor(mac), Port: 1234}}
+	if err := tftpReadHandler(a, "")("memtest.bin", rf); err == nil {
+		t.Fatalf("Wanted an error without a TFTP root")
+	}
+}
@@ -3,43 +3,156 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pin/tftp/v3"
 )
 
-// global buffer that replaces the old ipxe_efi_x86_64 const
-var ipxeX8664Efi []byte
+// iPXE binaries to serve over TFTP, by their flavor and the client
+// architecture they're for. IPXEWatcher replaces them as their files change.
+var (
+	ipxeBinariesMu sync.RWMutex
+	ipxeBinaries   = make(map[ipxeBinaryKey][]byte)
+)
 
 // call this at startup, before you create the TFTP server
-func LoadIPXEBinary(path string) error {
+func LoadIPXEBinary(key ipxeBinaryKey, path string) error {
+	data, err := readIPXEBinary(path)
+	if err != nil {
+		return err
+	}
+
+	ipxeBinariesMu.Lock()
+	ipxeBinaries[key] = data
+	ipxeBinariesMu.Unlock()
+
+	log.Printf("Loaded iPXE binary %q for %s (%d bytes)", path, key, len(data))
+	return nil
+}
+
+func readIPXEBinary(path string) ([]byte, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("reading iPXE binary %q: %w", path, err)
+		return nil, fmt.Errorf("reading iPXE binary %q: %w", path, err)
 	}
 
 	if len(data) == 0 {
-		return fmt.Errorf("iPXE binary %q is empty", path)
+		return nil, fmt.Errorf("iPXE binary %q is empty", path)
 	}
 
-	ipxeX8664Efi = data
-	log.Printf("Loaded iPXE binary %q (%d bytes)", path, len(ipxeX8664Efi))
-	return nil
+	return data, nil
+}
+
+// ipxeBinary is the iPXE binary for key, if we have one.
+func ipxeBinary(key ipxeBinaryKey) ([]byte, bool) {
+	ipxeBinariesMu.RLock()
+	defer ipxeBinariesMu.RUnlock()
+
+	binary, ok := ipxeBinaries[key]
+	return binary, ok
+}
+
+// tftpReadHandler serves `<mac>/<arch>/ipxe.efi`, and likewise the other
+// flavors' files, like `<mac>/<arch>/undionly.kpxe`. The older
+// `<mac>/ipxe.efi` form is served the EFI_X86_64 binary, and undionly.kpxe
+// the INTEL_X86PC one. Without the MAC, as in `<arch>/ipxe.efi` or
+// `ipxe.efi`, the MAC is recovered from the client's source address. Any
+// other file is served from tftpRoot, if it's set.
+func tftpReadHandler(a *Allocator, tftpRoot string) func(string, io.ReaderFrom) error {
+	return func(filename string, rf io.ReaderFrom) error {
+		if _, ok := ipxePathParts(filename); ok {
+			return serveIPXE(a, filename, rf)
+		}
+
+		return serveTFTPFile(a, tftpRoot, filename, rf)
+	}
+}
+
+// ipxePathParts splits an iPXE path after its MAC, if it has one, into the
+// optional architecture and the flavor's file. Files like `foo/ipxe.efi`,
+// where foo isn't an architecture, aren't iPXE paths.
+func ipxePathParts(filename string) ([]string, bool) {
+	parts := strings.Split(filename, "/")
+	if _, err := parseMACFromPath(filename); err == nil {
+		parts = parts[1:]
+	}
+
+	if len(parts) < 1 || len(parts) > 2 {
+		return nil, false
+	}
+
+	if _, ok := ipxeFlavorOfFile(parts[len(parts)-1]); !ok {
+		return nil, false
+	}
+
+	if len(parts) == 2 {
+		if _, err := parseArch(parts[0]); err != nil {
+			return nil, false
+		}
+	}
+
+	return parts, true
 }
 
-func tftpReadHandler(filename string, rf io.ReaderFrom) error {
-	mac, err := parseMACFromPath(filename)
+func serveIPXE(a *Allocator, filename string, rf io.ReaderFrom) error {
+	parts, ok := ipxePathParts(filename)
+	if !ok {
+		log.Println("Can't serve ", filename)
+		return fmt.Errorf("no such file %q", filename)
+	}
+
+	var pathMAC net.HardwareAddr
+	if mac, err := parseMACFromPath(filename); err == nil {
+		pathMAC = mac
+	}
+
+	source := rf.(tftp.OutgoingTransfer).RemoteAddr()
+	mac, err := resolveMAC(a, pathMAC, source.IP, *requireSourceMAC)
 	if err != nil {
-		log.Println("Can't parse a MAC from ", filename, err)
+		log.Printf("Refusing %s from %s: %v", filename, source.String(), err)
+		if pathMAC != nil {
+			machines.GetOrInitMachine(pathMAC).Notify("tftp_fetch_denied", TransferEvent{
+				Protocol: "tftp",
+				Filename: filename,
+				State:    "denied",
+				Error:    err.Error(),
+			})
+		}
+		return err
+	}
+
+	machine := machines.GetOrInitMachine(mac)
+
+	flavor, _ := ipxeFlavorOfFile(parts[len(parts)-1])
+	arch := flavor.defaultArch()
+	if len(parts) == 2 {
+		// ipxePathParts checked it's an architecture
+		arch, _ = parseArch(parts[0])
+	}
+
+	binary, ok := ipxeBinary(ipxeBinaryKey{flavor: flavor, arch: arch})
+	if !ok {
+		err := fmt.Errorf("no %s iPXE binary is configured for %s", flavor, archName(arch))
+		machine.Notify("unsupported_arch", UnsupportedArchEvent{
+			Protocol:      "tftp",
+			Architectures: []string{archName(arch)},
+			Filename:      filename,
+			Error:         err.Error(),
+		})
 		return err
 	}
 
 	log.Println("Serving ", filename)
 
-	underlying_reader := bytes.NewReader(ipxeX8664Efi)
+	underlying_reader := bytes.NewReader(binary)
 
 	tftpevent := TransferEvent{
 		Protocol:   "tftp",
@@ -47,21 +160,51 @@ func tftpReadHandler(filename string, rf io.ReaderFrom) error {
 		State:      "init",
 		TotalBytes: underlying_reader.Size(),
 		SentBytes:  0,
+		IPXEFlavor: string(flavor),
 	}
 
-	machine := machines.GetOrInitMachine(mac)
+	slot, err := acquireTransferSlot(context.Background(), mac.String(), source.String()+" "+filename, &tftpevent, func() {
+		machine.Event(context.Background(), "serve_ipxe_over_tftp", tftpevent)
+	})
+	if errors.Is(err, errDuplicateTransfer) {
+		// The first request's transfer is done, so the client won't see
+		// the error the server answers this one with
+		log.Printf("Dropped a retransmitted request for %s from %s", filename, source.String())
+		return err
+	} else if err != nil {
+		log.Printf("Not serving %s: %v", filename, err)
+		tftpevent.State = "refused"
+		tftpevent.Error = err.Error()
+		machine.Event(context.Background(), "serve_ipxe_over_tftp", tftpevent)
+		return err
+	}
+	defer slot.Release()
+
 	machine.Event(context.Background(), "serve_ipxe_over_tftp", tftpevent)
 
 	tftpevent.State = "sending"
 
 	rf.(tftp.OutgoingTransfer).SetSize(underlying_reader.Size())
 
-	r := newProgressReader(underlying_reader, func(bytes int64) error {
+	var throttle transferThrottle
+	throttled := slot.Reader(context.Background(), underlying_reader, func() {
+		if throttle.wait() {
+			tftpevent.State = "throttled"
+			machine.Event(context.Background(), "serve_ipxe_over_tftp", tftpevent)
+		}
+	})
+
+	r := newProgressReader(throttled, func(bytes int64) error {
 		tftpevent.SentBytes = bytes
+		tftpevent.State = throttle.progressState()
 		machine.Event(context.Background(), "serve_ipxe_over_tftp", tftpevent)
 		return nil
 	})
+	start := time.Now()
+	stop := tftpStats.watch(source)
 	n, err := rf.ReadFrom(r)
+	tftpevent.SentBytes = n
+	finishTFTPTransfer(&tftpevent, stop(), start)
 	if err != nil {
 		tftpevent.State = "error"
 		tftpevent.Error = err.Error()
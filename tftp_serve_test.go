@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// fakeTransfer stands in for the TFTP server's tftp.OutgoingTransfer.
+type fakeTransfer struct {
+	remote net.UDPAddr
+	size   int64
+	buf    bytes.Buffer
+}
+
+func (t *fakeTransfer) SetSize(n int64)                     { t.size = n }
+func (t *fakeTransfer) RemoteAddr() net.UDPAddr             { return t.remote }
+func (t *fakeTransfer) ReadFrom(r io.Reader) (int64, error) { return t.buf.ReadFrom(r) }
+
+func TestServeIPXEBySourceAddress(t *testing.T) {
+	machines = NewMachines(NewBroker())
+	ipxeBinaries = map[ipxeBinaryKey][]byte{
+		{ipxeFull, iana.EFI_X86_64}:      []byte("x86-64"),
+		{ipxeFull, iana.EFI_ARM64}:       []byte("arm64"),
+		{ipxeSNPOnly, iana.EFI_X86_64}:   []byte("snponly"),
+		{ipxeUNDIOnly, iana.INTEL_X86PC}: []byte("undionly"),
+	}
+	defer func() { ipxeBinaries = make(map[ipxeBinaryKey][]byte) }()
+
+	a := NewAllocator(net.ParseIP("fec0::"))
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	other, _ := net.ParseMAC("04:42:1a:03:9b:21")
+
+	for _, tc := range []struct {
+		filename     string
+		requireMatch bool
+		want         string
+	}{
+		{"ipxe.efi", false, "x86-64"},
+		{"EFI_ARM64/ipxe.efi", false, "arm64"},
+		{mac.String() + "/EFI_ARM64/ipxe.efi", true, "arm64"},
+		{other.String() + "/ipxe.efi", false, "x86-64"},
+		{other.String() + "/ipxe.efi", true, ""},
+		{"boot.efi", false, ""},
+		{"snponly.efi", false, "snponly"},
+		{mac.String() + "/INTEL_X86PC/undionly.kpxe", false, "undionly"},
+		{"undionly.kpxe", false, "undionly"},
+		{"EFI_ARM64/snponly.efi", false, ""},
+	} {
+		*requireSourceMAC = tc.requireMatch
+		rf := &fakeTransfer{remote: net.UDPAddr{IP: a.AddressFor(mac), Port: 1234}}
+
+		err := serveIPXE(a, tc.filename, rf)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: wanted an error", tc.filename)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.filename, err)
+		} else if rf.buf.String() != tc.want {
+			t.Errorf("%s: served %q, wanted %q", tc.filename, rf.buf.String(), tc.want)
+		}
+	}
+	*requireSourceMAC = false
+
+	if machines.GetMachine(mac) == nil {
+		t.Fatalf("Wanted the source address' machine to be tracked")
+	}
+}
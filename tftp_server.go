@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+const (
+	// The block size TFTP uses unless the client negotiates another
+	tftpDefaultBlockSize = 512
+	// The largest block size which fits in a UDP datagram
+	tftpLargestBlockSize = 65464
+)
+
+func newTFTPServer(a *Allocator, tftpRoot string) *tftp.Server {
+	// Without uploads, the server refuses writes
+	var write func(string, io.WriterTo) error
+	if uploads != nil {
+		write = tftpWriteHandler(a, uploads)
+	}
+
+	server := tftp.NewServer(tftpReadHandler(a, tftpRoot), write)
+	server.SetTimeout(*tftpTimeout)
+	server.SetRetries(*tftpRetries)
+	blockSize := *tftpMaxBlockSize
+	if blockSize == 0 && *tftpSinglePort {
+		// In single port mode, the server takes no limit to mean 512
+		blockSize = tftpLargestBlockSize
+	}
+	server.SetBlockSize(blockSize)
+	// This sends blocks ahead of the acknowledgements, but doesn't
+	// negotiate the RFC 7440 windowsize option, which the library doesn't
+	// support
+	server.SetAnticipate(*tftpWindowSize)
+	if *tftpSinglePort {
+		server.EnableSinglePort()
+	}
+	server.SetHook(tftpStats)
+
+	return server
+}
+
+// tftpStatsHook collects the TFTP server's statistics of the transfers our
+// handlers are waiting on, by the client's address.
+type tftpStatsHook struct {
+	mu      sync.Mutex
+	pending map[string]*tftp.TransferStats
+}
+
+var tftpStats = &tftpStatsHook{pending: make(map[string]*tftp.TransferStats)}
+
+func (h *tftpStatsHook) OnSuccess(stats tftp.TransferStats) {
+	h.record(stats)
+}
+
+func (h *tftpStatsHook) OnFailure(stats tftp.TransferStats, err error) {
+	h.record(stats)
+}
+
+func (h *tftpStatsHook) record(stats tftp.TransferStats) {
+	key := (&net.UDPAddr{IP: stats.RemoteAddr, Port: stats.Tid}).String()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.pending[key]; ok {
+		h.pending[key] = &stats
+	}
+}
+
+// watch collects the statistics of the transfer to addr. The returned
+// function stops, returning them if the server reported any.
+func (h *tftpStatsHook) watch(addr net.UDPAddr) func() *tftp.TransferStats {
+	key := addr.String()
+
+	h.mu.Lock()
+	h.pending[key] = nil
+	h.mu.Unlock()
+
+	return func() *tftp.TransferStats {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		stats := h.pending[key]
+		delete(h.pending, key)
+		return stats
+	}
+}
+
+// finishTFTPTransfer records a finished transfer's telemetry in event: the
+// block size if the client negotiated one, the window size it was sent with,
+// and the retransmits if the server counted them. Without the server's
+// statistics, it's timed from start.
+func finishTFTPTransfer(event *TransferEvent, stats *tftp.TransferStats, start time.Time) {
+	if stats == nil {
+		event.finished(time.Since(start))
+		return
+	}
+
+	if n, err := strconv.Atoi(stats.Opts["blksize"]); err == nil {
+		event.BlockSize = n
+	}
+	// Sending a window at a time, the server doesn't count datagrams
+	if stats.SenderAnticipateEnabled {
+		event.WindowSize = int(*tftpWindowSize)
+	} else {
+		event.WindowSize = 1
+		event.Retransmits = max(stats.DatagramsSent-stats.DatagramsAcked, 0)
+	}
+	event.finished(stats.Duration)
+}
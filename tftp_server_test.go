@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/pin/tftp/v3"
+)
+
+func TestTFTPTransferTelemetry(t *testing.T) {
+	broker := NewBroker()
+	machines = NewMachines(broker)
+	ipxeBinaries = map[ipxeBinaryKey][]byte{{ipxeFull, iana.EFI_X86_64}: bytes.Repeat([]byte("ipxe"), 1000)}
+	defer func() { ipxeBinaries = make(map[ipxeBinaryKey][]byte) }()
+
+	*tftpMaxBlockSize = 1024
+	defer func() { *tftpMaxBlockSize = 0 }()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTFTPServer(NewAllocator(net.ParseIP("fec0::")), "")
+	go server.Serve(conn)
+	defer server.Shutdown()
+
+	subscriber, unsubscribe := broker.SubscribeBuffered(64)
+	defer unsubscribe()
+
+	client, err := tftp.NewClient(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetBlockSize(1428)
+
+	wt, err := client.Receive("04:42:1a:03:9b:20/ipxe.efi", "octet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := wt.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 4000 {
+		t.Fatalf("Wanted 4000 bytes, got %d", buf.Len())
+	}
+
+	for {
+		var ev IdentifiedEvent
+		select {
+		case ev = <-subscriber:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the transfer to complete")
+		}
+
+		detail, ok := ev.Event.Detail.(TransferEvent)
+		if !ok || detail.State != "complete" {
+			continue
+		}
+
+		// The client asked for more than we agree to. Without the interface's
+		// MTU, the server doesn't go above 512 bytes.
+		if detail.BlockSize < 512 || detail.BlockSize > 1024 || detail.SentBytes != 4000 || detail.BytesPerSecond <= 0 || detail.IPXEFlavor != "ipxe" {
+			t.Fatalf("Wrong telemetry: %+v", detail)
+		}
+		break
+	}
+}
+
+func TestFinishTFTPTransfer(t *testing.T) {
+	event := TransferEvent{SentBytes: 3000}
+	finishTFTPTransfer(&event, &tftp.TransferStats{
+		Opts:           map[string]string{"blksize": "1428"},
+		Duration:       2 * time.Second,
+		DatagramsSent:  12,
+		DatagramsAcked: 9,
+	}, time.Now())
+
+	if event.BlockSize != 1428 || event.WindowSize != 1 || event.Retransmits != 3 || event.DurationMillis != 2000 || event.BytesPerSecond != 1500 {
+		t.Fatalf("Wrong telemetry: %+v", event)
+	}
+
+	// Without a negotiated block size or counted datagrams, neither is made up
+	*tftpWindowSize = 4
+	defer func() { *tftpWindowSize = 1 }()
+	event = TransferEvent{SentBytes: 3000}
+	finishTFTPTransfer(&event, &tftp.TransferStats{
+		SenderAnticipateEnabled: true,
+		Duration:                2 * time.Second,
+		DatagramsSent:           12,
+	}, time.Now())
+
+	if event.BlockSize != 0 || event.Retransmits != 0 || event.WindowSize != 4 {
+		t.Fatalf("Wanted only what was negotiated or counted, got %+v", event)
+	}
+}
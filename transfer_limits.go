@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// transferBurst is how far ahead of its rate a bucket lets transfers get,
+// and the most a throttled read reads at once.
+const transferBurst = 64 * 1024
+
+var (
+	errQueueTimeout      = errors.New("timed out waiting in the transfer queue")
+	errDuplicateTransfer = errors.New("the same transfer was already requested")
+)
+
+// TransferLimits bound boot file transfers over HTTP and TFTP: how many may
+// run at once, and how fast they may go, altogether and per client. A zero
+// limit is no limit. Transfers waiting for a slot are queued fairly: clients
+// take turns, and each client's transfers go in the order they came.
+//
+// A nil *TransferLimits doesn't limit anything.
+type TransferLimits struct {
+	maxActive          int
+	maxActivePerClient int
+	ratePerClient      int64
+	// rate is the bucket all transfers draw from, if there's a global rate
+	rate *tokenBucket
+
+	mu     sync.Mutex
+	active int
+	// clients are the clients with transfers running or queued
+	clients map[string]*transferClient
+	// turns are the clients with queued transfers, in the order they get
+	// their next turn
+	turns []string
+	// keys are the keys of the queued and running transfers which have one,
+	// each with a channel closed once the transfer is done
+	keys map[string]chan struct{}
+}
+
+type transferClient struct {
+	active int
+	queue  []chan struct{}
+	// rate is the bucket the client's transfers draw from, if there's a per
+	// client rate
+	rate *tokenBucket
+}
+
+var transferLimits *TransferLimits
+
+func NewTransferLimits(maxActive, maxActivePerClient int, rate, ratePerClient int64) *TransferLimits {
+	l := &TransferLimits{
+		maxActive:          maxActive,
+		maxActivePerClient: maxActivePerClient,
+		ratePerClient:      ratePerClient,
+		clients:            make(map[string]*transferClient),
+		keys:               make(map[string]chan struct{}),
+	}
+	if rate > 0 {
+		l.rate = newTokenBucket(rate)
+	}
+
+	return l
+}
+
+// TransferSlot is a transfer's place among the running transfers.
+type TransferSlot struct {
+	limits *TransferLimits
+	client string
+	key    string
+	// rates are the buckets the transfer draws from
+	rates []*tokenBucket
+}
+
+// Acquire waits for a slot for one of client's transfers. If it has to wait,
+// onQueued is called first, with the number of transfers waiting including
+// this one.
+//
+// A transfer with a key is a duplicate while another with the same key is
+// queued or running. Rather than taking a slot, it waits for the other to be
+// done, and then fails with errDuplicateTransfer. Retransmitted TFTP
+// requests are duplicates, which mustn't be answered while the client waits
+// for the first.
+func (l *TransferLimits) Acquire(ctx context.Context, client, key string, onQueued func(position int)) (*TransferSlot, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+
+	if done, ok := l.keys[key]; ok && key != "" {
+		l.mu.Unlock()
+		<-done
+		return nil, errDuplicateTransfer
+	}
+	if key != "" {
+		l.keys[key] = make(chan struct{})
+	}
+
+	c := l.clients[client]
+	if c == nil {
+		c = &transferClient{}
+		if l.ratePerClient > 0 {
+			c.rate = newTokenBucket(l.ratePerClient)
+		}
+		l.clients[client] = c
+	}
+
+	// Don't overtake the client's own queued transfers
+	if len(c.queue) == 0 && l.canStart(c) {
+		l.start(c)
+		l.mu.Unlock()
+		return l.slot(client, key, c), nil
+	}
+
+	ready := make(chan struct{})
+	if len(c.queue) == 0 {
+		l.turns = append(l.turns, client)
+	}
+	c.queue = append(c.queue, ready)
+
+	position := 0
+	for _, c := range l.clients {
+		position += len(c.queue)
+	}
+	l.mu.Unlock()
+
+	if onQueued != nil {
+		onQueued(position)
+	}
+
+	select {
+	case <-ready:
+		return l.slot(client, key, c), nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.done(key)
+	for i, queued := range c.queue {
+		if queued == ready {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			l.forget(client, c)
+			return nil, errQueueTimeout
+		}
+	}
+
+	// We got the slot while giving up on it
+	l.finish(client, c)
+	return nil, errQueueTimeout
+}
+
+// done lets the duplicates of the transfer with key fail.
+func (l *TransferLimits) done(key string) {
+	if done, ok := l.keys[key]; ok && key != "" {
+		close(done)
+		delete(l.keys, key)
+	}
+}
+
+func (l *TransferLimits) slot(client, key string, c *transferClient) *TransferSlot {
+	s := &TransferSlot{limits: l, client: client, key: key}
+	for _, rate := range []*tokenBucket{l.rate, c.rate} {
+		if rate != nil {
+			s.rates = append(s.rates, rate)
+		}
+	}
+	return s
+}
+
+func (l *TransferLimits) canStart(c *transferClient) bool {
+	return (l.maxActive == 0 || l.active < l.maxActive) &&
+		(l.maxActivePerClient == 0 || c.active < l.maxActivePerClient)
+}
+
+func (l *TransferLimits) start(c *transferClient) {
+	l.active++
+	c.active++
+}
+
+// finish frees a transfer's slot, and hands it on.
+func (l *TransferLimits) finish(client string, c *transferClient) {
+	l.active--
+	c.active--
+	l.forget(client, c)
+	l.dispatch()
+}
+
+// forget drops the client once it has nothing running or queued, and its
+// turn once it has nothing queued.
+func (l *TransferLimits) forget(client string, c *transferClient) {
+	if len(c.queue) == 0 {
+		for i, turn := range l.turns {
+			if turn == client {
+				l.turns = append(l.turns[:i], l.turns[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if c.active == 0 && len(c.queue) == 0 {
+		delete(l.clients, client)
+	}
+}
+
+// dispatch starts queued transfers while there are free slots, taking the
+// clients in turn.
+func (l *TransferLimits) dispatch() {
+	for started := true; started; {
+		started = false
+
+		for i, client := range l.turns {
+			c := l.clients[client]
+			if !l.canStart(c) {
+				continue
+			}
+
+			l.start(c)
+			close(c.queue[0])
+			c.queue = c.queue[1:]
+
+			// The client goes to the back of the line
+			l.turns = append(l.turns[:i], l.turns[i+1:]...)
+			if len(c.queue) > 0 {
+				l.turns = append(l.turns, client)
+			}
+
+			started = true
+			break
+		}
+	}
+}
+
+// Release frees the slot.
+func (s *TransferSlot) Release() {
+	if s == nil {
+		return
+	}
+
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+
+	s.limits.finish(s.client, s.limits.clients[s.client])
+	s.limits.done(s.key)
+}
+
+// Reader throttles r to the slot's rates. onThrottled is called each time
+// reading has to wait for them.
+func (s *TransferSlot) Reader(ctx context.Context, r io.Reader, onThrottled func()) io.Reader {
+	if s == nil || len(s.rates) == 0 {
+		return r
+	}
+
+	return &throttledReader{ctx: ctx, r: r, rates: s.rates, onThrottled: onThrottled}
+}
+
+type throttledReader struct {
+	ctx         context.Context
+	r           io.Reader
+	rates       []*tokenBucket
+	onThrottled func()
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > transferBurst {
+		b = b[:transferBurst]
+	}
+
+	n, err := t.r.Read(b)
+	if n == 0 {
+		return n, err
+	}
+
+	var wait time.Duration
+	for _, rate := range t.rates {
+		wait = max(wait, rate.take(n))
+	}
+
+	if wait > 0 {
+		if t.onThrottled != nil {
+			t.onThrottled()
+		}
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+
+	return n, err
+}
+
+// tokenBucket meters bytes at a rate. Takers may overdraw it, and then wait
+// for it to refill, so concurrent takers are served in order.
+type tokenBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: transferBurst,
+		last:   time.Now(),
+	}
+}
+
+// take draws n bytes, returning how long to wait before sending them.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(transferBurst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// transferThrottle follows whether a transfer is throttled, for its events.
+type transferThrottle struct {
+	throttled bool
+	// waited is whether the transfer was throttled since the last progress
+	// event
+	waited bool
+}
+
+// wait notes that the transfer was throttled, returning true the first time.
+func (t *transferThrottle) wait() bool {
+	t.waited = true
+	if t.throttled {
+		return false
+	}
+
+	t.throttled = true
+	return true
+}
+
+// progressState is the state of a progress event.
+func (t *transferThrottle) progressState() string {
+	defer func() { t.waited = false }()
+
+	if t.waited {
+		return "throttled"
+	}
+	return "sending"
+}
+
+// acquireTransferSlot waits for a slot for one of client's transfers,
+// recording it in event, and reporting it with record if it's queued. key is
+// as for Acquire.
+func acquireTransferSlot(ctx context.Context, client, key string, event *TransferEvent, record func()) (*TransferSlot, error) {
+	ctx, cancel := context.WithTimeout(ctx, *transferQueueTimeout)
+	defer cancel()
+
+	state := event.State
+	start := time.Now()
+
+	slot, err := transferLimits.Acquire(ctx, client, key, func(position int) {
+		event.State = "queued"
+		event.QueuePosition = position
+		record()
+	})
+
+	if event.State == "queued" {
+		event.State = state
+		event.QueuePosition = 0
+		event.QueuedMillis = time.Since(start).Milliseconds()
+	}
+
+	return slot, err
+}
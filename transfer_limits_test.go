@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/pin/tftp/v3"
+)
+
+func TestTransferLimitsQueueFairly(t *testing.T) {
+	l := NewTransferLimits(1, 0, 0, 0)
+
+	running, err := l.Acquire(context.Background(), "a", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a queues two transfers before b and c queue one each, but b and c get
+	// their turn before a's second
+	started := make(chan string)
+	positions := make(chan int)
+	var wg sync.WaitGroup
+	for _, client := range []string{"a", "a", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slot, err := l.Acquire(context.Background(), client, "", func(position int) { positions <- position })
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			started <- client
+			slot.Release()
+		}()
+		if position := <-positions; position < 1 {
+			t.Fatalf("Wanted a queue position, got %d", position)
+		}
+	}
+
+	running.Release()
+
+	var order []string
+	for range 4 {
+		order = append(order, <-started)
+	}
+	if want := []string{"a", "b", "c", "a"}; !slices.Equal(order, want) {
+		t.Fatalf("Wanted the clients to take turns %v, got %v", want, order)
+	}
+
+	wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.clients) != 0 || len(l.turns) != 0 || l.active != 0 {
+		t.Fatalf("Wanted nothing left once every transfer finished, got %v %v %d", l.clients, l.turns, l.active)
+	}
+}
+
+func TestTransferLimitsPerClient(t *testing.T) {
+	l := NewTransferLimits(0, 1, 0, 0)
+
+	a, err := l.Acquire(context.Background(), "a", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Release()
+
+	// Other clients aren't held up by a
+	b, err := l.Acquire(context.Background(), "b", "", func(int) { t.Error("Wanted b not to queue") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	queued := false
+	_, err = l.Acquire(ctx, "a", "", func(int) { queued = true })
+	if !queued || !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("Wanted a's second transfer to queue and time out, got %v", err)
+	}
+	if len(l.clients["a"].queue) != 0 || len(l.turns) != 0 {
+		t.Fatalf("Wanted the timed out transfer to leave the queue, got %v", l.turns)
+	}
+}
+
+func TestTransferLimitsDuplicates(t *testing.T) {
+	l := NewTransferLimits(1, 0, 0, 0)
+
+	running, err := l.Acquire(context.Background(), "a", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const key = "[fec0::1]:1024 boot.efi"
+
+	queued := make(chan *TransferSlot)
+	go func() {
+		slot, err := l.Acquire(context.Background(), "b", key, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		queued <- slot
+	}()
+
+	for {
+		l.mu.Lock()
+		waiting := len(l.turns)
+		l.mu.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A retransmitted request neither queues nor fails while the first is
+	// waiting or running
+	duplicate := make(chan error)
+	go func() {
+		_, err := l.Acquire(context.Background(), "b", key, func(int) { t.Error("Wanted the duplicate not to queue") })
+		duplicate <- err
+	}()
+
+	running.Release()
+	slot := <-queued
+
+	select {
+	case err := <-duplicate:
+		t.Fatalf("Wanted the duplicate to wait for the first transfer, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	slot.Release()
+	if err := <-duplicate; !errors.Is(err, errDuplicateTransfer) {
+		t.Fatalf("Wanted the duplicate dropped once the first was done, got %v", err)
+	}
+
+	// Once it's done, the same request is a new one
+	slot, err = l.Acquire(context.Background(), "b", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot.Release()
+
+	if len(l.clients) != 0 || len(l.turns) != 0 || len(l.keys) != 0 || l.active != 0 {
+		t.Fatalf("Wanted nothing left once every transfer finished, got %v %v %v %d", l.clients, l.turns, l.keys, l.active)
+	}
+}
+
+func TestTransferLimitsNil(t *testing.T) {
+	var l *TransferLimits
+
+	slot, err := l.Acquire(context.Background(), "a", "", nil)
+	if err != nil || slot != nil {
+		t.Fatalf("Wanted no limits, got %v %v", slot, err)
+	}
+	slot.Release()
+
+	r := &progressReader{}
+	if slot.Reader(context.Background(), r, nil) != r {
+		t.Fatal("Wanted the reader unthrottled")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1 << 20)
+
+	if wait := b.take(transferBurst); wait != 0 {
+		t.Fatalf("Wanted the burst for free, got a %v wait", wait)
+	}
+
+	// Another burst takes around 1/16s at 1MiB/s
+	wait := b.take(transferBurst)
+	if wait < 50*time.Millisecond || wait > 70*time.Millisecond {
+		t.Fatalf("Wanted a wait of about 62ms, got %v", wait)
+	}
+
+	// Overdrawing queues later takers behind earlier ones
+	if next := b.take(transferBurst); next <= wait {
+		t.Fatalf("Wanted the next taker to wait longer than %v, got %v", wait, next)
+	}
+}
+
+func TestServeQueuedTransfer(t *testing.T) {
+	dir := t.TempDir()
+	macDir := filepath.Join(dir, "04:42:1a:03:9b:20")
+	if err := os.MkdirAll(macDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(macDir, "root.squashfs"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	transferLimits = NewTransferLimits(1, 0, 0, 0)
+	defer func() { transferLimits = nil }()
+
+	timeout := *transferQueueTimeout
+	*transferQueueTimeout = 20 * time.Millisecond
+	defer func() { *transferQueueTimeout = timeout }()
+
+	mux, _, m := newTestWebserver(t, dir)
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/root.squashfs", nil))
+		return w
+	}
+
+	// Another client's transfer holds the only slot
+	other, err := transferLimits.Acquire(context.Background(), "other", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := get()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Wanted 503 once the queue timed out, got %d %v", w.Code, w.Header())
+	}
+
+	other.Release()
+
+	w = get()
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("Wanted the file once the slot was free, got %d %q", w.Code, w.Body.String())
+	}
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	var states []string
+	var queued TransferEvent
+	for _, ev := range m.GetMachine(mac).Events.Slice() {
+		if detail, ok := ev.Detail.(TransferEvent); ok && ev.Event == "http_fetch_file" {
+			states = append(states, detail.State)
+			if detail.State == "queued" {
+				queued = detail
+			}
+		}
+	}
+	if want := []string{"queued", "refused", "init", "complete"}; !slices.Equal(states, want) {
+		t.Fatalf("Wanted states %v, got %v", want, states)
+	}
+	if queued.QueuePosition != 1 {
+		t.Fatalf("Wanted the transfer first in the queue, got %+v", queued)
+	}
+}
+
+func TestServeQueuedTFTPRetransmit(t *testing.T) {
+	broker := NewBroker()
+	machines = NewMachines(broker)
+	ipxeBinaries = map[ipxeBinaryKey][]byte{
+		{ipxeFull, iana.EFI_X86_64}: bytes.Repeat([]byte("ipxe"), 1000),
+	}
+	defer func() { ipxeBinaries = make(map[ipxeBinaryKey][]byte) }()
+
+	transferLimits = NewTransferLimits(1, 0, 0, 0)
+	defer func() { transferLimits = nil }()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTFTPServer(NewAllocator(net.ParseIP("fec0::")), "")
+	go server.Serve(conn)
+	defer server.Shutdown()
+
+	// Another client's transfer holds the only slot
+	other, err := transferLimits.Acquire(context.Background(), "other", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := tftp.NewClient(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetTimeout(50 * time.Millisecond)
+	client.SetRetries(20)
+
+	received := make(chan error)
+	var buf bytes.Buffer
+	go func() {
+		wt, err := client.Receive("04:42:1a:03:9b:20/ipxe.efi", "octet")
+		if err == nil {
+			_, err = wt.WriteTo(&buf)
+		}
+		received <- err
+	}()
+
+	// The client sends its request again while it's queued
+	time.Sleep(300 * time.Millisecond)
+	other.Release()
+
+	if err := <-received; err != nil {
+		t.Fatalf("Wanted the queued transfer to complete, got %v", err)
+	}
+	if buf.Len() != 4000 {
+		t.Fatalf("Wanted the whole binary, got %d bytes", buf.Len())
+	}
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+	_, events := machines.GetMachine(mac).Snapshot()
+	var states []string
+	for _, ev := range events {
+		if detail, ok := ev.Detail.(TransferEvent); ok {
+			states = append(states, detail.State)
+		}
+	}
+	if states[0] != "queued" || slices.Contains(states, "refused") {
+		t.Fatalf("Wanted one queued transfer and nothing refused, got %v", states)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/pe"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// UKIInfo is the metadata embedded in a unified kernel image's PE sections.
+type UKIInfo struct {
+	// OSRelease is the os-release(5) file in .osrel, like {"ID": "nixos"}
+	OSRelease map[string]string `json:"os_release,omitempty"`
+	// Cmdline is the kernel command line in .cmdline
+	Cmdline string `json:"cmdline,omitempty"`
+	// Uname is the kernel release in .uname, like 6.12.1
+	Uname string `json:"uname,omitempty"`
+	// SBAT are the Secure Boot Advanced Targeting entries in .sbat
+	SBAT []SBATEntry `json:"sbat,omitempty"`
+}
+
+// SBATEntry is a line of an SBAT section, see
+// https://github.com/rhboot/shim/blob/main/SBAT.md
+type SBATEntry struct {
+	Component  string `json:"component"`
+	Generation string `json:"generation"`
+	Vendor     string `json:"vendor,omitempty"`
+	Package    string `json:"package,omitempty"`
+	Version    string `json:"version,omitempty"`
+	URL        string `json:"url,omitempty"`
+}
+
+// ukiInfos caches inspectUKI's results by the hex SHA-256 of the file. Files
+// which aren't UKIs are cached as nil.
+var ukiInfos sumCache[*UKIInfo]
+
+// ukiInfoFor inspects the file with the hex SHA-256 sum, if it isn't cached.
+func ukiInfoFor(sum string, r io.ReaderAt) *UKIInfo {
+	if info, ok := ukiInfos.get(sum); ok {
+		return info
+	}
+
+	info := inspectUKI(r)
+	ukiInfos.put(sum, info)
+	return info
+}
+
+// inspectUKI reads the metadata of a UKI. It returns nil if r isn't a PE/COFF
+// file with a .linux section.
+func inspectUKI(r io.ReaderAt) *UKIInfo {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	if f.Section(".linux") == nil {
+		return nil
+	}
+
+	info := &UKIInfo{}
+
+	if data := sectionString(f, ".osrel"); data != "" {
+		info.OSRelease = parseOSRelease(data)
+	}
+	info.Cmdline = strings.TrimSpace(sectionString(f, ".cmdline"))
+	info.Uname = strings.TrimSpace(sectionString(f, ".uname"))
+	info.SBAT = parseSBAT(sectionString(f, ".sbat"))
+
+	return info
+}
+
+// sectionString reads a section's contents, without the padding after them.
+func sectionString(f *pe.File, name string) string {
+	s := f.Section(name)
+	if s == nil {
+		return ""
+	}
+
+	data, err := s.Data()
+	if err != nil {
+		return ""
+	}
+
+	// The raw data is padded to the file alignment
+	if s.VirtualSize != 0 && int(s.VirtualSize) < len(data) {
+		data = data[:s.VirtualSize]
+	}
+
+	return string(bytes.TrimRight(data, "\x00"))
+}
+
+// parseOSRelease parses os-release(5) KEY=value lines, unquoting the values.
+func parseOSRelease(data string) map[string]string {
+	release := make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		release[key] = value
+	}
+
+	return release
+}
+
+// parseSBAT parses the CSV lines of an SBAT section.
+func parseSBAT(data string) []SBATEntry {
+	var entries []SBATEntry
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, ",", 6)
+		if len(fields) < 2 {
+			continue
+		}
+		fields = append(fields, make([]string, 6-len(fields))...)
+
+		entries = append(entries, SBATEntry{
+			Component:  fields[0],
+			Generation: fields[1],
+			Vendor:     fields[2],
+			Package:    fields[3],
+			Version:    fields[4],
+			URL:        fields[5],
+		})
+	}
+
+	return entries
+}
+
+// BootFileInfo describes the boot.efi a machine would be served.
+type BootFileInfo struct {
+	Filename     string   `json:"file_name"`
+	Directory    string   `json:"directory"`
+	SHA256       string   `json:"sha256"`
+	Size         int64    `json:"size"`
+	Image        string   `json:"image,omitempty"`
+	ImageVersion string   `json:"image_version,omitempty"`
+	Rollout      string   `json:"rollout,omitempty"`
+	UKI          *UKIInfo `json:"uki,omitempty"`
+	// Signature is set with -authenticode-trusted-certs
+	Signature *SignatureInfo `json:"signature,omitempty"`
+}
+
+// serveBootFileInfo describes the machine's boot.efi without serving it.
+func serveBootFileInfo(w http.ResponseWriter, netbootDir string, mac net.HardwareAddr) {
+	const rel = "boot.efi"
+
+	dirs, image, rollout, pinned := machineFileDirs(netbootDir, mac)
+
+	f, stat, dir, err := openTreeFile(dirs, rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	name := path.Join(dir, rel)
+
+	sum, err := fileSHA256(name, f, stat)
+	if err != nil {
+		log.Printf("Hashing %s: %v", name, err)
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	info := BootFileInfo{
+		Filename:  rel,
+		Directory: dir,
+		SHA256:    sha256Hex(sum),
+		Size:      stat.Size(),
+		UKI:       ukiInfoFor(sha256Hex(sum), f),
+	}
+
+	if authenticodeTrusted != nil {
+		info.Signature = authenticodeFor(info.SHA256, f, stat.Size())
+	}
+
+	if pinned && dir == catalog.ImageDir(image) {
+		info.Image = image.Name
+		info.ImageVersion = image.Version
+		info.Rollout = rollout
+	}
+
+	writeJSON(w, info)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// systemd-stub loads addons and credentials from the directory named after
+// the UKI, so the machine's generated extras are served from there.
+const (
+	ukiExtraDir = "boot.efi.extra.d"
+	// ukiAddonName is the addon carrying the machine's uki_cmdline
+	ukiAddonName = "dhcpv6macd.addon.efi"
+	// ukiCredentialSuffix is appended to the names of the machine's
+	// uki_credentials
+	ukiCredentialSuffix = ".cred"
+)
+
+var errNoUKIExtra = errors.New("no such UKI extra")
+
+// ukiExtraNames lists the machine's generated extras, as paths in its tree.
+func ukiExtraNames(mac net.HardwareAddr) []string {
+	var names []string
+
+	if inventory.HasUKICmdline(mac) {
+		names = append(names, path.Join(ukiExtraDir, ukiAddonName))
+	}
+
+	for _, name := range inventory.UKICredentialNames(mac) {
+		names = append(names, path.Join(ukiExtraDir, name+ukiCredentialSuffix))
+	}
+
+	return names
+}
+
+// renderUKIExtra renders one of the machine's generated extras, rel being its
+// path in the machine's tree. It returns errNoUKIExtra if the machine has no
+// such extra. machineType is the PE machine type of addons.
+func renderUKIExtra(mac net.HardwareAddr, ctx BootTemplateContext, rel string, machineType uint16) ([]byte, error) {
+	dir, name := path.Split(rel)
+	if dir != ukiExtraDir+"/" {
+		return nil, errNoUKIExtra
+	}
+
+	if name == ukiAddonName {
+		cmdline, ok, err := inventory.UKICmdline(mac, ctx)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, errNoUKIExtra
+		}
+
+		return buildUKIAddon(machineType, cmdline), nil
+	}
+
+	if credential, ok := strings.CutSuffix(name, ukiCredentialSuffix); ok {
+		data, ok, err := inventory.UKICredential(mac, credential, ctx)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, errNoUKIExtra
+		}
+
+		return data, nil
+	}
+
+	return nil, errNoUKIExtra
+}
+
+// ukiMachineType is the PE machine type of the machine's boot.efi, so its
+// addons match it, defaulting to x86-64.
+func ukiMachineType(netbootDir string, mac net.HardwareAddr) uint16 {
+	dirs, _, _, _ := machineFileDirs(netbootDir, mac)
+
+	f, _, _, err := openTreeFile(dirs, "boot.efi")
+	if err != nil {
+		return pe.IMAGE_FILE_MACHINE_AMD64
+	}
+	defer f.Close()
+
+	file, err := pe.NewFile(f)
+	if err != nil {
+		return pe.IMAGE_FILE_MACHINE_AMD64
+	}
+
+	return file.Machine
+}
+
+// buildUKIAddon builds an unsigned PE32+ EFI application holding just a
+// .cmdline section, which systemd-stub appends to the UKI's own command
+// line. With Secure Boot, systemd-stub refuses unsigned addons.
+func buildUKIAddon(machineType uint16, cmdline string) []byte {
+	const (
+		peOffset         = 0x40
+		fileAlignment    = 0x200
+		sectionAlignment = 0x1000
+		// IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_READ
+		dataCharacteristics = 0x40000040
+	)
+
+	align := func(n, to uint32) uint32 {
+		return (n + to - 1) &^ (to - 1)
+	}
+
+	data := []byte(cmdline)
+	rawSize := align(uint32(len(data)), fileAlignment)
+
+	var buf bytes.Buffer
+
+	dos := make([]byte, peOffset)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], peOffset)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              machineType,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: uint16(binary.Size(pe.OptionalHeader64{})),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE | pe.IMAGE_FILE_LARGE_ADDRESS_AWARE,
+	})
+
+	binary.Write(&buf, binary.LittleEndian, pe.OptionalHeader64{
+		Magic:                 0x20b,
+		SizeOfInitializedData: rawSize,
+		ImageBase:             0x10000000,
+		SectionAlignment:      sectionAlignment,
+		FileAlignment:         fileAlignment,
+		SizeOfImage:           sectionAlignment + align(uint32(len(data)), sectionAlignment),
+		SizeOfHeaders:         fileAlignment,
+		Subsystem:             pe.IMAGE_SUBSYSTEM_EFI_APPLICATION,
+		NumberOfRvaAndSizes:   16,
+	})
+
+	header := pe.SectionHeader32{
+		VirtualSize:      uint32(len(data)),
+		VirtualAddress:   sectionAlignment,
+		SizeOfRawData:    rawSize,
+		PointerToRawData: fileAlignment,
+		Characteristics:  dataCharacteristics,
+	}
+	copy(header.Name[:], ".cmdline")
+	binary.Write(&buf, binary.LittleEndian, header)
+
+	buf.Write(make([]byte, fileAlignment-buf.Len()))
+	buf.Write(data)
+	buf.Write(make([]byte, int(rawSize)-len(data)))
+
+	return buf.Bytes()
+}
+
+// serveUKIExtra serves one of the machine's generated extras, if the request
+// is verified to come from the machine. It returns false, having written
+// nothing, if the machine has no such extra.
+func serveUKIExtra(w http.ResponseWriter, r *http.Request, a *Allocator, machine *Machine, netbootDir, rel string, verified bool) bool {
+	mac := net.HardwareAddr(machine.Mac)
+	ctx := machineTemplateContext(a, mac, machine, nil)
+
+	data, err := renderUKIExtra(mac, ctx, rel, ukiMachineType(netbootDir, mac))
+	if errors.Is(err, errNoUKIExtra) {
+		return false
+	}
+
+	if !verified {
+		denyFetch(w, r, machine, errors.New("UKI extras need -boot-url-key-file or -require-source-mac"))
+		return true
+	}
+
+	event := TransferEvent{
+		Protocol: requestProtocol(r),
+		Filename: rel,
+		State:    "error",
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+		recordTransfer(r.Context(), machine, fileEventFor(rel), event)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+
+	sum := sha256.Sum256(data)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Repr-Digest", reprDigest(sum[:]))
+	http.ServeContent(w, r, rel, time.Time{}, bytes.NewReader(data))
+
+	if r.Method != http.MethodHead {
+		event.State = "complete"
+		event.SHA256 = sha256Hex(sum[:])
+		event.SentBytes = int64(len(data))
+		event.TotalBytes = int64(len(data))
+		recordTransfer(r.Context(), machine, fileEventFor(rel), event)
+	}
+
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUKIExtras(t *testing.T) {
+	inventory = loadTestInventory(t, `{
+		"groups": {
+			"shared-uki": {
+				"uki_cmdline": "hostname={{.Hostname}}",
+				"uki_credentials": {"hostname": "{{.Hostname}}", "role": "worker"}
+			}
+		},
+		"machines": {
+			"04:42:1a:03:9b:20": {
+				"hostname": "r1n1",
+				"groups": ["shared-uki"],
+				"uki_credentials": {"role": "control-plane"}
+			}
+		}
+	}`)
+	defer func() { inventory = nil }()
+
+	mac, _ := net.ParseMAC("04:42:1a:03:9b:20")
+
+	want := []string{
+		"boot.efi.extra.d/dhcpv6macd.addon.efi",
+		"boot.efi.extra.d/hostname.cred",
+		"boot.efi.extra.d/role.cred",
+	}
+	if got := ukiExtraNames(mac); !slices.Equal(got, want) {
+		t.Fatalf("Wanted %v, got %v", want, got)
+	}
+
+	mux, _, _ := newTestWebserver(t, t.TempDir())
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = net.JoinHostPort(NewAllocator(net.ParseIP("fec0::")).AddressFor(mac).String(), "40000")
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// Anyone could ask for a MAC's extras without a check of who's asking
+	w := get("/mac/04:42:1a:03:9b:20/boot.efi.extra.d/hostname.cred")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Wanted the extras refused without -require-source-mac, got %d", w.Code)
+	}
+	if w = get("/boot.efi.extra.d/hostname.cred"); w.Code != http.StatusOK {
+		t.Fatalf("Wanted the extras for a MAC found by the source address, got %d", w.Code)
+	}
+
+	*requireSourceMAC = true
+	defer func() { *requireSourceMAC = false }()
+
+	w = get("/mac/04:42:1a:03:9b:20/boot.efi.extra.d/dhcpv6macd.addon.efi")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wanted the addon, got %d %q", w.Code, w.Body.String())
+	}
+
+	addon, err := pe.NewFile(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("The addon isn't a PE file: %v", err)
+	}
+	if addon.Machine != pe.IMAGE_FILE_MACHINE_AMD64 {
+		t.Fatalf("Wanted an x86-64 addon without a boot.efi, got %#x", addon.Machine)
+	}
+	if header, ok := addon.OptionalHeader.(*pe.OptionalHeader64); !ok || header.Subsystem != pe.IMAGE_SUBSYSTEM_EFI_APPLICATION {
+		t.Fatalf("Wanted an EFI application, got %+v", addon.OptionalHeader)
+	}
+	if cmdline := sectionString(addon, ".cmdline"); cmdline != "hostname=r1n1" {
+		t.Fatalf("Wanted the rendered command line, got %q", cmdline)
+	}
+
+	// The machine's own credentials win over its groups'
+	for name, want := range map[string]string{"hostname": "r1n1", "role": "control-plane"} {
+		w = get("/mac/04:42:1a:03:9b:20/boot.efi.extra.d/" + name + ".cred")
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Fatalf("Wanted %s to be %q, got %d %q", name, want, w.Code, w.Body.String())
+		}
+	}
+
+	// Anything else in the directory comes from the file tree
+	if w = get("/mac/04:42:1a:03:9b:20/boot.efi.extra.d/other.cred"); w.Code != http.StatusNotFound {
+		t.Fatalf("Wanted 404 for an unknown credential, got %d", w.Code)
+	}
+
+	// Without a script template, iPXE gets one which fetches the extras next
+	// to the UKI
+	if tmpl := ipxeScriptTemplateFor(mac); tmpl != defaultIPXEScriptTemplate {
+		t.Fatalf("Wanted the default script for a UKI machine with extras")
+	}
+	w = get("/mac/04:42:1a:03:9b:20/" + ipxeScriptName)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wanted the script, got %d", w.Code)
+	}
+	script := w.Body.String()
+	for _, extra := range want {
+		fetch := "imgfetch --name " + extra + " http://[fec0::]/mac/04:42:1a:03:9b:20/" + extra + "\n"
+		if !strings.Contains(script, fetch) {
+			t.Fatalf("Wanted the script to fetch %s, got %q", extra, script)
+		}
+	}
+	if !strings.HasSuffix(script, "\nchain http://[fec0::]/mac/04:42:1a:03:9b:20/boot.efi\n") {
+		t.Fatalf("Wanted the script to chain boot.efi after the extras, got %q", script)
+	}
+
+	other, _ := net.ParseMAC("04:42:1a:03:9b:21")
+	if tmpl := ipxeScriptTemplateFor(other); tmpl != nil {
+		t.Fatalf("Wanted UKI machines without extras chained straight to the boot URL")
+	}
+
+	arm := buildUKIAddon(pe.IMAGE_FILE_MACHINE_ARM64, "quiet")
+	if addon, err := pe.NewFile(bytes.NewReader(arm)); err != nil || addon.Machine != pe.IMAGE_FILE_MACHINE_ARM64 {
+		t.Fatalf("Wanted an arm64 addon, got %v", err)
+	}
+}
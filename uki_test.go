@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testSection struct {
+	name string
+	data string
+}
+
+// buildTestPE builds a minimal PE/COFF file with the sections, padding each
+// to a 512 byte file alignment.
+func buildTestPE(t *testing.T, sections []testSection) []byte {
+	const peOffset = 0x40
+
+	var buf bytes.Buffer
+	dos := make([]byte, peOffset)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], peOffset)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:          pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections: uint16(len(sections)),
+	})
+
+	offset := uint32(1024)
+	for _, s := range sections {
+		var header pe.SectionHeader32
+		copy(header.Name[:], s.name)
+		header.VirtualSize = uint32(len(s.data))
+		header.SizeOfRawData = (uint32(len(s.data)) + 511) &^ 511
+		header.PointerToRawData = offset
+		binary.Write(&buf, binary.LittleEndian, header)
+		offset += header.SizeOfRawData
+	}
+
+	if buf.Len() > 1024 {
+		t.Fatal("Too many sections for the test PE")
+	}
+	buf.Write(make([]byte, 1024-buf.Len()))
+
+	for _, s := range sections {
+		buf.WriteString(s.data)
+		buf.Write(make([]byte, ((len(s.data)+511)&^511)-len(s.data)))
+	}
+
+	return buf.Bytes()
+}
+
+var testUKISections = []testSection{
+	{".osrel", "NAME=NixOS\nID=nixos\nVERSION_ID=\"25.11\"\n# comment\n"},
+	{".cmdline", "init=/init console=ttyS0\n"},
+	{".uname", "6.12.1"},
+	{".sbat", "sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\nsystemd-stub,1,The systemd Developers,systemd,257,https://systemd.io/\n"},
+	{".linux", "not really a kernel"},
+}
+
+func TestInspectUKI(t *testing.T) {
+	info := inspectUKI(bytes.NewReader(buildTestPE(t, testUKISections)))
+	if info == nil {
+		t.Fatal("Wanted a UKI")
+	}
+
+	if info.OSRelease["ID"] != "nixos" || info.OSRelease["VERSION_ID"] != "25.11" || len(info.OSRelease) != 3 {
+		t.Fatalf("Wrong os-release: %v", info.OSRelease)
+	}
+	if info.Cmdline != "init=/init console=ttyS0" || info.Uname != "6.12.1" {
+		t.Fatalf("Wrong cmdline or uname: %q %q", info.Cmdline, info.Uname)
+	}
+	if len(info.SBAT) != 2 || info.SBAT[1].Component != "systemd-stub" || info.SBAT[1].Version != "257" {
+		t.Fatalf("Wrong SBAT: %+v", info.SBAT)
+	}
+
+	// A PE without a kernel is just an EFI program
+	if info := inspectUKI(bytes.NewReader(buildTestPE(t, testUKISections[:2]))); info != nil {
+		t.Fatalf("Wanted no UKI without .linux, got %+v", info)
+	}
+
+	if info := inspectUKI(bytes.NewReader([]byte("#!ipxe\nexit\n"))); info != nil {
+		t.Fatalf("Wanted no UKI from a script, got %+v", info)
+	}
+}
+
+func TestServeUKIInfo(t *testing.T) {
+	dir := t.TempDir()
+	macDir := filepath.Join(dir, "04:42:1a:03:9b:20")
+	if err := os.MkdirAll(macDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(macDir, "boot.efi"), buildTestPE(t, testUKISections), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(macDir, "copy.efi"), buildTestPE(t, testUKISections), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, broker, _ := newTestWebserver(t, dir)
+
+	getInfo := func(target, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		// Even from the machine's own address
+		r.RemoteAddr = "[fec0::442:1a03:9b20]:1234"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// The cmdline may hold secrets, so the info is only for operators
+	if w := getInfo("/mac/04:42:1a:03:9b:20/boot.efi/info", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Wanted the info refused without -admin-token-file, got %d", w.Code)
+	}
+
+	adminToken = []byte("hunter2")
+	defer func() { adminToken = nil }()
+
+	if w := getInfo("/mac/04:42:1a:03:9b:20/boot.efi/info", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Wanted the info refused with the wrong token, got %d", w.Code)
+	}
+
+	w := getInfo("/mac/04:42:1a:03:9b:20/boot.efi/info", "hunter2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wanted the info, got %d %q", w.Code, w.Body.String())
+	}
+
+	var info BootFileInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.UKI == nil || info.UKI.OSRelease["VERSION_ID"] != "25.11" || info.SHA256 == "" || info.Filename != "boot.efi" {
+		t.Fatalf("Wanted the UKI's metadata, got %+v", info)
+	}
+
+	subscriber, unsubscribe := broker.SubscribeBuffered(16)
+	defer unsubscribe()
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/boot.efi", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wanted boot.efi, got %d", w.Code)
+	}
+
+	ev := <-subscriber
+	for ev.Event.Event != "http_fetch_uki" {
+		ev = <-subscriber
+	}
+	detail, ok := ev.Event.Detail.(TransferEvent)
+	if !ok || detail.UKI == nil || detail.UKI.Uname != "6.12.1" {
+		t.Fatalf("Wanted the UKI's metadata in http_fetch_uki, got %+v", ev.Event)
+	}
+
+	// Only boot.efi is reported as a UKI
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/mac/04:42:1a:03:9b:20/copy.efi", nil))
+	for len(subscriber) > 0 {
+		if detail, ok := (<-subscriber).Event.Detail.(TransferEvent); ok && strings.HasSuffix(detail.Filename, "copy.efi") && detail.UKI != nil {
+			t.Fatalf("Wanted no UKI metadata for other files, got %+v", detail)
+		}
+	}
+
+	w = getInfo("/mac/04:42:1a:03:9b:21/boot.efi/info", "hunter2")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Wanted 404 for a machine without boot.efi, got %d", w.Code)
+	}
+}
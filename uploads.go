@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+// Uploads are the crash dumps, firmware logs and such which machines push
+// with TFTP writes. Each machine's uploads are in a directory named after its
+// MAC, and count against its quota and the directory's total quota.
+//
+// Concurrent uploads may overshoot the quotas, by at most the size of the
+// uploads which finish while the others are still going.
+type Uploads struct {
+	dir        string
+	maxSize    int64
+	quota      int64
+	totalQuota int64
+
+	mu sync.Mutex
+	// inflight are the bytes of each MAC's unfinished uploads
+	inflight map[string]int64
+}
+
+var uploads *Uploads
+
+var (
+	errUploadTooLarge = errors.New("the upload is larger than -tftp-upload-max-size")
+	errUploadQuota    = errors.New("the upload would go over the machine's -tftp-upload-quota")
+	errUploadTotal    = errors.New("the upload would go over -tftp-upload-total-quota")
+)
+
+// Upload names are a single path element, and don't start with a dot, which
+// is kept for the files being received
+var uploadNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+
+// Upload is a file a machine has uploaded.
+type Upload struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func NewUploads(dir string, maxSize, quota, totalQuota int64) (*Uploads, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating the upload directory: %w", err)
+	}
+
+	return &Uploads{
+		dir:        dir,
+		maxSize:    maxSize,
+		quota:      quota,
+		totalQuota: totalQuota,
+		inflight:   make(map[string]int64),
+	}, nil
+}
+
+func (u *Uploads) dirFor(mac net.HardwareAddr) string {
+	return filepath.Join(u.dir, mac.String())
+}
+
+// List is the machine's uploads, by name.
+func (u *Uploads) List(mac net.HardwareAddr) ([]Upload, error) {
+	entries, err := os.ReadDir(u.dirFor(mac))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Upload{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	list := []Upload{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !uploadNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		list = append(list, Upload{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Open opens one of the machine's uploads.
+func (u *Uploads) Open(mac net.HardwareAddr, name string) (*os.File, error) {
+	if !uploadNamePattern.MatchString(name) {
+		return nil, fs.ErrNotExist
+	}
+
+	return os.Open(filepath.Join(u.dirFor(mac), name))
+}
+
+// used is the size of the machine's uploads, except the one named except,
+// which is being replaced.
+func (u *Uploads) used(mac net.HardwareAddr, except string) (int64, error) {
+	list, err := u.List(mac)
+	if err != nil {
+		return 0, err
+	}
+
+	var used int64
+	for _, upload := range list {
+		if upload.Name != except {
+			used += upload.Size
+		}
+	}
+	return used, nil
+}
+
+// totalUsed is the size of every machine's uploads, except the machine's one
+// named except, which is being replaced.
+func (u *Uploads) totalUsed(mac net.HardwareAddr, except string) (int64, error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		dirMAC, err := net.ParseMAC(entry.Name())
+		if !entry.IsDir() || err != nil || dirMAC.String() != entry.Name() {
+			continue
+		}
+
+		replaced := ""
+		if dirMAC.String() == mac.String() {
+			replaced = except
+		}
+		used, err := u.used(dirMAC, replaced)
+		if err != nil {
+			return 0, err
+		}
+		total += used
+	}
+	return total, nil
+}
+
+// inflightTotal is the bytes of every machine's unfinished uploads. The
+// caller holds mu.
+func (u *Uploads) inflightTotal() int64 {
+	var total int64
+	for _, n := range u.inflight {
+		total += n
+	}
+	return total
+}
+
+// Check refuses an upload of size bytes which wouldn't fit.
+func (u *Uploads) Check(mac net.HardwareAddr, name string, size int64) error {
+	if size > u.maxSize {
+		return errUploadTooLarge
+	}
+
+	used, err := u.used(mac, name)
+	if err != nil {
+		return err
+	}
+
+	total, err := u.totalUsed(mac, name)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if used+u.inflight[mac.String()]+size > u.quota {
+		return errUploadQuota
+	}
+	if total+u.inflightTotal()+size > u.totalQuota {
+		return errUploadTotal
+	}
+	return nil
+}
+
+// Receive stores an upload read from r, replacing any upload of the same
+// name once it's complete. It returns the upload's size and SHA-256.
+func (u *Uploads) Receive(mac net.HardwareAddr, name string, r io.Reader) (int64, []byte, error) {
+	if !uploadNamePattern.MatchString(name) {
+		return 0, nil, fmt.Errorf("invalid upload name %q", name)
+	}
+
+	used, err := u.used(mac, name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	total, err := u.totalUsed(mac, name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dir := u.dirFor(mac)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return 0, nil, err
+	}
+
+	f, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	w := &quotaWriter{uploads: u, mac: mac.String(), used: used, total: total, w: io.MultiWriter(f, hash)}
+	defer w.release()
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return n, nil, err
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return n, nil, err
+	}
+
+	return n, hash.Sum(nil), nil
+}
+
+// quotaWriter fails writes which would take an upload over the maximum size,
+// or the machine or the directory over their quotas.
+type quotaWriter struct {
+	uploads *Uploads
+	mac     string
+	// used is the size of the machine's other uploads, and total of every
+	// machine's
+	used    int64
+	total   int64
+	written int64
+	w       io.Writer
+}
+
+func (q *quotaWriter) Write(b []byte) (int, error) {
+	n := int64(len(b))
+	if q.written+n > q.uploads.maxSize {
+		return 0, errUploadTooLarge
+	}
+
+	var err error
+	q.uploads.mu.Lock()
+	if q.used+q.uploads.inflight[q.mac]+n > q.uploads.quota {
+		err = errUploadQuota
+	} else if q.total+q.uploads.inflightTotal()+n > q.uploads.totalQuota {
+		err = errUploadTotal
+	} else {
+		q.uploads.inflight[q.mac] += n
+		q.written += n
+	}
+	q.uploads.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return q.w.Write(b)
+}
+
+func (q *quotaWriter) release() {
+	q.uploads.mu.Lock()
+	defer q.uploads.mu.Unlock()
+
+	q.uploads.inflight[q.mac] -= q.written
+	if q.uploads.inflight[q.mac] <= 0 {
+		delete(q.uploads.inflight, q.mac)
+	}
+}
+
+// tftpWriteHandler receives uploads into the machine's upload directory. As
+// with reads, the path may start with the MAC, or the MAC is recovered from
+// the client's source address. Either way, unlike reads, the source address
+// must be the machine's own.
+func tftpWriteHandler(a *Allocator, u *Uploads) func(string, io.WriterTo) error {
+	return func(filename string, wt io.WriterTo) error {
+		return receiveUpload(a, u, filename, wt)
+	}
+}
+
+func receiveUpload(a *Allocator, u *Uploads, filename string, wt io.WriterTo) error {
+	transfer := wt.(tftp.IncomingTransfer)
+	source := transfer.RemoteAddr()
+
+	name := strings.TrimLeft(filename, "/")
+
+	var pathMAC net.HardwareAddr
+	if mac, err := parseMACFromPath(name); err == nil {
+		pathMAC = mac
+		_, name, _ = strings.Cut(name, "/")
+	}
+
+	event := TransferEvent{
+		Protocol: "tftp",
+		Filename: name,
+		State:    "denied",
+	}
+
+	mac, err := resolveMAC(a, pathMAC, source.IP, true)
+	if err != nil {
+		log.Printf("Refusing the upload of %s from %s: %v", filename, source.String(), err)
+		if pathMAC != nil {
+			event.Error = err.Error()
+			machines.GetOrInitMachine(pathMAC).Notify("tftp_upload", event)
+		}
+		return err
+	}
+
+	machine := machines.GetOrInitMachine(mac)
+	event.Directory = u.dirFor(mac)
+
+	deny := func(err error) error {
+		log.Printf("Refusing the upload of %s from %s: %v", filename, source.String(), err)
+		event.Error = err.Error()
+		machine.Notify("tftp_upload", event)
+		return err
+	}
+
+	if !uploadNamePattern.MatchString(name) {
+		return deny(fmt.Errorf("invalid upload name %q", name))
+	}
+
+	// Clients which send the size can be refused before they send anything
+	if size, ok := transfer.Size(); ok {
+		event.TotalBytes = size
+		if err := u.Check(mac, name, size); err != nil {
+			return deny(err)
+		}
+	}
+
+	log.Printf("Receiving %s from %s", name, source.String())
+	event.State = "init"
+	machine.Notify("tftp_upload", event)
+	event.State = "receiving"
+
+	pr, pw := io.Pipe()
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		_, err := wt.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+
+	r := newProgressReader(pr, func(bytes int64) error {
+		event.SentBytes = bytes
+		machine.Progress("tftp_upload", event)
+		return nil
+	})
+
+	start := time.Now()
+	n, sum, err := u.Receive(mac, name, r)
+	// Stop the transfer, if we're the ones who failed, before the server
+	// gets our error
+	pr.CloseWithError(err)
+	<-received
+
+	event.SentBytes = n
+	event.finished(time.Since(start))
+	if err != nil {
+		event.State = "error"
+		event.Error = err.Error()
+		machine.Notify("tftp_upload", event)
+		log.Printf("Receiving failure: %v", err)
+		return err
+	}
+
+	event.State = "complete"
+	event.SHA256 = sha256Hex(sum)
+	machine.Notify("tftp_upload", event)
+	log.Printf("%d bytes received for %s", n, name)
+	return nil
+}
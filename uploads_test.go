@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+func TestTFTPUploads(t *testing.T) {
+	broker := NewBroker()
+	machines = NewMachines(broker)
+
+	dir := t.TempDir()
+	var err error
+	uploads, err = NewUploads(dir, 4096, 6000, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { uploads = nil }()
+
+	// Another machine's uploads take 5000 bytes of the total quota
+	other := "04:42:1a:03:9b:21"
+	if err := os.MkdirAll(filepath.Join(dir, other), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, other, "old.log"), make([]byte, 5000), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads must come from the machine's address, and ::1 is 00:00:00:00:00:01's
+	a := NewAllocator(net.ParseIP("::"))
+
+	conn, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTFTPServer(a, "")
+	go server.Serve(conn)
+	defer server.Shutdown()
+
+	subscriber, unsubscribe := broker.SubscribeBuffered(64)
+	defer unsubscribe()
+
+	client, err := tftp.NewClient(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetTimeout(time.Second)
+	client.SetRetries(1)
+
+	send := func(filename string, data []byte, withSize bool) error {
+		rf, err := client.Send(filename, "octet")
+		if err != nil {
+			return err
+		}
+		if withSize {
+			rf.(tftp.OutgoingTransfer).SetSize(int64(len(data)))
+		}
+		_, err = rf.ReadFrom(bytes.NewReader(data))
+		return err
+	}
+
+	mac := "00:00:00:00:00:01"
+	crash := bytes.Repeat([]byte("panic "), 500)
+
+	if err := send(mac+"/crash.log", crash, true); err != nil {
+		t.Fatalf("Wanted the upload accepted: %v", err)
+	}
+
+	for {
+		ev := <-subscriber
+		detail, ok := ev.Event.Detail.(TransferEvent)
+		if ev.Event.Event != "tftp_upload" || !ok || detail.State != "complete" {
+			continue
+		}
+		if detail.Filename != "crash.log" || detail.SentBytes != int64(len(crash)) || detail.SHA256 == "" {
+			t.Fatalf("Wrong upload event: %+v", detail)
+		}
+		break
+	}
+
+	// The last block is only acknowledged once the upload is in place
+	if data, err := os.ReadFile(filepath.Join(dir, mac, "crash.log")); err != nil || !bytes.Equal(data, crash) {
+		t.Fatalf("The upload doesn't match what was sent: %v", err)
+	}
+
+	for _, tc := range []struct {
+		filename string
+		size     int
+		withSize bool
+	}{
+		{mac + "/../escape.log", 10, true},
+		{mac + "/.hidden", 10, true},
+		{mac + "/big.bin", 5000, true},
+		{mac + "/big.bin", 5000, false},
+		// crash.log takes 3000 bytes of the quota
+		{mac + "/second.log", 4000, true},
+		{mac + "/second.log", 4000, false},
+		{other + "/crash.log", 10, true},
+	} {
+		if err := send(tc.filename, make([]byte, tc.size), tc.withSize); err == nil {
+			t.Errorf("%s (%d bytes, size sent %v): wanted a refusal", tc.filename, tc.size, tc.withSize)
+		}
+	}
+
+	// Replacing an upload only counts the new one
+	if err := send(mac+"/crash.log", make([]byte, 4000), true); err != nil {
+		t.Fatalf("Wanted the replacement accepted: %v", err)
+	}
+
+	// The machine has room for this, but the directory doesn't
+	if err := send(mac+"/third.log", make([]byte, 1500), true); err == nil {
+		t.Errorf("Wanted an upload over the total quota refused")
+	}
+	if err := send("third.log", make([]byte, 1500), false); err == nil {
+		t.Errorf("Wanted an upload over the total quota refused, without its size sent")
+	}
+
+	mux, err := webserver("", broker, machines, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/machines/"+mac+"/uploads", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Wanted uploads refused without -admin-token-file, got %d", w.Code)
+	}
+
+	adminToken = []byte("hunter2")
+	defer func() { adminToken = nil }()
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Authorization", "Bearer hunter2")
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w = get("/machines/" + mac + "/uploads")
+
+	var list []Upload
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "crash.log" || list[0].Size != 4000 {
+		t.Fatalf("Wanted just the replaced crash.log, got %+v", list)
+	}
+
+	w = get("/machines/" + mac + "/uploads/crash.log")
+	if w.Code != http.StatusOK || w.Body.Len() != 4000 {
+		t.Fatalf("Wanted the upload, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}